@@ -0,0 +1,87 @@
+// Package audit ведёт журнал действий модераторов и администраторов
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/dvgavrilov/gochat/service/source/models"
+	"github.com/dvgavrilov/gochat/service/source/persistence"
+	"github.com/sirupsen/logrus"
+)
+
+// Действия, попадающие в журнал
+const (
+	ConversationRead       = "conversation.read"
+	ConversationAssign     = "conversation.assign"
+	ConversationTransfer   = "conversation.transfer"
+	ConversationStatus     = "conversation.status"
+	ConversationExport     = "conversation.export"
+	MembershipDenied       = "conversation.access_denied"
+	UnreadGlobalMarkedRead = "unread.global_marked_read"
+	AdminDisconnect        = "admin.disconnect"
+	AdminRemoveFromRoom    = "admin.remove_from_room"
+	AdminAnnouncement      = "admin.announcement"
+	ConfigReload           = "config.reload"
+	RetentionPurge         = "retention.purge"
+	SubjectExport          = "user.data_export"
+	SubjectErasure         = "user.data_erasure"
+	Reencryption           = "encryption.reencrypt"
+)
+
+// Типы объектов действия
+const (
+	TargetConversation = "conversation"
+	TargetMessage      = "message"
+	TargetUser         = "user"
+	TargetRoom         = "room"
+	TargetConfig       = "config"
+)
+
+// Actor кто выполнил действие. Нулевой ActorID означает сам сервер, например, перезагрузку по SIGHUP
+type Actor struct {
+	ID         uint
+	Role       string
+	RemoteAddr string
+}
+
+// Record добавляет запись в журнал. Ошибка записи не прерывает действие, а пишется в лог
+// вместе с содержимым записи, чтобы его можно было восстановить.
+func Record(actor Actor, action string, targetType string, targetID interface{}, metadata map[string]interface{}) {
+	entry := &models.AuditEntry{
+		ActorID:    actor.ID,
+		ActorRole:  actor.Role,
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   fmt.Sprintf("%v", targetID),
+		RemoteAddr: actor.RemoteAddr,
+		CreatedAt:  time.Now().UTC(),
+	}
+
+	if len(metadata) > 0 {
+		raw, err := json.Marshal(metadata)
+		if err != nil {
+			logrus.Error(err)
+		} else {
+			entry.Metadata = string(raw)
+		}
+	}
+
+	err := persistence.GetAuditProvider().Add(entry)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"audit":       action,
+			"actor_id":    entry.ActorID,
+			"actor_role":  entry.ActorRole,
+			"target_type": entry.TargetType,
+			"target_id":   entry.TargetID,
+			"metadata":    entry.Metadata,
+		}).Error(fmt.Sprintf("audit entry was not stored: %v", err))
+	}
+}
+
+// Find ищет записи журнала
+func Find(filter models.AuditFilter) (*[]models.AuditEntry, error) {
+	return persistence.GetAuditProvider().Find(filter)
+}
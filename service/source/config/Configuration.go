@@ -3,8 +3,13 @@ package config
 import (
 	"encoding/json"
 	"os"
+
+	"github.com/dvgavrilov/gochat/service/source/models"
 )
 
+// DefaultPath путь к файлу конфигурации, если он не передан флагом --config
+const DefaultPath = "../config/configuration.json"
+
 // Configuration стуктура
 type Configuration struct {
 	DatabaseSettings    DatabaseSettings
@@ -12,59 +17,356 @@ type Configuration struct {
 	ChatRoomSettings    ChatRoomSettings
 	RedisSettings       RedisSettings
 	ApplicationSettings ApplicationSettings
+	TLSSettings         TLSSettings
+	JWTSettings         JWTSettings
+	PermissionSettings  PermissionSettings
+	MembershipSettings  MembershipSettings
+	RoutingSettings     RoutingSettings
+	SLASettings         SLASettings
+	RetentionSettings   RetentionSettings
+	EncryptionSettings  EncryptionSettings
+	FilterSettings      FilterSettings
+	MetricsSettings     MetricsSettings
 }
 
 // DatabaseSettings стуктура
 type DatabaseSettings struct {
-	Engine   string
-	Server   string
-	Port     string
-	User     string
-	Password string
-	Database string
+	Engine   string `env:"GOCHAT_DATABASE_ENGINE"`
+	Server   string `env:"GOCHAT_DATABASE_SERVER"`
+	Port     int    `env:"GOCHAT_DATABASE_PORT"`
+	User     string `env:"GOCHAT_DATABASE_USER"`
+	Password string `env:"GOCHAT_DATABASE_PASSWORD" secret:"true"`
+	Database string `env:"GOCHAT_DATABASE_NAME"`
 }
 
 // WebSocketSettings struct
 type WebSocketSettings struct {
-	ReadBufferSize  int
-	WriteBufferSize int
-	Port            int
-	Origin          string
+	ReadBufferSize  int    `env:"GOCHAT_WEBSOCKET_READ_BUFFER_SIZE"`
+	WriteBufferSize int    `env:"GOCHAT_WEBSOCKET_WRITE_BUFFER_SIZE"`
+	Port            int    `env:"GOCHAT_WEBSOCKET_PORT"`
+	Origin          string `env:"GOCHAT_WEBSOCKET_ORIGIN" runtime:"true"`
 }
 
 // ChatRoomSettings struct
 type ChatRoomSettings struct {
-	MaxValueOfChatters int
-	CacheHistory       string
+	MaxValueOfChatters int  `env:"GOCHAT_CHATROOM_MAX_CHATTERS" runtime:"true"`
+	CacheHistory       bool `env:"GOCHAT_CHATROOM_CACHE_HISTORY"`
 }
 
 // ApplicationSettings struct
 type ApplicationSettings struct {
-	DebugMode string
+	DebugMode bool `env:"GOCHAT_DEBUG_MODE"`
+	// ShutdownTimeout время в секундах, отведённое на корректную остановку сервера
+	ShutdownTimeout int `env:"GOCHAT_SHUTDOWN_TIMEOUT" runtime:"true"`
+}
+
+// TLSSettings struct. Используются, когда DebugMode выключен
+type TLSSettings struct {
+	CertFile string `env:"GOCHAT_TLS_CERT_FILE"`
+	KeyFile  string `env:"GOCHAT_TLS_KEY_FILE"`
+	// ClientCAFile необязательный файл с CA, при его наличии требуется клиентский сертификат
+	ClientCAFile string `env:"GOCHAT_TLS_CLIENT_CA_FILE"`
+	// MinVersion одно из значений 1.0, 1.1, 1.2, 1.3, по умолчанию 1.2
+	MinVersion string `env:"GOCHAT_TLS_MIN_VERSION"`
+}
+
+// JWTSettings struct. Ключи берутся из JWKSFile и, для HS256, из Secret
+type JWTSettings struct {
+	// Algorithm одно из значений HS256, RS256, ES256
+	Algorithm string `env:"GOCHAT_JWT_ALGORITHM"`
+	Secret    string `env:"GOCHAT_JWT_SECRET" secret:"true" runtime:"true"`
+	// JWKSFile локальный JWKS файл, ключи в нём выбираются по kid, что позволяет ротацию
+	JWKSFile string `env:"GOCHAT_JWT_JWKS_FILE" runtime:"true"`
+	Issuer   string `env:"GOCHAT_JWT_ISSUER" runtime:"true"`
+	Audience string `env:"GOCHAT_JWT_AUDIENCE" runtime:"true"`
+	// SubjectClaim claim с идентификатором пользователя, по умолчанию sub
+	SubjectClaim string `env:"GOCHAT_JWT_SUBJECT_CLAIM"`
+	// RoleClaim claim с ролью пользователя, по умолчанию role. Если его нет,
+	// роль определяется по наличию request_id (customer) или admin_id (agent)
+	RoleClaim string `env:"GOCHAT_JWT_ROLE_CLAIM"`
+	// ApplicationClaim claim с идентификатором приложения или списком приложений, беседы которых
+	// пользователь может создавать и к которым может присоединяться, по умолчанию application_id
+	ApplicationClaim string `env:"GOCHAT_JWT_APPLICATION_CLAIM"`
+	// LegacySidParameter режим совместимости: идентификатор пользователя берётся из параметра sid
+	LegacySidParameter bool `env:"GOCHAT_JWT_LEGACY_SID"`
+}
+
+// PermissionSettings struct. Events сопоставляет имя события или административного действия
+// со списком ролей, которым оно разрешено. Всё, чего нет в списке, запрещено.
+type PermissionSettings struct {
+	Events map[string][]string `env:"GOCHAT_PERMISSIONS" runtime:"true"`
+}
+
+// MembershipSettings struct. Overrides перечисляет для каждой роли действия,
+// которые она может выполнять в беседе, не являясь её участником
+type MembershipSettings struct {
+	Overrides map[string][]string `env:"GOCHAT_MEMBERSHIP_OVERRIDES" runtime:"true"`
+}
+
+// RoutingSettings struct
+type RoutingSettings struct {
+	// Strategy одно из значений round_robin, least_busy, sticky
+	Strategy string `env:"GOCHAT_ROUTING_STRATEGY" runtime:"true"`
+	// Teams команды модераторов, которым можно передавать беседы: имя команды и идентификаторы модераторов
+	Teams map[string][]uint `env:"GOCHAT_ROUTING_TEAMS" runtime:"true"`
+}
+
+// SLASettings struct. Все значения задаются в секундах
+type SLASettings struct {
+	// ResponseTime время, за которое модератор должен ответить на сообщение клиента
+	ResponseTime int `env:"GOCHAT_SLA_RESPONSE_TIME" runtime:"true"`
+	// Applications переопределяет ResponseTime для приложений, ключ - идентификатор приложения
+	Applications map[string]int `env:"GOCHAT_SLA_APPLICATIONS" runtime:"true"`
+	// WarningBefore за сколько до нарушения модераторы получают предупреждение
+	WarningBefore int `env:"GOCHAT_SLA_WARNING_BEFORE" runtime:"true"`
+	// CheckInterval период проверки бесед, ожидающих ответа
+	CheckInterval int `env:"GOCHAT_SLA_CHECK_INTERVAL"`
+}
+
+// RetentionSettings struct. Сроки задаются в днях, 0 означает хранить бессрочно
+type RetentionSettings struct {
+	// MessageDays через сколько дней удаляются сообщения и их отметки о прочтении
+	MessageDays int `env:"GOCHAT_RETENTION_MESSAGE_DAYS" runtime:"true"`
+	// ArchiveResolvedDays через сколько дней после закрытия беседа переводится в archived
+	ArchiveResolvedDays int `env:"GOCHAT_RETENTION_ARCHIVE_RESOLVED_DAYS" runtime:"true"`
+	// Applications заменяет обе политики для приложений, ключ - идентификатор приложения
+	Applications map[string]RetentionPolicy `env:"GOCHAT_RETENTION_APPLICATIONS" runtime:"true"`
+	// DryRun только считает, что было бы удалено, ничего не меняя
+	DryRun bool `env:"GOCHAT_RETENTION_DRY_RUN" runtime:"true"`
+	// BatchSize сколько строк удаляется одной транзакцией
+	BatchSize int `env:"GOCHAT_RETENTION_BATCH_SIZE" runtime:"true"`
+	// CheckInterval период запуска очистки в секундах
+	CheckInterval int `env:"GOCHAT_RETENTION_CHECK_INTERVAL"`
+}
+
+// RetentionPolicy сроки хранения данных одного приложения
+type RetentionPolicy struct {
+	MessageDays         int
+	ArchiveResolvedDays int
+}
+
+// EncryptionSettings struct
+type EncryptionSettings struct {
+	// KeyFile json файл версионных мастер-ключей, пустой путь отключает шифрование сообщений
+	KeyFile string `env:"GOCHAT_ENCRYPTION_KEY_FILE" runtime:"true"`
+	// ReencryptBatchSize сколько сообщений перешифровывается за один запрос к базе
+	ReencryptBatchSize int `env:"GOCHAT_ENCRYPTION_REENCRYPT_BATCH_SIZE" runtime:"true"`
+	// ReencryptInterval период в секундах, с которым сообщения со старым ключом или без шифрования
+	// перешифровываются активным ключом
+	ReencryptInterval int `env:"GOCHAT_ENCRYPTION_REENCRYPT_INTERVAL"`
+}
+
+// FilterSettings struct. Фильтры проверяют текст сообщения перед сохранением в порядке перечисления
+type FilterSettings struct {
+	Default []FilterRule `env:"GOCHAT_FILTERS_DEFAULT" runtime:"true"`
+	// Applications заменяет Default для приложений, ключ - идентификатор приложения
+	Applications map[string][]FilterRule `env:"GOCHAT_FILTERS_APPLICATIONS" runtime:"true"`
+}
+
+// FilterRule один фильтр. Встроенные типы: regex и keywords (списки в Patterns), card, email, phone
+type FilterRule struct {
+	// Name попадает в решение, записанное в сообщение, по умолчанию совпадает с Type
+	Name     string
+	Type     string
+	Action   string // reject, mask или flag
+	Patterns []string
+	// Roles роли отправителей, к сообщениям которых применяется фильтр, пустой список - все роли
+	Roles []string
+}
+
+// MetricsSettings struct. /metrics отдаётся без JWT, доступ к нему ограничивается токеном и списком сетей
+type MetricsSettings struct {
+	Enabled bool `env:"GOCHAT_METRICS_ENABLED" runtime:"true"`
+	// Token если задан, запрос должен передать его в заголовке Authorization: Bearer
+	Token string `env:"GOCHAT_METRICS_TOKEN" secret:"true" runtime:"true"`
+	// AllowedNetworks сети в нотации CIDR, из которых разрешено читать метрики, пустой список - любые
+	AllowedNetworks []string `env:"GOCHAT_METRICS_ALLOWED_NETWORKS" runtime:"true"`
 }
 
 // RedisSettings struct
 type RedisSettings struct {
-	Address string
-	Port    int
+	Address string `env:"GOCHAT_REDIS_ADDRESS"`
+	Port    int    `env:"GOCHAT_REDIS_PORT"`
 }
 
-// Read функция отвечает за загрузка конфигурации с json файла и декодирования его структуру Configuration
-func Read() error {
+// Read функция отвечает за загрузку конфигурации. Значения применяются слоями:
+// значения по умолчанию, затем json файл path, затем переменные окружения GOCHAT_*.
+// Итоговая конфигурация проверяется, все найденные ошибки возвращаются одной ошибкой.
+func Read(path string) error {
 
-	file, err := os.Open("../config/configuration.json")
+	cfg, err := Load(path)
 	if err != nil {
 		return err
 	}
+
+	MainConfiguration = *cfg
+	loadedPath = path
+
+	snapshot := *cfg
+	current.Store(&snapshot)
+
+	return nil
+}
+
+// Load функция собирает и проверяет конфигурацию, не изменяя MainConfiguration
+func Load(path string) (*Configuration, error) {
+	if path == "" {
+		path = DefaultPath
+	}
+
+	cfg := defaults()
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
 	defer file.Close()
 
 	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&MainConfiguration)
+	err = decoder.Decode(cfg)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	errs := applyEnv(cfg)
+	errs = append(errs, cfg.Validate()...)
+	if len(errs) > 0 {
+		return nil, &ValidationError{Problems: errs}
+	}
+
+	return cfg, nil
+}
+
+func defaults() *Configuration {
+	return &Configuration{
+		DatabaseSettings: DatabaseSettings{
+			Engine: "postgres",
+			Port:   5432,
+		},
+		WebSocketSettings: WebSocketSettings{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			Port:            8888,
+		},
+		ChatRoomSettings: ChatRoomSettings{
+			MaxValueOfChatters: 50,
+		},
+		RedisSettings: RedisSettings{
+			Port: 6379,
+		},
+		ApplicationSettings: ApplicationSettings{
+			ShutdownTimeout: 30,
+		},
+		TLSSettings: TLSSettings{
+			MinVersion: "1.2",
+		},
+		JWTSettings: JWTSettings{
+			Algorithm:        "HS256",
+			SubjectClaim:     "sub",
+			RoleClaim:        "role",
+			ApplicationClaim: "application_id",
+		},
+		PermissionSettings: PermissionSettings{
+			Events: defaultPermissions(),
+		},
+		MembershipSettings: MembershipSettings{
+			Overrides: defaultMembershipOverrides(),
+		},
+		RoutingSettings: RoutingSettings{
+			Strategy: "least_busy",
+			Teams:    map[string][]uint{},
+		},
+		SLASettings: SLASettings{
+			ResponseTime:  300,
+			Applications:  map[string]int{},
+			WarningBefore: 60,
+			CheckInterval: 15,
+		},
+		RetentionSettings: RetentionSettings{
+			Applications:  map[string]RetentionPolicy{},
+			BatchSize:     500,
+			CheckInterval: 3600,
+		},
+		EncryptionSettings: EncryptionSettings{
+			ReencryptBatchSize: 200,
+			ReencryptInterval:  600,
+		},
+		FilterSettings: FilterSettings{
+			Default:      []FilterRule{},
+			Applications: map[string][]FilterRule{},
+		},
+		MetricsSettings: MetricsSettings{
+			Enabled:         true,
+			AllowedNetworks: []string{"127.0.0.1/32", "::1/128"},
+		},
+	}
+}
+
+func defaultPermissions() map[string][]string {
+	all := models.Roles
+	writers := []string{models.RoleCustomer, models.RoleAgent, models.RoleSupervisor, models.RoleBot}
+	staff := []string{models.RoleAgent, models.RoleSupervisor, models.RoleAuditor}
+
+	return map[string][]string{
+		"Event.GetConversationList":        all,
+		"Event.AddConversation":            writers,
+		"Action.CreateConversation":        {models.RoleAgent, models.RoleSupervisor},
+		"Event.GetMessageList":             all,
+		"Event.SendMessage":                writers,
+		"Event.ReadMessage":                writers,
+		"Event.GetUnreadInfo":              all,
+		"Event.GetUnreadMessages":          staff,
+		"Event.RefreshToken":               all,
+		"Event.AssignConversation":         {models.RoleAgent, models.RoleSupervisor},
+		"Action.AssignToOthers":            {models.RoleSupervisor},
+		"Action.SendInternalNote":          {models.RoleAgent, models.RoleSupervisor},
+		"Action.ReadInternalNotes":         staff,
+		"Event.TransferConversation":       {models.RoleAgent, models.RoleSupervisor},
+		"Event.GetTransferHistory":         {models.RoleAgent, models.RoleSupervisor, models.RoleAuditor},
+		"Event.ResolveConversation":        {models.RoleAgent, models.RoleSupervisor},
+		"Event.ReopenConversation":         {models.RoleCustomer, models.RoleAgent, models.RoleSupervisor},
+		"Event.ListCannedResponses":        {models.RoleAgent, models.RoleSupervisor},
+		"Event.SaveCannedResponse":         {models.RoleAgent, models.RoleSupervisor},
+		"Event.DeleteCannedResponse":       {models.RoleAgent, models.RoleSupervisor},
+		"Event.SendCannedResponse":         {models.RoleAgent, models.RoleSupervisor},
+		"Action.ManageTeamCannedResponses": {models.RoleSupervisor},
+		"Event.GetConversationStats":       staff,
+		"Action.ExportTranscript":          {models.RoleCustomer, models.RoleAgent, models.RoleSupervisor, models.RoleAuditor},
+		"Report.SLA":                       {models.RoleSupervisor, models.RoleAuditor},
+		"Admin.ReloadConfiguration":        {models.RoleSupervisor},
+		"Admin.ViewHub":                    {models.RoleSupervisor, models.RoleAuditor},
+		"Admin.DisconnectChatter":          {models.RoleSupervisor},
+		"Admin.ManageRooms":                {models.RoleSupervisor},
+		"Admin.Announce":                   {models.RoleSupervisor},
+		"Admin.ManageRetention":            {models.RoleSupervisor},
+		"Admin.ExportUserData":             {models.RoleSupervisor},
+		"Admin.EraseUserData":              {models.RoleSupervisor},
+		"Admin.ManageEncryption":           {models.RoleSupervisor},
+		"Admin.ViewAudit":                  {models.RoleSupervisor, models.RoleAuditor},
+	}
+}
+
+func defaultMembershipOverrides() map[string][]string {
+	moderators := []string{
+		"Event.AddConversation",
+		"Event.GetMessageList",
+		"Event.SendMessage",
+		"Event.ReadMessage",
+		"Event.AssignConversation",
+		"Event.ResolveConversation",
+		"Event.ReopenConversation",
+		"Event.TransferConversation",
+		"Event.GetTransferHistory",
+		"Event.SendCannedResponse",
+		"Event.GetConversationStats",
+		"Action.ExportTranscript",
+	}
+
+	return map[string][]string{
+		models.RoleAgent:      moderators,
+		models.RoleSupervisor: moderators,
+		models.RoleAuditor:    {"Event.GetMessageList", "Event.GetTransferHistory", "Event.GetConversationStats", "Action.ExportTranscript"},
+	}
 }
 
 var MainConfiguration Configuration
@@ -0,0 +1,77 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+)
+
+const envTag = "env"
+
+// applyEnv переопределяет поля конфигурации значениями переменных окружения,
+// имена которых заданы тегом env. Возвращает все ошибки разбора значений.
+func applyEnv(cfg *Configuration) []string {
+	return applyEnvToStruct(reflect.ValueOf(cfg).Elem())
+}
+
+func applyEnvToStruct(v reflect.Value) []string {
+	problems := make([]string, 0)
+
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			problems = append(problems, applyEnvToStruct(field)...)
+			continue
+		}
+
+		name := v.Type().Field(i).Tag.Get(envTag)
+		if name == "" {
+			continue
+		}
+
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		err := setField(field, value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+
+	return problems
+}
+
+func setField(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+		field.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", value)
+		}
+		field.SetBool(b)
+	case reflect.Map, reflect.Slice:
+		// сложные значения передаются в виде json
+		ptr := reflect.New(field.Type())
+		err := json.Unmarshal([]byte(value), ptr.Interface())
+		if err != nil {
+			return fmt.Errorf("%q is not a valid json value: %v", value, err)
+		}
+		field.Set(ptr.Elem())
+	default:
+		return fmt.Errorf("unsupported field type %v", field.Kind())
+	}
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// runtimeTag помечает поля, которые безопасно менять без перезапуска сервера
+const runtimeTag = "runtime"
+
+var (
+	current    atomic.Value
+	reloadMux  sync.Mutex
+	loadedPath string
+)
+
+// Change описывает изменение одного поля конфигурации при перезагрузке
+type Change struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+	// Applied false, если поле требует перезапуска и новое значение было проигнорировано
+	Applied bool `json:"applied"`
+}
+
+// Current возвращает актуальный снимок конфигурации. В отличие от MainConfiguration
+// поля, помеченные тегом runtime, в нём обновляются при перезагрузке.
+func Current() *Configuration {
+	if c, ok := current.Load().(*Configuration); ok {
+		return c
+	}
+
+	return &MainConfiguration
+}
+
+// Reload перечитывает конфигурацию из того же источника, что и Read, и атомарно подменяет
+// снимок, возвращаемый Current. Применяются только поля с тегом runtime, изменения остальных
+// полей возвращаются с Applied == false. Если новая конфигурация не проходит проверку,
+// текущий снимок остаётся прежним.
+func Reload() ([]Change, error) {
+	reloadMux.Lock()
+	defer reloadMux.Unlock()
+
+	loaded, err := Load(loadedPath)
+	if err != nil {
+		return nil, err
+	}
+
+	old := Current()
+	next := *old
+	changes := mergeRuntime(reflect.ValueOf(&next).Elem(), reflect.ValueOf(old).Elem(), reflect.ValueOf(loaded).Elem(), "")
+
+	current.Store(&next)
+	return changes, nil
+}
+
+func mergeRuntime(dst, old, loaded reflect.Value, prefix string) []Change {
+	changes := make([]Change, 0)
+
+	for i := 0; i < dst.NumField(); i++ {
+		field := dst.Type().Field(i)
+		name := prefix + field.Name
+
+		if field.Type.Kind() == reflect.Struct {
+			changes = append(changes, mergeRuntime(dst.Field(i), old.Field(i), loaded.Field(i), name+".")...)
+			continue
+		}
+
+		if reflect.DeepEqual(old.Field(i).Interface(), loaded.Field(i).Interface()) {
+			continue
+		}
+
+		change := Change{
+			Field:   name,
+			Old:     printable(field, old.Field(i)),
+			New:     printable(field, loaded.Field(i)),
+			Applied: field.Tag.Get(runtimeTag) == "true",
+		}
+
+		if change.Applied {
+			dst.Field(i).Set(loaded.Field(i))
+		}
+
+		changes = append(changes, change)
+	}
+
+	return changes
+}
+
+// printable не допускает попадания секретов в журнал
+func printable(field reflect.StructField, v reflect.Value) string {
+	if field.Tag.Get("secret") == "true" {
+		return "***"
+	}
+
+	return fmt.Sprintf("%v", v.Interface())
+}
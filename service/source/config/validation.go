@@ -0,0 +1,259 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/dvgavrilov/gochat/service/source/models"
+)
+
+// ValidationError содержит все ошибки, найденные при проверке конфигурации
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid configuration: %s", strings.Join(e.Problems, "; "))
+}
+
+var tlsVersions = map[string]bool{"1.0": true, "1.1": true, "1.2": true, "1.3": true}
+
+// developmentJWTSecret секрет из примеров configuration.json, годится только для DebugMode.
+// В остальных окружениях секрет задаётся через GOCHAT_JWT_SECRET или JWTSettings.JWKSFile
+const developmentJWTSecret = "gochat-development-secret-do-not-use-in-production"
+
+// Validate проверяет конфигурацию и возвращает список всех найденных ошибок
+func (c *Configuration) Validate() []string {
+	problems := make([]string, 0)
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	db := c.DatabaseSettings
+	if db.Engine != "postgres" {
+		add("DatabaseSettings.Engine: %q is not supported, only postgres is", db.Engine)
+	}
+	if db.Server == "" {
+		add("DatabaseSettings.Server is required")
+	}
+	if !validPort(db.Port) {
+		add("DatabaseSettings.Port: %v is not a valid port", db.Port)
+	}
+	if db.User == "" {
+		add("DatabaseSettings.User is required")
+	}
+	if db.Database == "" {
+		add("DatabaseSettings.Database is required")
+	}
+
+	ws := c.WebSocketSettings
+	if ws.ReadBufferSize <= 0 {
+		add("WebSocketSettings.ReadBufferSize must be positive")
+	}
+	if ws.WriteBufferSize <= 0 {
+		add("WebSocketSettings.WriteBufferSize must be positive")
+	}
+	if !validPort(ws.Port) {
+		add("WebSocketSettings.Port: %v is not a valid port", ws.Port)
+	}
+
+	if c.ChatRoomSettings.MaxValueOfChatters <= 0 {
+		add("ChatRoomSettings.MaxValueOfChatters must be positive")
+	}
+
+	if c.ChatRoomSettings.CacheHistory {
+		if c.RedisSettings.Address == "" {
+			add("RedisSettings.Address is required when ChatRoomSettings.CacheHistory is on")
+		}
+		if !validPort(c.RedisSettings.Port) {
+			add("RedisSettings.Port: %v is not a valid port", c.RedisSettings.Port)
+		}
+	}
+
+	if c.ApplicationSettings.ShutdownTimeout < 0 {
+		add("ApplicationSettings.ShutdownTimeout must not be negative")
+	}
+
+	if !c.ApplicationSettings.DebugMode {
+		if c.TLSSettings.CertFile == "" {
+			add("TLSSettings.CertFile is required when DebugMode is off")
+		}
+		if c.TLSSettings.KeyFile == "" {
+			add("TLSSettings.KeyFile is required when DebugMode is off")
+		}
+	}
+	if c.TLSSettings.MinVersion != "" && !tlsVersions[c.TLSSettings.MinVersion] {
+		add("TLSSettings.MinVersion: %q must be one of 1.0, 1.1, 1.2, 1.3", c.TLSSettings.MinVersion)
+	}
+
+	jwt := c.JWTSettings
+	switch jwt.Algorithm {
+	case "HS256":
+		if jwt.Secret == "" && jwt.JWKSFile == "" {
+			add("JWTSettings.Secret or JWTSettings.JWKSFile is required for HS256")
+		}
+		if jwt.Secret == developmentJWTSecret && !c.ApplicationSettings.DebugMode {
+			add("JWTSettings.Secret: the development secret must be replaced, set GOCHAT_JWT_SECRET when DebugMode is off")
+		}
+	case "RS256", "ES256":
+		if jwt.JWKSFile == "" {
+			add("JWTSettings.JWKSFile is required for %s", jwt.Algorithm)
+		}
+	default:
+		add("JWTSettings.Algorithm: %q must be one of HS256, RS256, ES256", jwt.Algorithm)
+	}
+	if jwt.Issuer == "" {
+		add("JWTSettings.Issuer is required")
+	}
+	if jwt.Audience == "" {
+		add("JWTSettings.Audience is required")
+	}
+
+	for name, roles := range c.PermissionSettings.Events {
+		for _, role := range roles {
+			if !knownRole(role) {
+				add("PermissionSettings.Events[%s]: unknown role %q", name, role)
+			}
+		}
+	}
+
+	for role := range c.MembershipSettings.Overrides {
+		if !knownRole(role) {
+			add("MembershipSettings.Overrides: unknown role %q", role)
+		}
+	}
+
+	switch c.RoutingSettings.Strategy {
+	case "round_robin", "least_busy", "sticky":
+	default:
+		add("RoutingSettings.Strategy: %q must be one of round_robin, least_busy, sticky", c.RoutingSettings.Strategy)
+	}
+
+	for team, members := range c.RoutingSettings.Teams {
+		if team == "" {
+			add("RoutingSettings.Teams: team name must not be empty")
+		}
+		if len(members) == 0 {
+			add("RoutingSettings.Teams: team %q has no members", team)
+		}
+	}
+
+	sla := c.SLASettings
+	if sla.ResponseTime <= 0 {
+		add("SLASettings.ResponseTime: must be positive, got %v", sla.ResponseTime)
+	}
+	if sla.WarningBefore < 0 {
+		add("SLASettings.WarningBefore: must not be negative, got %v", sla.WarningBefore)
+	}
+	if sla.CheckInterval <= 0 {
+		add("SLASettings.CheckInterval: must be positive, got %v", sla.CheckInterval)
+	}
+	for app, seconds := range sla.Applications {
+		if _, err := strconv.ParseUint(app, 10, 32); err != nil {
+			add("SLASettings.Applications: %q is not an application id", app)
+		}
+		if seconds <= 0 {
+			add("SLASettings.Applications: response time of application %s must be positive, got %v", app, seconds)
+		}
+	}
+
+	retention := c.RetentionSettings
+	if retention.MessageDays < 0 {
+		add("RetentionSettings.MessageDays: must not be negative, got %v", retention.MessageDays)
+	}
+	if retention.ArchiveResolvedDays < 0 {
+		add("RetentionSettings.ArchiveResolvedDays: must not be negative, got %v", retention.ArchiveResolvedDays)
+	}
+	if retention.BatchSize <= 0 {
+		add("RetentionSettings.BatchSize: must be positive, got %v", retention.BatchSize)
+	}
+	if retention.CheckInterval <= 0 {
+		add("RetentionSettings.CheckInterval: must be positive, got %v", retention.CheckInterval)
+	}
+	for app, policy := range retention.Applications {
+		if _, err := strconv.ParseUint(app, 10, 32); err != nil {
+			add("RetentionSettings.Applications: %q is not an application id", app)
+		}
+		if policy.MessageDays < 0 || policy.ArchiveResolvedDays < 0 {
+			add("RetentionSettings.Applications: retention of application %s must not be negative", app)
+		}
+	}
+
+	encryption := c.EncryptionSettings
+	if encryption.ReencryptBatchSize <= 0 {
+		add("EncryptionSettings.ReencryptBatchSize: must be positive, got %v", encryption.ReencryptBatchSize)
+	}
+	if encryption.ReencryptInterval <= 0 {
+		add("EncryptionSettings.ReencryptInterval: must be positive, got %v", encryption.ReencryptInterval)
+	}
+
+	metrics := c.MetricsSettings
+	if metrics.Enabled && metrics.Token == "" && len(metrics.AllowedNetworks) == 0 {
+		add("MetricsSettings.Token or MetricsSettings.AllowedNetworks is required when metrics are enabled")
+	}
+	for _, network := range metrics.AllowedNetworks {
+		if _, _, err := net.ParseCIDR(network); err != nil {
+			add("MetricsSettings.AllowedNetworks: %q is not a CIDR network", network)
+		}
+	}
+
+	problems = append(problems, validateFilters("FilterSettings.Default", c.FilterSettings.Default)...)
+	for app, rules := range c.FilterSettings.Applications {
+		if _, err := strconv.ParseUint(app, 10, 32); err != nil {
+			add("FilterSettings.Applications: %q is not an application id", app)
+		}
+		problems = append(problems, validateFilters(fmt.Sprintf("FilterSettings.Applications[%s]", app), rules)...)
+	}
+
+	return problems
+}
+
+// validateFilters проверяет действия, роли и регулярные выражения. Тип фильтра проверяется
+// при сборке цепочки, так как кроме встроенных могут быть зарегистрированы и другие
+func validateFilters(prefix string, rules []FilterRule) []string {
+	problems := make([]string, 0)
+	for i, rule := range rules {
+		if rule.Type == "" {
+			problems = append(problems, fmt.Sprintf("%s[%v]: type is required", prefix, i))
+		}
+
+		switch rule.Action {
+		case "reject", "mask", "flag":
+		default:
+			problems = append(problems, fmt.Sprintf("%s[%v]: action %q must be one of reject, mask, flag", prefix, i, rule.Action))
+		}
+
+		for _, role := range rule.Roles {
+			if !knownRole(role) {
+				problems = append(problems, fmt.Sprintf("%s[%v]: unknown role %q", prefix, i, role))
+			}
+		}
+
+		if rule.Type == "regex" {
+			for _, p := range rule.Patterns {
+				if _, err := regexp.Compile(p); err != nil {
+					problems = append(problems, fmt.Sprintf("%s[%v]: pattern %q is invalid: %v", prefix, i, p, err))
+				}
+			}
+		}
+	}
+
+	return problems
+}
+
+func knownRole(role string) bool {
+	for _, r := range models.Roles {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+func validPort(port int) bool {
+	return port > 0 && port <= 65535
+}
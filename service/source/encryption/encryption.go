@@ -0,0 +1,239 @@
+// Package encryption шифрует содержимое сообщений конвертом: каждое сообщение шифруется
+// своим случайным ключом данных AES-256-GCM, а ключ данных шифруется версионным мастер-ключом
+// из локального файла. При ротации мастер-ключа достаточно перешифровать ключи данных.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/dvgavrilov/gochat/service/source/config"
+	"github.com/sirupsen/logrus"
+)
+
+const keySize = 32
+
+var (
+	// ErrKeyFileInvalid error
+	ErrKeyFileInvalid = errors.New("encryption key file is invalid")
+	// ErrUnknownKeyVersion error
+	ErrUnknownKeyVersion = errors.New("content is encrypted with an unknown key version")
+	// ErrDisabled error
+	ErrDisabled = errors.New("encryption key file is not configured")
+)
+
+// keyFile формат файла ключей:
+// {"active": 2, "keys": {"1": "<base64, 32 байта>", "2": "<base64, 32 байта>"}}
+type keyFile struct {
+	Active uint              `json:"active"`
+	Keys   map[string]string `json:"keys"`
+}
+
+// keyring мастер-ключи по версиям, новые сообщения шифруются версией active
+type keyring struct {
+	active uint
+	keys   map[uint]cipher.AEAD
+}
+
+var activeKeyring atomic.Value
+
+// Reload перечитывает EncryptionSettings.KeyFile. Пустой путь отключает шифрование новых сообщений,
+// но ранее зашифрованные сообщения тогда прочитать не получится
+func Reload() error {
+	path := config.Current().EncryptionSettings.KeyFile
+	if path == "" {
+		activeKeyring.Store(&keyring{keys: map[uint]cipher.AEAD{}})
+		logrus.Warn("message content is stored unencrypted, EncryptionSettings.KeyFile is not set")
+		return nil
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	kr, err := parseKeyFile(raw)
+	if err != nil {
+		return err
+	}
+
+	activeKeyring.Store(kr)
+
+	logrus.Info(fmt.Sprintf("message encryption uses key version %v of %v loaded", kr.active, len(kr.keys)))
+	return nil
+}
+
+func parseKeyFile(raw []byte) (*keyring, error) {
+	file := &keyFile{}
+	err := json.Unmarshal(raw, file)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", ErrKeyFileInvalid, err)
+	}
+
+	kr := &keyring{active: file.Active, keys: make(map[uint]cipher.AEAD)}
+	for v, encoded := range file.Keys {
+		version, err := strconv.ParseUint(v, 10, 32)
+		if err != nil || version == 0 {
+			return nil, fmt.Errorf("%v: key version %q must be a positive number", ErrKeyFileInvalid, v)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != keySize {
+			return nil, fmt.Errorf("%v: key %v must be %v bytes encoded in base64", ErrKeyFileInvalid, v, keySize)
+		}
+
+		kr.keys[uint(version)], err = newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if _, ok := kr.keys[kr.active]; !ok {
+		return nil, fmt.Errorf("%v: active key version %v is missing", ErrKeyFileInvalid, kr.active)
+	}
+
+	return kr, nil
+}
+
+func current() *keyring {
+	kr, _ := activeKeyring.Load().(*keyring)
+	if kr == nil {
+		return &keyring{keys: map[uint]cipher.AEAD{}}
+	}
+
+	return kr
+}
+
+// ActiveVersion версия мастер-ключа для новых сообщений, 0 если шифрование выключено
+func ActiveVersion() uint {
+	return current().active
+}
+
+// Seal шифрует plaintext новым ключом данных. Возвращает шифротекст и ключ данных, зашифрованный
+// активным мастер-ключом version, в base64. additional привязывает шифротекст к записи, например, к беседе
+func Seal(plaintext string, additional string) (content string, dataKey string, version uint, err error) {
+	kr := current()
+	master, ok := kr.keys[kr.active]
+	if !ok {
+		return "", "", 0, ErrDisabled
+	}
+
+	key := make([]byte, keySize)
+	_, err = io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	sealedContent, err := seal(aead, []byte(plaintext), []byte(additional))
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	wrapped, err := seal(master, key, versionData(kr.active))
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	return sealedContent, wrapped, kr.active, nil
+}
+
+// Open расшифровывает содержимое, зашифрованное Seal
+func Open(content string, dataKey string, version uint, additional string) (string, error) {
+	key, err := unwrap(dataKey, version)
+	if err != nil {
+		return "", err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := open(aead, content, []byte(additional))
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
+
+// Rewrap перешифровывает ключ данных активным мастер-ключом, само содержимое не меняется
+func Rewrap(dataKey string, version uint) (string, uint, error) {
+	key, err := unwrap(dataKey, version)
+	if err != nil {
+		return "", 0, err
+	}
+
+	kr := current()
+	master, ok := kr.keys[kr.active]
+	if !ok {
+		return "", 0, ErrDisabled
+	}
+
+	wrapped, err := seal(master, key, versionData(kr.active))
+	if err != nil {
+		return "", 0, err
+	}
+
+	return wrapped, kr.active, nil
+}
+
+func unwrap(dataKey string, version uint) ([]byte, error) {
+	master, ok := current().keys[version]
+	if !ok {
+		return nil, ErrUnknownKeyVersion
+	}
+
+	return open(master, dataKey, versionData(version))
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// seal возвращает base64(nonce || шифротекст)
+func seal(aead cipher.AEAD, plaintext []byte, additional []byte) (string, error) {
+	nonce := make([]byte, aead.NonceSize())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, additional)), nil
+}
+
+func open(aead cipher.AEAD, sealed string, additional []byte) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(raw) < aead.NonceSize() {
+		return nil, errors.New("encrypted value is too short")
+	}
+
+	return aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], additional)
+}
+
+func versionData(version uint) []byte {
+	return []byte(strconv.FormatUint(uint64(version), 10))
+}
@@ -0,0 +1,146 @@
+package encryption
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+var (
+	key1 = base64.StdEncoding.EncodeToString([]byte(strings.Repeat("1", keySize)))
+	key2 = base64.StdEncoding.EncodeToString([]byte(strings.Repeat("2", keySize)))
+)
+
+// useKeyFile делает raw текущим набором ключей и возвращает функцию, восстанавливающую прежний
+func useKeyFile(t *testing.T, raw string) func() {
+	kr, err := parseKeyFile([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := current()
+	activeKeyring.Store(kr)
+	return func() { activeKeyring.Store(previous) }
+}
+
+func TestSealOpenRewrap(t *testing.T) {
+	restore := useKeyFile(t, `{"active": 1, "keys": {"1": "`+key1+`"}}`)
+	defer restore()
+
+	content, dataKey, version, err := Seal("привет", "conversation:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 1 || content == "привет" {
+		t.Fatalf("Seal returned version %v and content %q", version, content)
+	}
+
+	if got, err := Open(content, dataKey, version, "conversation:1"); err != nil || got != "привет" {
+		t.Fatalf("Open = %q, %v", got, err)
+	}
+
+	useKeyFile(t, `{"active": 2, "keys": {"1": "`+key1+`", "2": "`+key2+`"}}`)
+
+	rewrapped, newVersion, err := Rewrap(dataKey, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newVersion != 2 || rewrapped == dataKey {
+		t.Fatalf("Rewrap returned version %v", newVersion)
+	}
+
+	if got, err := Open(content, rewrapped, newVersion, "conversation:1"); err != nil || got != "привет" {
+		t.Fatalf("Open after Rewrap = %q, %v", got, err)
+	}
+
+	// ключ данных, обёрнутый версией 2, не открывается версией 1
+	if _, err := Open(content, rewrapped, 1, "conversation:1"); err == nil {
+		t.Error("data key rewrapped with version 2 was opened with version 1")
+	}
+}
+
+func TestOpenRejectsTamperedContent(t *testing.T) {
+	restore := useKeyFile(t, `{"active": 1, "keys": {"1": "`+key1+`"}}`)
+	defer restore()
+
+	content, dataKey, version, err := Seal("hello", "conversation:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, _ := base64.StdEncoding.DecodeString(content)
+	raw[len(raw)-1] ^= 0xff
+	tampered := base64.StdEncoding.EncodeToString(raw)
+
+	if _, err := Open(tampered, dataKey, version, "conversation:1"); err == nil {
+		t.Error("tampered content was opened")
+	}
+
+	if _, err := Open(content[:8], dataKey, version, "conversation:1"); err == nil {
+		t.Error("truncated content was opened")
+	}
+
+	if _, err := Open(content, dataKey, version, "conversation:2"); err == nil {
+		t.Error("content of conversation 1 was opened as conversation 2")
+	}
+}
+
+func TestUnknownKeyVersion(t *testing.T) {
+	restore := useKeyFile(t, `{"active": 1, "keys": {"1": "`+key1+`"}}`)
+	defer restore()
+
+	content, dataKey, _, err := Seal("hello", "conversation:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(content, dataKey, 3, "conversation:1"); err != ErrUnknownKeyVersion {
+		t.Errorf("Open with version 3 returned %v, want %v", err, ErrUnknownKeyVersion)
+	}
+
+	if _, _, err := Rewrap(dataKey, 3); err != ErrUnknownKeyVersion {
+		t.Errorf("Rewrap with version 3 returned %v, want %v", err, ErrUnknownKeyVersion)
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	previous := current()
+	activeKeyring.Store(&keyring{keys: nil})
+	defer activeKeyring.Store(previous)
+
+	if ActiveVersion() != 0 {
+		t.Errorf("ActiveVersion = %v without keys", ActiveVersion())
+	}
+
+	if _, _, _, err := Seal("hello", "conversation:1"); err != ErrDisabled {
+		t.Errorf("Seal without keys returned %v, want %v", err, ErrDisabled)
+	}
+}
+
+func TestParseKeyFile(t *testing.T) {
+	invalid := map[string]string{
+		"not json":         `{"active": 1,`,
+		"zero version":     `{"active": 1, "keys": {"0": "` + key1 + `", "1": "` + key1 + `"}}`,
+		"negative version": `{"active": 1, "keys": {"-1": "` + key1 + `", "1": "` + key1 + `"}}`,
+		"text version":     `{"active": 1, "keys": {"v1": "` + key1 + `", "1": "` + key1 + `"}}`,
+		"short key":        `{"active": 1, "keys": {"1": "` + base64.StdEncoding.EncodeToString([]byte("short")) + `"}}`,
+		"bad base64":       `{"active": 1, "keys": {"1": "***"}}`,
+		"missing active":   `{"active": 2, "keys": {"1": "` + key1 + `"}}`,
+		"no active":        `{"keys": {"1": "` + key1 + `"}}`,
+		"no keys":          `{"active": 1}`,
+	}
+
+	for name, raw := range invalid {
+		if _, err := parseKeyFile([]byte(raw)); err == nil || !strings.HasPrefix(err.Error(), ErrKeyFileInvalid.Error()) {
+			t.Errorf("%s: parseKeyFile returned %v, want %v", name, err, ErrKeyFileInvalid)
+		}
+	}
+
+	kr, err := parseKeyFile([]byte(`{"active": 2, "keys": {"1": "` + key1 + `", "2": "` + key2 + `"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kr.active != 2 || len(kr.keys) != 2 {
+		t.Errorf("parseKeyFile loaded version %v of %v keys", kr.active, len(kr.keys))
+	}
+}
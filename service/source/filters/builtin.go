@@ -0,0 +1,263 @@
+package filters
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/dvgavrilov/gochat/service/source/config"
+)
+
+var (
+	// ErrNoPatterns error
+	ErrNoPatterns = errors.New("filter requires at least one pattern")
+)
+
+var (
+	wordPattern  = regexp.MustCompile(`[\p{L}\p{N}]+`)
+	cardPattern  = regexp.MustCompile(`\d(?:[ -]?\d){12,}`)
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+	phonePattern = regexp.MustCompile(`\+?\d[\d \-()]{7,}\d`)
+)
+
+func init() {
+	Register("regex", newRegexFilter)
+	Register("keywords", newKeywordFilter)
+	Register("card", func(config.FilterRule) (Filter, error) { return cardFilter{}, nil })
+	Register("email", func(config.FilterRule) (Filter, error) { return emailFilter{}, nil })
+	Register("phone", func(config.FilterRule) (Filter, error) { return phoneFilter{}, nil })
+}
+
+// regexFilter ищет совпадения с любым из выражений Patterns
+type regexFilter struct {
+	patterns []*regexp.Regexp
+}
+
+func newRegexFilter(rule config.FilterRule) (Filter, error) {
+	if len(rule.Patterns) == 0 {
+		return nil, ErrNoPatterns
+	}
+
+	f := regexFilter{}
+	for _, p := range rule.Patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		f.patterns = append(f.patterns, re)
+	}
+
+	return f, nil
+}
+
+func (f regexFilter) Find(content string) [][]int {
+	found := make([][]int, 0)
+	for _, re := range f.patterns {
+		for _, m := range re.FindAllStringIndex(content, -1) {
+			if m[0] < m[1] && !overlaps(found, m) {
+				found = append(found, m)
+			}
+		}
+	}
+
+	return found
+}
+
+func (f regexFilter) Mask(fragment string) string {
+	return stars(fragment)
+}
+
+// keywordFilter ищет слова из Patterns без учёта регистра. Слова выделяются по буквам и цифрам
+// любого алфавита, так как \b в regexp понимает только латиницу
+type keywordFilter struct {
+	words map[string]bool
+}
+
+func newKeywordFilter(rule config.FilterRule) (Filter, error) {
+	if len(rule.Patterns) == 0 {
+		return nil, ErrNoPatterns
+	}
+
+	f := keywordFilter{words: make(map[string]bool)}
+	for _, w := range rule.Patterns {
+		f.words[strings.ToLower(w)] = true
+	}
+
+	return f, nil
+}
+
+func (f keywordFilter) Find(content string) [][]int {
+	found := make([][]int, 0)
+	for _, m := range wordPattern.FindAllStringIndex(content, -1) {
+		if f.words[strings.ToLower(content[m[0]:m[1]])] {
+			found = append(found, m)
+		}
+	}
+
+	return found
+}
+
+func (f keywordFilter) Mask(fragment string) string {
+	return stars(fragment)
+}
+
+// cardFilter ищет номера карт из 13-19 цифр, разделённых пробелами или дефисами,
+// с верной контрольной цифрой по алгоритму Луна
+type cardFilter struct{}
+
+func (cardFilter) Find(content string) [][]int {
+	found := make([][]int, 0)
+	for _, m := range cardPattern.FindAllStringIndex(content, -1) {
+		found = append(found, findCards(content, m[0], m[1])...)
+	}
+
+	return found
+}
+
+// findCards проверяет внутри совпадения все последовательности соседних групп цифр длиной 13-19 цифр,
+// начиная с самых длинных. Так номер находится и рядом с другими числами, например, со сроком действия
+// в "4111 1111 1111 1111 12/25", а длинные числа без разделителей не дробятся на случайные номера
+func findCards(content string, start int, end int) [][]int {
+	groups := digitGroups(content, start, end)
+	found := make([][]int, 0)
+
+	for i := 0; i < len(groups); {
+		// last последняя группа, с которой номер ещё не длиннее 19 цифр
+		last, count := i-1, 0
+		for last+1 < len(groups) && count+groups[last+1][1]-groups[last+1][0] <= 19 {
+			last++
+			count += groups[last][1] - groups[last][0]
+		}
+
+		matched := false
+		for j := last; j >= i; j-- {
+			if luhn(digits(content[groups[i][0]:groups[j][1]])) {
+				found = append(found, []int{groups[i][0], groups[j][1]})
+				i = j + 1
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			i++
+		}
+	}
+
+	return found
+}
+
+// digitGroups границы групп цифр между разделителями
+func digitGroups(content string, start int, end int) [][]int {
+	groups := make([][]int, 0)
+	for i := start; i < end; {
+		if content[i] < '0' || content[i] > '9' {
+			i++
+			continue
+		}
+
+		j := i
+		for j < end && content[j] >= '0' && content[j] <= '9' {
+			j++
+		}
+		groups = append(groups, []int{i, j})
+		i = j
+	}
+
+	return groups
+}
+
+// Mask оставляет последние четыре цифры и разделители
+func (cardFilter) Mask(fragment string) string {
+	return maskDigits(fragment, 4)
+}
+
+type emailFilter struct{}
+
+func (emailFilter) Find(content string) [][]int {
+	return emailPattern.FindAllStringIndex(content, -1)
+}
+
+// Mask оставляет первый символ имени и домен
+func (emailFilter) Mask(fragment string) string {
+	at := strings.LastIndex(fragment, "@")
+	return fragment[:1] + "***" + fragment[at:]
+}
+
+// phoneFilter ищет номера из 10-15 цифр, возможно с +, пробелами, дефисами и скобками
+type phoneFilter struct{}
+
+func (phoneFilter) Find(content string) [][]int {
+	found := make([][]int, 0)
+	for _, m := range phonePattern.FindAllStringIndex(content, -1) {
+		n := len(digits(content[m[0]:m[1]]))
+		if n >= 10 && n <= 15 {
+			found = append(found, m)
+		}
+	}
+
+	return found
+}
+
+// Mask оставляет две последние цифры
+func (phoneFilter) Mask(fragment string) string {
+	return maskDigits(fragment, 2)
+}
+
+func luhn(number string) bool {
+	if len(number) < 13 || len(number) > 19 {
+		return false
+	}
+
+	sum := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		d := int(number[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+
+	return sum%10 == 0
+}
+
+func digits(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, value)
+}
+
+// maskDigits заменяет звёздочками все цифры, кроме последних keep
+func maskDigits(value string, keep int) string {
+	left := len(digits(value)) - keep
+	return strings.Map(func(r rune) rune {
+		if unicode.IsDigit(r) && left > 0 {
+			left--
+			return '*'
+		}
+		return r
+	}, value)
+}
+
+func stars(value string) string {
+	return strings.Repeat("*", len([]rune(value)))
+}
+
+func overlaps(found [][]int, m []int) bool {
+	for _, f := range found {
+		if m[0] < f[1] && f[0] < m[1] {
+			return true
+		}
+	}
+
+	return false
+}
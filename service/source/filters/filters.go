@@ -0,0 +1,211 @@
+// Package filters проверяет текст сообщений перед сохранением: отклоняет, маскирует
+// найденные фрагменты или помечает сообщение для модераторов
+package filters
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/dvgavrilov/gochat/service/source/config"
+	"github.com/dvgavrilov/gochat/service/source/metrics"
+	"github.com/dvgavrilov/gochat/service/source/models"
+	"github.com/sirupsen/logrus"
+)
+
+// Действия фильтра
+const (
+	ActionReject = "reject"
+	ActionMask   = "mask"
+	ActionFlag   = "flag"
+)
+
+// Filter находит в тексте фрагменты и знает, как их замаскировать
+type Filter interface {
+	// Find возвращает непересекающиеся границы найденных фрагментов [начало, конец) в байтах
+	Find(content string) [][]int
+	// Mask возвращает замену фрагмента
+	Mask(fragment string) string
+}
+
+// Factory создаёт фильтр по правилу из FilterSettings
+type Factory func(rule config.FilterRule) (Filter, error)
+
+var (
+	factoriesMux sync.RWMutex
+	factories    = map[string]Factory{}
+)
+
+// Register добавляет тип фильтра, который затем можно указать в FilterRule.Type
+func Register(kind string, factory Factory) {
+	factoriesMux.Lock()
+	defer factoriesMux.Unlock()
+
+	factories[kind] = factory
+}
+
+// Decision результат проверки сообщения
+type Decision struct {
+	// Action пустое, models.FilterMasked, models.FilterFlagged или ActionReject
+	Action  string
+	Content string
+	Reasons []string
+}
+
+// Rejected сообщение не должно быть сохранено
+func (d *Decision) Rejected() bool {
+	return d.Action == ActionReject
+}
+
+type step struct {
+	name   string
+	action string
+	roles  []string
+	filter Filter
+}
+
+func (s *step) appliesTo(role string) bool {
+	if len(s.roles) == 0 {
+		return true
+	}
+
+	for _, r := range s.roles {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pipelines цепочки, собранные для одного снимка конфигурации
+type pipelines struct {
+	settings     *config.Configuration
+	defaults     []*step
+	applications map[uint][]*step
+}
+
+var (
+	compiledMux sync.Mutex
+	compiled    *pipelines
+)
+
+// Apply пропускает текст сообщения отправителя с ролью role через цепочку фильтров приложения.
+// Фильтры выполняются по порядку, каждый следующий видит уже замаскированный текст,
+// а первый сработавший reject останавливает проверку
+func Apply(applicationID uint, role string, content string) *Decision {
+	decision := &Decision{Content: content, Reasons: make([]string, 0)}
+
+	for _, s := range pipelineFor(applicationID) {
+		if !s.appliesTo(role) {
+			continue
+		}
+
+		found := s.filter.Find(decision.Content)
+		if len(found) == 0 {
+			continue
+		}
+
+		decision.Reasons = append(decision.Reasons, s.name)
+		observe(s.name, s.action)
+
+		switch s.action {
+		case ActionReject:
+			decision.Action = ActionReject
+			return decision
+		case ActionMask:
+			decision.Content = mask(decision.Content, found, s.filter)
+			decision.Action = models.FilterMasked
+		case ActionFlag:
+			if decision.Action == "" {
+				decision.Action = models.FilterFlagged
+			}
+		}
+	}
+
+	return decision
+}
+
+// mask заменяет фрагменты с конца, чтобы границы ещё не обработанных фрагментов не сдвигались
+func mask(content string, found [][]int, f Filter) string {
+	sort.Slice(found, func(i, j int) bool { return found[i][0] < found[j][0] })
+
+	for i := len(found) - 1; i >= 0; i-- {
+		start, end := found[i][0], found[i][1]
+		content = content[:start] + f.Mask(content[start:end]) + content[end:]
+	}
+
+	return content
+}
+
+// pipelineFor пересобирает цепочки, когда перезагрузка конфигурации подменяет её снимок
+func pipelineFor(applicationID uint) []*step {
+	settings := config.Current()
+
+	compiledMux.Lock()
+	defer compiledMux.Unlock()
+
+	if compiled == nil || compiled.settings != settings {
+		compiled = compile(settings)
+	}
+
+	if steps, ok := compiled.applications[applicationID]; ok {
+		return steps
+	}
+
+	return compiled.defaults
+}
+
+func compile(settings *config.Configuration) *pipelines {
+	ret := &pipelines{
+		settings:     settings,
+		defaults:     compileRules("default", settings.FilterSettings.Default),
+		applications: make(map[uint][]*step),
+	}
+
+	for app, rules := range settings.FilterSettings.Applications {
+		id, err := strconv.ParseUint(app, 10, 32)
+		if err != nil {
+			continue
+		}
+
+		ret.applications[uint(id)] = compileRules("application "+app, rules)
+	}
+
+	return ret
+}
+
+// compileRules пропускает правила неизвестного типа, так как проверка конфигурации типы не знает
+func compileRules(scope string, rules []config.FilterRule) []*step {
+	factoriesMux.RLock()
+	defer factoriesMux.RUnlock()
+
+	steps := make([]*step, 0, len(rules))
+	for i, rule := range rules {
+		factory, ok := factories[rule.Type]
+		if !ok {
+			logrus.Error(fmt.Sprintf("content filter %v of %s has unknown type %q and is skipped", i, scope, rule.Type))
+			continue
+		}
+
+		f, err := factory(rule)
+		if err != nil {
+			logrus.Error(fmt.Sprintf("content filter %v of %s is skipped: %v", i, scope, err))
+			continue
+		}
+
+		name := rule.Name
+		if name == "" {
+			name = rule.Type
+		}
+
+		steps = append(steps, &step{name: name, action: rule.Action, roles: rule.Roles, filter: f})
+	}
+
+	return steps
+}
+
+func observe(name string, action string) {
+	metrics.FilterMatches.WithLabelValues(name, action).Inc()
+}
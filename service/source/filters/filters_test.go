@@ -0,0 +1,165 @@
+package filters
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/dvgavrilov/gochat/service/source/config"
+	"github.com/dvgavrilov/gochat/service/source/models"
+)
+
+func TestLuhn(t *testing.T) {
+	cases := map[string]bool{
+		"4111111111111111":     true,
+		"378282246310005":      true,
+		"6011111111111117":     true,
+		"4000056655665556":     true,
+		"4111111111111112":     false,
+		"4242":                 false,
+		"41111111111111111111": false,
+	}
+
+	for number, want := range cases {
+		if got := luhn(number); got != want {
+			t.Errorf("luhn(%q) = %v, want %v", number, got, want)
+		}
+	}
+}
+
+func TestCardMask(t *testing.T) {
+	cases := []struct {
+		content string
+		want    string
+	}{
+		{"card 4111 1111 1111 1111", "card **** **** **** 1111"},
+		{"4111-1111-1111-1111 12/25", "****-****-****-1111 12/25"},
+		{"4111111111111111 1225 cvc 123", "************1111 1225 cvc 123"},
+		{"order 12345 4111111111111111", "order 12345 ************1111"},
+		{"1234 4111 1111 1111 1111", "1234 **** **** **** 1111"},
+		{"amex 3782 822463 10005", "amex **** ****** *0005"},
+		{"two 4111111111111111 and 6011111111111117", "two ************1111 and ************1117"},
+		{"4111111111111112", "4111111111111112"},
+		{"id 41111111111111110000", "id 41111111111111110000"},
+		{"no digits here", "no digits here"},
+	}
+
+	f := cardFilter{}
+	for _, c := range cases {
+		if got := mask(c.content, f.Find(c.content), f); got != c.want {
+			t.Errorf("card mask of %q = %q, want %q", c.content, got, c.want)
+		}
+	}
+}
+
+func TestEmailAndPhoneMask(t *testing.T) {
+	cases := []struct {
+		filter  Filter
+		content string
+		want    string
+	}{
+		{emailFilter{}, "write to john.doe@example.com please", "write to j***@example.com please"},
+		{phoneFilter{}, "call +7 (912) 345-67-89", "call +* (***) ***-**-89"},
+		{phoneFilter{}, "code 123-45", "code 123-45"},
+	}
+
+	for _, c := range cases {
+		if got := mask(c.content, c.filter.Find(c.content), c.filter); got != c.want {
+			t.Errorf("mask of %q = %q, want %q", c.content, got, c.want)
+		}
+	}
+}
+
+func TestKeywordFilter(t *testing.T) {
+	f, err := newKeywordFilter(config.FilterRule{Patterns: []string{"Дурак", "spam"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := "ты ДУРАК, это spam, а не spammer"
+	if got, want := mask(content, f.Find(content), f), "ты *****, это ****, а не spammer"; got != want {
+		t.Errorf("keyword mask = %q, want %q", got, want)
+	}
+
+	if _, err = newKeywordFilter(config.FilterRule{}); err != ErrNoPatterns {
+		t.Errorf("keyword filter without patterns returned %v, want %v", err, ErrNoPatterns)
+	}
+}
+
+func TestApply(t *testing.T) {
+	settings := config.MainConfiguration.FilterSettings
+	defer func() {
+		config.MainConfiguration.FilterSettings = settings
+		compiled = nil
+	}()
+
+	config.MainConfiguration.FilterSettings = config.FilterSettings{
+		Default: []config.FilterRule{
+			{Type: "card", Action: ActionMask},
+			{Type: "email", Action: ActionMask, Roles: []string{models.RoleCustomer}},
+			{Name: "password", Type: "regex", Action: ActionReject, Patterns: []string{`(?i)password\s*[:=]\s*\S+`}},
+			{Name: "refund", Type: "keywords", Action: ActionFlag, Patterns: []string{"refund"}},
+			{Type: "unknown", Action: ActionReject},
+		},
+		Applications: map[string][]config.FilterRule{
+			"7": {{Type: "email", Action: ActionFlag}},
+		},
+	}
+	compiled = nil
+
+	cases := []struct {
+		name          string
+		applicationID uint
+		role          string
+		content       string
+		want          Decision
+	}{
+		{
+			name:    "customer card and email are masked",
+			role:    models.RoleCustomer,
+			content: "4111 1111 1111 1111, a@b.io",
+			want:    Decision{Action: models.FilterMasked, Content: "**** **** **** 1111, a***@b.io", Reasons: []string{"card", "email"}},
+		},
+		{
+			name:    "email rule does not apply to agents",
+			role:    models.RoleAgent,
+			content: "write to a@b.io",
+			want:    Decision{Action: "", Content: "write to a@b.io", Reasons: []string{}},
+		},
+		{
+			name:    "reject stops the pipeline",
+			role:    models.RoleCustomer,
+			content: "password: hunter2, refund",
+			want:    Decision{Action: ActionReject, Content: "password: hunter2, refund", Reasons: []string{"password"}},
+		},
+		{
+			name:    "mask wins over a later flag",
+			role:    models.RoleCustomer,
+			content: "refund to 4111111111111111",
+			want:    Decision{Action: models.FilterMasked, Content: "refund to ************1111", Reasons: []string{"card", "refund"}},
+		},
+		{
+			name:    "flag keeps the content",
+			role:    models.RoleAgent,
+			content: "Refund approved",
+			want:    Decision{Action: models.FilterFlagged, Content: "Refund approved", Reasons: []string{"refund"}},
+		},
+		{
+			name:          "application rules replace the default",
+			applicationID: 7,
+			role:          models.RoleCustomer,
+			content:       "a@b.io 4111111111111111",
+			want:          Decision{Action: models.FilterFlagged, Content: "a@b.io 4111111111111111", Reasons: []string{"email"}},
+		},
+	}
+
+	for _, c := range cases {
+		got := Apply(c.applicationID, c.role, c.content)
+		if !reflect.DeepEqual(*got, c.want) {
+			t.Errorf("%s: Apply(%q) = %+v, want %+v", c.name, c.content, *got, c.want)
+		}
+	}
+
+	if !Apply(0, models.RoleCustomer, "password=1").Rejected() {
+		t.Error("Rejected() is false for a rejected message")
+	}
+}
@@ -2,6 +2,7 @@ package interfaces
 
 import (
 	"io"
+	"time"
 
 	"github.com/dvgavrilov/gochat/service/source/models"
 )
@@ -15,16 +16,23 @@ type DataSource interface {
 
 // MessagesProvider struct
 type MessagesProvider interface {
-	GetMessages(conversationID uint) (*[]models.Message, error)
-	GetUnreadMessages(userID uint) (*[]models.Message, error)
+	GetMessages(conversationID uint, includeInternal bool) (*[]models.Message, error)
+	GetUnreadMessages(userID uint, includeInternal bool) (*[]models.Message, error)
+	// GetMessagesPage возвращает не больше limit сообщений с id больше afterID в порядке id
+	GetMessagesPage(conversationID uint, includeInternal bool, afterID uint, limit int) (*[]models.Message, error)
+	// GetMessage возвращает nil, если сообщения нет
+	GetMessage(messageID uint) (*models.Message, error)
 	AddMessage(message *models.Message) (*models.Message, error)
 }
 
 // ConversationsProvider структура
 type ConversationsProvider interface {
-	GetByUserID(userID uint) (*[]models.Conversation, error)
+	GetByUserID(userID uint, statuses []string) (*[]models.Conversation, error)
 	GetByApplicationID(applicationID uint) (*models.Conversation, error)
 	Add(conversation *models.Conversation) (*models.Conversation, error)
+	SetAssignee(conversationID uint, assigneeID uint, lastAssigneeID uint) error
+	CountByAssignee(assigneeID uint) (int, error)
+	SetStatus(conversationID uint, status string) error
 }
 
 // ParticipantsProvider struct
@@ -33,11 +41,65 @@ type ParticipantsProvider interface {
 	GetByConversationID(conversationID uint) (*[]models.Participant, error)
 }
 
+// TransfersProvider struct
+type TransfersProvider interface {
+	Add(transfer *models.Transfer) error
+	GetByConversationID(conversationID uint) (*[]models.Transfer, error)
+}
+
+// CannedResponsesProvider struct
+type CannedResponsesProvider interface {
+	Save(response *models.CannedResponse) (*models.CannedResponse, error)
+	GetByID(id uint) (*models.CannedResponse, error)
+	GetAvailable(ownerID uint, teams []string) (*[]models.CannedResponse, error)
+	Delete(id uint) error
+}
+
+// StatsProvider struct
+type StatsProvider interface {
+	Get(conversationID uint) (*models.ConversationStats, error)
+	Save(stats *models.ConversationStats) error
+	GetAwaiting() (*[]models.ConversationStats, error)
+	GetByPeriod(from time.Time, to time.Time) (*[]models.ConversationStats, error)
+}
+
+// AuditProvider struct. Журнал аудита не поддерживает изменение и удаление записей
+type AuditProvider interface {
+	Add(entry *models.AuditEntry) error
+	Find(filter models.AuditFilter) (*[]models.AuditEntry, error)
+}
+
+// RetentionProvider struct. Удаление идёт пачками по limit строк, каждая пачка в своей транзакции
+type RetentionProvider interface {
+	CountExpiredMessages(scope models.RetentionScope, before time.Time) (messages int, unreadInfos int, err error)
+	DeleteExpiredMessages(scope models.RetentionScope, before time.Time, limit int) (messages int, unreadInfos int, err error)
+	CountResolvedBefore(scope models.RetentionScope, before time.Time) (int, error)
+	GetResolvedBefore(scope models.RetentionScope, before time.Time, limit int) (*[]models.Conversation, error)
+}
+
+// SubjectProvider struct. Все данные, связанные с пользователем, для запросов на выгрузку и удаление
+type SubjectProvider interface {
+	GetConversations(userID uint) (*[]models.Conversation, error)
+	GetSentMessages(userID uint, afterID uint, limit int) (*[]models.Message, error)
+	GetUnreadInfos(userID uint, afterMessageID uint, limit int) (*[]models.UnreadInfo, error)
+	GetTransfers(userID uint) (*[]models.Transfer, error)
+	GetCannedResponses(ownerID uint) (*[]models.CannedResponse, error)
+	// Erase удаляет данные пользователя одной транзакцией. При pseudonymize сообщения
+	// остаются в беседах без автора, а их текст заменяется на placeholder
+	Erase(userID uint, pseudonymize bool, placeholder string) (*models.ErasureResult, error)
+}
+
+// MessageKeysProvider struct. Перевод сообщений на активный ключ шифрования
+type MessageKeysProvider interface {
+	CountByKeyVersion() (map[uint]int, error)
+	Reencrypt(afterID uint, limit int) (lastID uint, reencrypted int, err error)
+}
+
 // UnreadInfoManager struct
 type UnreadInfoManager interface {
 	Add(unreadInfo *models.UnreadInfo) error
 	GetByMessageID(messageID uint) (*[]models.UnreadInfo, error)
-	GetForUser(participantID uint) (int, error)
+	GetForUser(participantID uint, includeInternal bool) (int, error)
 	GetForUserAndGlobal(participantID uint) (int, error)
 	MarkAsRead(messageID uint, participantID uint) error
 }
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"flag"
 	"log"
+	"os"
 
 	"github.com/dvgavrilov/gochat/service/source/config"
 	"github.com/dvgavrilov/gochat/service/source/persistence"
@@ -9,8 +11,15 @@ import (
 )
 
 func main() {
+	defaultPath := config.DefaultPath
+	if path, ok := os.LookupEnv("GOCHAT_CONFIG"); ok {
+		defaultPath = path
+	}
+
+	configPath := flag.String("config", defaultPath, "path to the json configuration file")
+	flag.Parse()
 
-	err := config.Read()
+	err := config.Read(*configPath)
 	if err != nil {
 		log.Panic(err.Error())
 	}
@@ -19,10 +28,16 @@ func main() {
 	if err != nil {
 		log.Panic(err.Error())
 	}
-	defer persistence.DataSourceCloser().Close()
 
-	err = route.RegisterRoutes()
+	routeErr := route.RegisterRoutes()
+
+	// соединения с базой и пул redis закрываются только после того, как все сокеты закрыты
+	err = persistence.DataSourceCloser().Close()
 	if err != nil {
-		log.Panic(err.Error())
+		log.Println(err.Error())
+	}
+
+	if routeErr != nil {
+		log.Panic(routeErr.Error())
 	}
 }
@@ -0,0 +1,225 @@
+package messaging
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// SystemAnnouncementEvent const
+	SystemAnnouncementEvent = "Event.SystemAnnouncement"
+	// RemovedFromRoomEvent const
+	RemovedFromRoomEvent = "Event.RemovedFromRoom"
+
+	// CloseDisconnectedByAdmin код закрытия сокета, отключённого администратором
+	CloseDisconnectedByAdmin = 4003
+
+	// maxCloseReason close frame вмещает не больше 123 байт причины
+	maxCloseReason = 123
+)
+
+// ChatterInfo описание подключенного чаттера
+type ChatterInfo struct {
+	UserID      uint      `json:"user_id"`
+	Role        string    `json:"role"`
+	RemoteAddr  string    `json:"remote_addr"`
+	ConnectedAt time.Time `json:"connected_since"`
+	Rooms       []string  `json:"rooms"`
+}
+
+// RoomMember участник комнаты
+type RoomMember struct {
+	UserID uint   `json:"user_id"`
+	Role   string `json:"role"`
+}
+
+// RoomInfo описание комнаты
+type RoomInfo struct {
+	ID      string       `json:"id"`
+	Members []RoomMember `json:"members"`
+}
+
+type systemAnnouncementEventResult struct {
+	Text      string    `json:"text"`
+	Room      string    `json:"room,omitempty"`
+	CreatedAt time.Time `json:"create_at"`
+}
+
+type removedFromRoomEventResult struct {
+	SessionChannel string `json:"session_channel"`
+}
+
+// ListChatters возвращает подключенных чаттеров, отсортированных по идентификатору и времени подключения
+func ListChatters() []ChatterInfo {
+	ret := make([]ChatterInfo, 0)
+	if hub == nil {
+		return ret
+	}
+
+	hub.exec(func() {
+		for c := range hub.Chatters {
+			rooms := make([]string, 0, len(c.rooms))
+			for id := range c.rooms {
+				rooms = append(rooms, id)
+			}
+			sort.Strings(rooms)
+
+			ret = append(ret, ChatterInfo{
+				UserID:      c.UserID,
+				Role:        c.Role,
+				RemoteAddr:  c.RemoteAddr,
+				ConnectedAt: c.ConnectedAt,
+				Rooms:       rooms,
+			})
+		}
+	})
+
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].UserID != ret[j].UserID {
+			return ret[i].UserID < ret[j].UserID
+		}
+		return ret[i].ConnectedAt.Before(ret[j].ConnectedAt)
+	})
+
+	return ret
+}
+
+// ListRooms возвращает активные комнаты с их участниками
+func ListRooms() []RoomInfo {
+	ret := make([]RoomInfo, 0)
+	if hub == nil {
+		return ret
+	}
+
+	hub.exec(func() {
+		for id, room := range hub.Rooms {
+			members := make([]RoomMember, 0, len(room.Chatters))
+			for c := range room.Chatters {
+				members = append(members, RoomMember{UserID: c.UserID, Role: c.Role})
+			}
+			sort.Slice(members, func(i, j int) bool { return members[i].UserID < members[j].UserID })
+
+			ret = append(ret, RoomInfo{ID: id, Members: members})
+		}
+	})
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	return ret
+}
+
+// DisconnectUser закрывает все сокеты пользователя с кодом CloseDisconnectedByAdmin
+// и возвращает количество закрытых сокетов
+func DisconnectUser(userID uint, reason string) int {
+	if hub == nil {
+		return 0
+	}
+
+	// обрезаем по границе символа, иначе кириллица даст невалидный UTF-8 в close frame
+	if len(reason) > maxCloseReason {
+		n := maxCloseReason
+		for n > 0 && !utf8.RuneStart(reason[n]) {
+			n--
+		}
+		reason = reason[:n]
+	}
+
+	closed := 0
+	hub.exec(func() {
+		for c := range hub.Chatters {
+			if c.UserID == userID {
+				c.closeWith(CloseDisconnectedByAdmin, reason)
+				closed++
+			}
+		}
+	})
+
+	logrus.Info(fmt.Sprintf("Chatter with id %v was disconnected by an administrator, %v sockets closed", userID, closed))
+	return closed
+}
+
+// RemoveFromRoom удаляет все сокеты пользователя из комнаты chatID, пользователь получает RemovedFromRoomEvent.
+// Возвращает количество удалённых сокетов.
+func RemoveFromRoom(userID uint, chatID string) (int, error) {
+	if hub == nil {
+		return 0, ErrChatRoomNotFound
+	}
+
+	raw, err := json.Marshal(&EventResult{
+		Name:   RemovedFromRoomEvent,
+		Ok:     true,
+		Result: removedFromRoomEventResult{SessionChannel: chatID},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	hub.exec(func() {
+		room, ok := hub.Rooms[chatID]
+		if !ok {
+			err = ErrChatRoomNotFound
+			return
+		}
+
+		for c := range room.Chatters {
+			if c.UserID != userID {
+				continue
+			}
+
+			hub.removeFromRoom(c, chatID)
+			hub.deliver(c, raw)
+			removed++
+		}
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	logrus.Info(fmt.Sprintf("Chatter with id %v was removed from the %s chat room by an administrator", userID, chatID))
+	return removed, nil
+}
+
+// Announce рассылает системное объявление всем чаттерам или, если chatID не пустой, участникам комнаты.
+// Возвращает количество получателей.
+func Announce(text string, chatID string) (int, error) {
+	if hub == nil {
+		return 0, nil
+	}
+
+	raw, err := json.Marshal(&EventResult{
+		Name: SystemAnnouncementEvent,
+		Ok:   true,
+		Result: systemAnnouncementEventResult{
+			Text:      text,
+			Room:      chatID,
+			CreatedAt: time.Now().UTC(),
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	recipients := 0
+	count := func(c *Chatter) bool {
+		recipients++
+		return true
+	}
+
+	if chatID == "" {
+		err = hub.broadcast(raw, count)
+	} else {
+		err = hub.broadcastToRoom(chatID, raw, count)
+	}
+
+	if err != nil && err != ErrNoChatterMatch {
+		return 0, err
+	}
+
+	return recipients, nil
+}
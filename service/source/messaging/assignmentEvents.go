@@ -0,0 +1,80 @@
+package messaging
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/dvgavrilov/gochat/service/source/audit"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrAssigneeNotModerator error
+	ErrAssigneeNotModerator = errors.New("conversation can be assigned only to a moderator")
+)
+
+const (
+	// AssignConversationEvent const
+	AssignConversationEvent = "Event.AssignConversation"
+	// ConversationAssignedEvent const
+	ConversationAssignedEvent = "Event.ConversationAssigned"
+
+	// assignToOthersAction действие, позволяющее назначать беседы другим модераторам
+	assignToOthersAction = "Action.AssignToOthers"
+)
+
+type assignConversationEventArgs struct {
+	SessionChannel string `json:"session_channel"`
+	// AssigneeID модератор, которому назначается беседа, 0 означает самого себя
+	AssigneeID uint `json:"assignee_id"`
+}
+
+func onAssignConversation(e *Event, c *Chatter) (*EventResult, error) {
+	args := &assignConversationEventArgs{}
+	err := convertFromRaw([]byte(reflect.ValueOf(e.Args).String()), args)
+	if err != nil {
+		logrus.Error(err)
+		return e.getErrorResponse(ErrMarschalingMessage), nil
+	}
+
+	sc, err := ParseSessionChannel(args.SessionChannel)
+	if err != nil {
+		logrus.Error(err)
+		return e.getErrorResponse(err), nil
+	}
+
+	logrus.Info(fmt.Sprintf("Received a new %v event with following parameters: SessionChannel:%s, AssigneeID:%v", e.Name, sc.ToString(), args.AssigneeID))
+
+	assignee := args.AssigneeID
+	if assignee == 0 {
+		assignee = c.UserID
+	}
+
+	if assignee != c.UserID && !IsAllowed(c.Role, assignToOthersAction) {
+		return e.getErrorResponse(ErrForbidden), nil
+	}
+
+	if assignee != c.UserID && !isModeratorID(assignee) {
+		return e.getErrorResponse(ErrAssigneeNotModerator), nil
+	}
+
+	conversation, err := loadConversation(c, e.Name, sc)
+	if err != nil {
+		return e.getErrorResponse(err), nil
+	}
+
+	err = routing.assignTo(conversation, assignee)
+	if err != nil {
+		return e.getErrorResponse(err), nil
+	}
+
+	audit.Record(c.actor(), audit.ConversationAssign, audit.TargetConversation, conversation.ID,
+		map[string]interface{}{"assignee": assignee})
+
+	return &EventResult{
+		Name:   (*e).Name,
+		Ok:     true,
+		Result: convertConversation(conversation),
+	}, nil
+}
@@ -0,0 +1,27 @@
+package messaging
+
+import (
+	"net/http"
+
+	"github.com/dvgavrilov/gochat/service/source/audit"
+	"github.com/dvgavrilov/gochat/service/source/config"
+	"github.com/go-chi/jwtauth"
+)
+
+// ActorFromRequest описывает автора HTTP запроса для журнала аудита по claims его токена
+func ActorFromRequest(r *http.Request) audit.Actor {
+	_, claims, _ := jwtauth.FromContext(r.Context())
+	role, _ := RoleFromClaims(claims)
+
+	settings := config.Current().JWTSettings
+	id, err := subjectFromClaims(claims, settings.SubjectClaim)
+	if err != nil && settings.LegacySidParameter {
+		id, _ = getSenderID(r)
+	}
+
+	return audit.Actor{ID: id, Role: role, RemoteAddr: r.RemoteAddr}
+}
+
+func (c *Chatter) actor() audit.Actor {
+	return audit.Actor{ID: c.UserID, Role: c.Role, RemoteAddr: c.RemoteAddr}
+}
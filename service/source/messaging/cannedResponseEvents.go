@@ -0,0 +1,375 @@
+package messaging
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dvgavrilov/gochat/service/source/config"
+	"github.com/dvgavrilov/gochat/service/source/models"
+	"github.com/dvgavrilov/gochat/service/source/persistence"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrCannedResponseNotFound error
+	ErrCannedResponseNotFound = errors.New("canned response not found")
+	// ErrCannedResponseEmpty error
+	ErrCannedResponseEmpty = errors.New("canned response title and content are required")
+	// ErrGetCannedResponses error
+	ErrGetCannedResponses = errors.New("error while getting canned responses")
+	// ErrSaveCannedResponse error
+	ErrSaveCannedResponse = errors.New("error while saving a canned response")
+	// ErrDeleteCannedResponse error
+	ErrDeleteCannedResponse = errors.New("error while deleting a canned response")
+)
+
+const (
+	// ListCannedResponsesEvent const
+	ListCannedResponsesEvent = "Event.ListCannedResponses"
+	// SaveCannedResponseEvent const
+	SaveCannedResponseEvent = "Event.SaveCannedResponse"
+	// DeleteCannedResponseEvent const
+	DeleteCannedResponseEvent = "Event.DeleteCannedResponse"
+	// SendCannedResponseEvent const
+	SendCannedResponseEvent = "Event.SendCannedResponse"
+
+	// manageTeamCannedResponsesAction действие, позволяющее менять ответы команд, в которые модератор не входит
+	manageTeamCannedResponsesAction = "Action.ManageTeamCannedResponses"
+)
+
+var placeholderPattern = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_]+)\s*\}\}`)
+
+type saveCannedResponseEventArgs struct {
+	// ID 0 создаёт новый ответ
+	ID uint `json:"id"`
+	// Team пустая для личного ответа, задаётся только при создании
+	Team    string `json:"team"`
+	Title   string `json:"title"`
+	Content string `json:"content"`
+}
+
+type deleteCannedResponseEventArgs struct {
+	ID uint `json:"id"`
+}
+
+type sendCannedResponseEventArgs struct {
+	SessionChannel   string `json:"session_channel"`
+	CannedResponseID uint   `json:"canned_response_id"`
+	// Variables дополняют и переопределяют переменные, взятые из беседы
+	Variables map[string]string `json:"variables"`
+}
+
+type listCannedResponsesEventResult struct {
+	CannedResponses []*cannedResponse `json:"canned_responses"`
+}
+
+type cannedResponse struct {
+	ID        uint      `json:"id"`
+	OwnerID   uint      `json:"owner_id"`
+	Team      string    `json:"team"`
+	Title     string    `json:"title"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"create_at"`
+	UpdateAt  time.Time `json:"update_at"`
+}
+
+func onListCannedResponses(e *Event, c *Chatter) (*EventResult, error) {
+	logrus.Info(fmt.Sprintf("Received a new %v event with following parameters: UserID:%v", e.Name, c.UserID))
+
+	responses, err := persistence.GetCannedResponsesProvider().GetAvailable(c.UserID, teamsOf(c.UserID))
+	if err != nil {
+		logrus.Error(err)
+		return e.getErrorResponse(ErrGetCannedResponses), nil
+	}
+
+	return &EventResult{
+		Name: (*e).Name,
+		Ok:   true,
+		Result: listCannedResponsesEventResult{
+			CannedResponses: convertCannedResponses(responses),
+		},
+	}, nil
+}
+
+func onSaveCannedResponse(e *Event, c *Chatter) (*EventResult, error) {
+	args := &saveCannedResponseEventArgs{}
+	err := convertFromRaw([]byte(reflect.ValueOf(e.Args).String()), args)
+	if err != nil {
+		logrus.Error(err)
+		return e.getErrorResponse(ErrMarschalingMessage), nil
+	}
+
+	logrus.Info(fmt.Sprintf("Received a new %v event with following parameters: ID:%v, Team:%s", e.Name, args.ID, args.Team))
+
+	if strings.TrimSpace(args.Title) == "" || strings.TrimSpace(args.Content) == "" {
+		return e.getErrorResponse(ErrCannedResponseEmpty), nil
+	}
+
+	response := &models.CannedResponse{
+		Team:      args.Team,
+		CreatedAt: time.Now().UTC(),
+	}
+	if args.Team == "" {
+		response.OwnerID = c.UserID
+	} else if _, ok := config.Current().RoutingSettings.Teams[args.Team]; !ok {
+		return e.getErrorResponse(ErrTeamNotFound), nil
+	}
+
+	if args.ID != 0 {
+		response, err = persistence.GetCannedResponsesProvider().GetByID(args.ID)
+		if err != nil {
+			logrus.Error(err)
+			return e.getErrorResponse(ErrGetCannedResponses), nil
+		}
+	}
+
+	if response == nil {
+		return e.getErrorResponse(ErrCannedResponseNotFound), nil
+	}
+
+	if !canAccessCannedResponse(c, response) {
+		return e.getErrorResponse(ErrForbidden), nil
+	}
+
+	response.Title = args.Title
+	response.Content = args.Content
+	response.UpdatedAt = time.Now().UTC()
+
+	response, err = persistence.GetCannedResponsesProvider().Save(response)
+	if err != nil {
+		logrus.Error(err)
+		return e.getErrorResponse(ErrSaveCannedResponse), nil
+	}
+
+	return &EventResult{
+		Name:   (*e).Name,
+		Ok:     true,
+		Result: convertCannedResponse(response),
+	}, nil
+}
+
+func onDeleteCannedResponse(e *Event, c *Chatter) (*EventResult, error) {
+	args := &deleteCannedResponseEventArgs{}
+	err := convertFromRaw([]byte(reflect.ValueOf(e.Args).String()), args)
+	if err != nil {
+		logrus.Error(err)
+		return e.getErrorResponse(ErrMarschalingMessage), nil
+	}
+
+	logrus.Info(fmt.Sprintf("Received a new %v event with following parameters: ID:%v", e.Name, args.ID))
+
+	response, err := persistence.GetCannedResponsesProvider().GetByID(args.ID)
+	if err != nil {
+		logrus.Error(err)
+		return e.getErrorResponse(ErrGetCannedResponses), nil
+	}
+
+	if response == nil || !canAccessCannedResponse(c, response) {
+		return e.getErrorResponse(ErrCannedResponseNotFound), nil
+	}
+
+	err = persistence.GetCannedResponsesProvider().Delete(response.ID)
+	if err != nil {
+		logrus.Error(err)
+		return e.getErrorResponse(ErrDeleteCannedResponse), nil
+	}
+
+	return &EventResult{
+		Name:   (*e).Name,
+		Ok:     true,
+		Result: convertCannedResponse(response),
+	}, nil
+}
+
+// onSendCannedResponse подставляет переменные в шаблон и отправляет результат
+// через onSendMessage, как обычное сообщение
+func onSendCannedResponse(e *Event, c *Chatter) (*EventResult, error) {
+	args := &sendCannedResponseEventArgs{}
+	err := convertFromRaw([]byte(reflect.ValueOf(e.Args).String()), args)
+	if err != nil {
+		logrus.Error(err)
+		return e.getErrorResponse(ErrMarschalingMessage), nil
+	}
+
+	sc, err := ParseSessionChannel(args.SessionChannel)
+	if err != nil {
+		logrus.Error(err)
+		return e.getErrorResponse(err), nil
+	}
+
+	logrus.Info(fmt.Sprintf("Received a new %v event with following parameters: SessionChannel:%s, CannedResponseID:%v", e.Name, sc.ToString(), args.CannedResponseID))
+
+	if !IsAllowed(c.Role, SendMessageEvent) {
+		return e.getErrorResponse(ErrForbidden), nil
+	}
+
+	response, err := persistence.GetCannedResponsesProvider().GetByID(args.CannedResponseID)
+	if err != nil {
+		logrus.Error(err)
+		return e.getErrorResponse(ErrGetCannedResponses), nil
+	}
+
+	if response == nil || !canAccessCannedResponse(c, response) {
+		return e.getErrorResponse(ErrCannedResponseNotFound), nil
+	}
+
+	conversation, err := loadConversation(c, e.Name, sc)
+	if err != nil {
+		return e.getErrorResponse(err), nil
+	}
+
+	vars, err := cannedResponseVariables(c, conversation, args.Variables)
+	if err != nil {
+		logrus.Error(err)
+		return e.getErrorResponse(ErrGettingConversation), nil
+	}
+
+	content, err := fillPlaceholders(response.Content, vars)
+	if err != nil {
+		return e.getErrorResponse(err), nil
+	}
+
+	raw, err := json.Marshal(&sendMessageEventArgs{
+		SessionChannel: args.SessionChannel,
+		Content:        content,
+		ContentType:    models.ContentText,
+	})
+	if err != nil {
+		logrus.Error(err)
+		return e.getErrorResponse(ErrMarschalingMessage), nil
+	}
+
+	result, err := onSendMessage(&Event{Name: SendMessageEvent, Args: string(raw)}, c)
+	if result != nil {
+		result.Name = (*e).Name
+	}
+
+	return result, err
+}
+
+// cannedResponseVariables значения переменных шаблона, переданные клиентом имеют приоритет.
+// customer_id первый из клиентов беседы, customer_ids все клиенты через пробел
+func cannedResponseVariables(c *Chatter, conv *models.Conversation, custom map[string]string) (map[string]string, error) {
+	customers, err := customerParticipants(conv)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	vars := map[string]string{
+		"conversation_id": fmt.Sprintf("%v", conv.ID),
+		"application_id":  fmt.Sprintf("%v", conv.ApplicationID),
+		"session_channel": SessionChannel{ApplicationID: conv.ApplicationID}.ToString(),
+		"status":          conversationStatus(conv),
+		"assignee_id":     fmt.Sprintf("%v", conv.AssigneeID),
+		"agent_id":        fmt.Sprintf("%v", c.UserID),
+		"date":            now.Format("2006-01-02"),
+		"time":            now.Format("15:04"),
+	}
+
+	if len(customers) > 0 {
+		vars["customer_id"] = fmt.Sprintf("%v", customers[0])
+		vars["customer_ids"] = joinIDs(customers)
+	}
+
+	for k, v := range custom {
+		vars[k] = v
+	}
+
+	return vars, nil
+}
+
+// customerParticipants роль участника не хранится, поэтому клиентами считаются
+// участники, которые не являются ни ответственными за беседу, ни модераторами
+func customerParticipants(conv *models.Conversation) ([]uint, error) {
+	participants, err := persistence.GetParticipantsProvider().GetByConversationID(conv.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]uint, 0)
+	for _, p := range *participants {
+		if p.UserID == conv.AssigneeID || p.UserID == conv.LastAssigneeID || isModeratorID(p.UserID) {
+			continue
+		}
+
+		ret = append(ret, p.UserID)
+	}
+
+	return ret, nil
+}
+
+// fillPlaceholders заменяет {{name}} значениями vars и возвращает ошибку со списком
+// переменных, для которых значения нет
+func fillPlaceholders(content string, vars map[string]string) (string, error) {
+	missing := make(map[string]bool)
+	ret := placeholderPattern.ReplaceAllStringFunc(content, func(match string) string {
+		name := placeholderPattern.FindStringSubmatch(match)[1]
+		value, ok := vars[name]
+		if !ok {
+			missing[name] = true
+			return match
+		}
+
+		return value
+	})
+
+	if len(missing) > 0 {
+		names := make([]string, 0, len(missing))
+		for name := range missing {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		return "", fmt.Errorf("canned response variables are missing: %s", strings.Join(names, ", "))
+	}
+
+	return ret, nil
+}
+
+// canAccessCannedResponse личный ответ доступен только владельцу, ответ команды - её участникам
+// и тем, кому разрешено управлять ответами всех команд
+func canAccessCannedResponse(c *Chatter, r *models.CannedResponse) bool {
+	if r.Team == "" {
+		return r.OwnerID == c.UserID
+	}
+
+	for _, team := range teamsOf(c.UserID) {
+		if team == r.Team {
+			return true
+		}
+	}
+
+	return IsAllowed(c.Role, manageTeamCannedResponsesAction)
+}
+
+func convertCannedResponses(responses *[]models.CannedResponse) []*cannedResponse {
+	ret := make([]*cannedResponse, 0)
+	if responses == nil {
+		return ret
+	}
+
+	for i := range *responses {
+		ret = append(ret, convertCannedResponse(&(*responses)[i]))
+	}
+
+	return ret
+}
+
+func convertCannedResponse(model *models.CannedResponse) *cannedResponse {
+	return &cannedResponse{
+		ID:        model.ID,
+		OwnerID:   model.OwnerID,
+		Team:      model.Team,
+		Title:     model.Title,
+		Content:   model.Content,
+		CreatedAt: model.CreatedAt,
+		UpdateAt:  model.UpdatedAt,
+	}
+}
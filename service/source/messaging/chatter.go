@@ -3,10 +3,14 @@ package messaging
 import (
 	"encoding/json"
 	"fmt"
-	"leto-yanao-1/service/source/config"
-
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/dvgavrilov/gochat/service/source/config"
+	"github.com/dvgavrilov/gochat/service/source/metrics"
+	"github.com/dvgavrilov/gochat/service/source/models"
+
 	"github.com/sirupsen/logrus"
 
 	"github.com/gorilla/websocket"
@@ -14,13 +18,30 @@ import (
 
 // Chatter structure
 type Chatter struct {
-	UserID      uint
+	UserID uint
+	Role   string
+	// IsCustomer и IsModerator выводятся из Role и определяют, кому доставляются сообщения,
+	// а не права доступа, которые проверяются по матрице PermissionSettings
 	IsCustomer  bool
 	IsModerator bool
-	Rooms       map[string]*chatRoom
 	Events      map[string]EventHandler
 	WebSocket   *WebSocket
 	Out         chan []byte
+	// applications приложения из токена, в беседы которых чаттер может войти без MembershipSettings.Overrides
+	applications []uint
+	// RemoteAddr и ConnectedAt показываются в административном API
+	RemoteAddr  string
+	ConnectedAt time.Time
+
+	// rooms принадлежит горутине хаба, см. Hub.exec
+	rooms     map[string]*chatRoom
+	done      chan struct{}
+	closeOnce sync.Once
+	closeMsg  []byte
+
+	// expiresAt срок действия токена на момент подключения, обновления приходят через refresh
+	expiresAt time.Time
+	refresh   chan time.Time
 }
 
 const (
@@ -28,15 +49,29 @@ const (
 	pongWait       = 60 * time.Second
 	pingPeriod     = (pongWait * 9) / 10
 	maxMessageSize = 512
+	outQueueSize   = 256
 )
 
+func newChatter(userID uint, role string, ws *WebSocket) *Chatter {
+	return &Chatter{
+		UserID:      userID,
+		Role:        role,
+		IsCustomer:  role == models.RoleCustomer,
+		IsModerator: models.IsModeratorRole(role),
+		WebSocket:   ws,
+		Events:      make(map[string]EventHandler),
+		Out:         make(chan []byte, outQueueSize),
+		rooms:       make(map[string]*chatRoom),
+		done:        make(chan struct{}),
+		refresh:     make(chan time.Time),
+		ConnectedAt: time.Now().UTC(),
+	}
+}
+
 // Reader func
 func (c *Chatter) Reader() {
-	defer func() {
-		hub.leave(c)
-		c.WebSocket.Conn.Close()
-		hub.unregister(c)
-	}()
+	// сокет закрывает Writer, после того как отправит close frame
+	defer hub.unregister(c)
 
 	c.WebSocket.Conn.SetReadLimit(int64(config.MainConfiguration.WebSocketSettings.ReadBufferSize))
 	c.WebSocket.Conn.SetReadDeadline(time.Now().Add(pongWait))
@@ -59,23 +94,47 @@ func (c *Chatter) Reader() {
 
 		e, err := rawToEvent(m)
 		if err != nil {
+			metrics.EventsReceived.WithLabelValues("", metrics.OutcomeMalformed).Inc()
 			em := fmt.Sprintf("message parsing error: %v", err)
 			logrus.Error(em)
-			c.WebSocket.Conn.WriteJSON(em)
+			c.replyJSON(em)
 			// TODO - should we continue or break?
 			continue
 		}
 
 		action, ok := c.Events[e.Name]
 		if !ok {
+			// имя неизвестного события в метку не попадает, чтобы клиент не мог раздуть число рядов
+			metrics.EventsReceived.WithLabelValues("", metrics.OutcomeUnknown).Inc()
 			em := fmt.Sprintf("not supported event: %v", e.Name)
 			logrus.Error(em)
-			c.WebSocket.Conn.WriteJSON(em)
+			c.replyJSON(em)
 			// TODO - should we continue or break?
 			continue
 		}
 
+		if !IsAllowed(c.Role, e.Name) {
+			metrics.EventsReceived.WithLabelValues(e.Name, metrics.OutcomeForbidden).Inc()
+			logrus.Warn(fmt.Sprintf("Chatter with id %v and role %s is not allowed to call %v", c.UserID, c.Role, e.Name))
+			c.replyJSON(e.getErrorResponse(ErrForbidden))
+			continue
+		}
+
+		// inflight увеличивается до проверки done: Shutdown сначала закрывает done и только потом
+		// ждёт inflight, поэтому обработчик либо будет учтён, либо не будет запущен
+		atomic.AddInt64(&inflight, 1)
+		select {
+		case <-c.done:
+			atomic.AddInt64(&inflight, -1)
+			return
+		default:
+		}
+
+		start := time.Now()
 		ret, err := action(e, c)
+		metrics.EventDuration.WithLabelValues(e.Name).Observe(time.Since(start).Seconds())
+		atomic.AddInt64(&inflight, -1)
+		metrics.EventsReceived.WithLabelValues(e.Name, eventOutcome(ret, err)).Inc()
 		if err != nil {
 			em := fmt.Sprintf("a critical error happened, closing the socket.")
 			logrus.Error(em)
@@ -86,56 +145,75 @@ func (c *Chatter) Reader() {
 		if err != nil {
 			em := fmt.Sprintf("event result serialization error: %v", err)
 			logrus.Error(em)
-			c.WebSocket.Conn.WriteJSON(em)
+			c.replyJSON(em)
 			// TODO - shold we continue or break?
 			continue
 		}
 
-		c.Out <- rm
+		if !c.reply(rm) {
+			break
+		}
+	}
+}
+
+// eventOutcome результат обработки события для метрик
+func eventOutcome(ret *EventResult, err error) string {
+	switch {
+	case err != nil:
+		return metrics.OutcomeFailed
+	case ret != nil && !ret.Ok:
+		return metrics.OutcomeError
 	}
+
+	return metrics.OutcomeOk
 }
 
 // Writer func
 func (c *Chatter) Writer() {
 	ticker := time.NewTicker(pingPeriod)
+	token := newTokenTimers(c.expiresAt)
 	defer func() {
-		hub.leave(c)
 		ticker.Stop()
+		token.stop()
 		hub.unregister(c)
 		c.WebSocket.Conn.Close()
+		writers.Done()
 	}()
 
 	for {
 		select {
-		case m, ok := <-c.Out:
+		case <-c.done:
+			{
+				c.flush()
+				c.WebSocket.write(websocket.CloseMessage, c.closeMsg)
+				return
+			}
+		case m := <-c.Out:
 			{
+				metrics.OutQueueDepth.Observe(float64(len(c.Out)))
 				c.WebSocket.Conn.SetWriteDeadline(time.Now().Add(writeWait))
-				if !ok {
-					c.WebSocket.Conn.WriteMessage(websocket.CloseMessage, []byte{})
-					return
-				}
 
 				w, err := c.WebSocket.Conn.NextWriter(websocket.TextMessage)
 				if err != nil {
+					metrics.WriteFailures.WithLabelValues("next_writer").Inc()
 					em := fmt.Sprintf("getting next writer error: %v", err)
 					logrus.Error(em)
-					c.WebSocket.Conn.WriteJSON(em)
 					return
 				}
 
 				_, err = w.Write(m)
 				if err != nil {
+					metrics.WriteFailures.WithLabelValues("write").Inc()
 					em := fmt.Sprintf("writing message back error: %v", err)
 					logrus.Error(em)
-					c.WebSocket.Conn.WriteJSON(em)
 					return
 				}
 
 				err = w.Close()
 				if err != nil {
+					metrics.WriteFailures.WithLabelValues("close").Inc()
 					em := fmt.Sprintf("closing web socket writer error: %v", err)
 					logrus.Error(em)
-					c.WebSocket.Conn.WriteJSON(em)
 					return
 				}
 			}
@@ -143,9 +221,32 @@ func (c *Chatter) Writer() {
 			{
 				err := c.WebSocket.wpong()
 				if err != nil {
+					metrics.WriteFailures.WithLabelValues("ping").Inc()
 					return
 				}
 			}
+		case expiresAt := <-c.refresh:
+			{
+				token.reset(expiresAt)
+			}
+		case <-token.warning.C:
+			{
+				m, err := token.warningMessage()
+				if err != nil {
+					logrus.Error(err)
+					continue
+				}
+
+				err = c.WebSocket.write(websocket.TextMessage, m)
+				if err != nil {
+					return
+				}
+			}
+		case <-token.expiry.C:
+			{
+				logrus.Info(fmt.Sprintf("The token of chatter with id %v expired, closing the socket", c.UserID))
+				c.closeWith(CloseTokenExpired, "token expired")
+			}
 		}
 	}
 }
@@ -161,6 +262,71 @@ func (w *WebSocket) write(messageType int, payload []byte) error {
 	return w.Conn.WriteMessage(messageType, payload)
 }
 
+// send ставит сообщение в очередь без блокировки. Возвращает false,
+// если чаттер уже закрыт или его очередь переполнена.
+func (c *Chatter) send(message []byte) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+
+	select {
+	case c.Out <- message:
+		return true
+	default:
+		return false
+	}
+}
+
+// reply ставит ответ на событие в очередь, ожидая места в ней, пока чаттер не закрыт
+func (c *Chatter) reply(message []byte) bool {
+	select {
+	case c.Out <- message:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+func (c *Chatter) replyJSON(v interface{}) bool {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		logrus.Error(err)
+		return false
+	}
+
+	return c.reply(raw)
+}
+
+// close завершает работу Writer, может вызываться многократно
+func (c *Chatter) close() {
+	c.closeWith(websocket.CloseNormalClosure, "")
+}
+
+// closeWith завершает работу Writer, который перед закрытием сокета
+// отправит close frame с переданными кодом и причиной
+func (c *Chatter) closeWith(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.closeMsg = websocket.FormatCloseMessage(code, reason)
+		close(c.done)
+	})
+}
+
+// flush отправляет сообщения, оставшиеся в очереди на момент закрытия
+func (c *Chatter) flush() {
+	for {
+		select {
+		case m := <-c.Out:
+			if err := c.WebSocket.write(websocket.TextMessage, m); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
 // On func
 func (c *Chatter) On(eventName string, action EventHandler) *Chatter {
 	(*c).Events[eventName] = action
@@ -28,10 +28,12 @@ const (
 	AddConversationEvent = "Event.AddConversation"
 	// GetConversationListEvent const
 	GetConversationListEvent = "Event.GetConversationList"
+
+	// createConversationAction позволяет создавать беседы приложений, которых нет в токене
+	createConversationAction = "Action.CreateConversation"
 )
 
 type addConversationEventArgs struct {
-	UserID        uint `json:"user_id"`
 	ApplicationID uint `json:"application_id"`
 }
 
@@ -40,7 +42,8 @@ type addConversationEventResult struct {
 }
 
 type getConversationListArgs struct {
-	UserID uint `json:"user_id"`
+	// Statuses фильтр по состоянию, по умолчанию возвращаются open и pending беседы
+	Statuses []string `json:"statuses"`
 }
 
 type getConversationListResult struct {
@@ -51,6 +54,8 @@ type conversation struct {
 	ID             uint      `json:"id"`
 	SessionChannel string    `json:"session_channel"`
 	ApplicationID  uint      `json:"application_id"`
+	AssigneeID     uint      `json:"assignee_id"`
+	Status         string    `json:"status"`
 	CreatedAt      time.Time `json:"create_at"`
 	UpdateAt       time.Time `json:"update_at"`
 }
@@ -68,10 +73,6 @@ func onAddConversation(e *Event, c *Chatter) (*EventResult, error) {
 		return e.getErrorResponse(ErrMarschalingMessage), nil
 	}
 
-	if args.UserID != c.UserID {
-		return e.getErrorResponse(ErrUnauthorized), nil
-	}
-
 	sc := SessionChannel{
 		ApplicationID: args.ApplicationID,
 	}
@@ -84,8 +85,15 @@ func onAddConversation(e *Event, c *Chatter) (*EventResult, error) {
 	}
 
 	if conv == nil {
+		// иначе первый же клиент с любым application_id занял бы чужую беседу
+		if !c.hasApplication(args.ApplicationID) && !IsAllowed(c.Role, createConversationAction) {
+			auditMembershipDenial(c, createConversationAction, &models.Conversation{ApplicationID: args.ApplicationID})
+			return e.getErrorResponse(ErrNotConversationMember), nil
+		}
+
 		newConversation := &models.Conversation{
 			ApplicationID: args.ApplicationID,
+			Status:        models.ConversationOpen,
 			CreatedAt:     time.Now().UTC(),
 			UpdatedAt:     time.Now().UTC(),
 			Participants: []models.Participant{
@@ -103,15 +111,20 @@ func onAddConversation(e *Event, c *Chatter) (*EventResult, error) {
 
 		conv = newConversation
 	} else {
-		found := false
-		for _, p := range conv.Participants {
-			if p.UserID == c.UserID {
-				found = true
-				break
-			}
+		found, err := isParticipant(conv.ID, c.UserID)
+		if err != nil {
+			logrus.Error(err)
+			return e.getErrorResponse(ErrGettingConversation), nil
 		}
 
 		if !found {
+			// присоединиться к чужой беседе можно своему приложению из токена
+			// или по правилам MembershipSettings.Overrides
+			if !c.hasApplication(args.ApplicationID) && !canOverrideMembership(c.Role, e.Name) {
+				auditMembershipDenial(c, e.Name, conv)
+				return e.getErrorResponse(ErrNotConversationMember), nil
+			}
+
 			p := &models.Participant{
 				ConversationID: conv.ID,
 				UserID:         c.UserID,
@@ -125,44 +138,43 @@ func onAddConversation(e *Event, c *Chatter) (*EventResult, error) {
 	}
 
 	key := fmt.Sprintf("%v", args.ApplicationID)
-	cr, err := hub.join(c, key)
+	err = hub.join(c, key)
 	if err != nil {
 		logrus.Error(err)
 		return e.getErrorResponse(ErrJoiningChat), nil
 	}
-	if _, ok := c.Rooms[key]; !ok {
-		c.Rooms[key] = cr
-	}
 
 	return &EventResult{
-		Name: (*e).Name,
-		Ok:   true,
-		Result: &conversation{
-			ID:             conv.ID,
-			ApplicationID:  conv.ApplicationID,
-			CreatedAt:      conv.CreatedAt,
-			UpdateAt:       conv.UpdatedAt,
-			SessionChannel: sc.ToString(),
-		},
+		Name:   (*e).Name,
+		Ok:     true,
+		Result: convertConversation(conv),
 	}, nil
 }
 
 func onGetConversationList(e *Event, c *Chatter) (*EventResult, error) {
 
 	args := &getConversationListArgs{}
-	err := convertFromRaw([]byte(reflect.ValueOf(e.Args).String()), args)
-	if err != nil {
-		logrus.Error(err)
-		return e.getErrorResponse(ErrMarschalingMessage), nil
+	if e.Args != nil {
+		err := convertFromRaw([]byte(reflect.ValueOf(e.Args).String()), args)
+		if err != nil {
+			logrus.Error(err)
+			return e.getErrorResponse(ErrMarschalingMessage), nil
+		}
 	}
 
-	logrus.Info(fmt.Sprintf("Received a new %v event with following parameters: UserID:%v", e.Name, args.UserID))
+	if len(args.Statuses) == 0 {
+		args.Statuses = models.ActiveConversationStatuses
+	}
 
-	if c.UserID != args.UserID {
-		return e.getErrorResponse(ErrUnauthorized), nil
+	for _, s := range args.Statuses {
+		if !models.IsConversationStatus(s) {
+			return e.getErrorResponse(ErrStatusInvalid), nil
+		}
 	}
 
-	conversations, err := persistence.GetConversationsProvider().GetByUserID(args.UserID)
+	logrus.Info(fmt.Sprintf("Received a new %v event with following parameters: UserID:%v, Statuses:%v", e.Name, c.UserID, args.Statuses))
+
+	conversations, err := persistence.GetConversationsProvider().GetByUserID(c.UserID, args.Statuses)
 	if err != nil {
 		logrus.Error(err)
 		return nil, ErrGetConnections
@@ -196,6 +208,8 @@ func convertConversation(model *models.Conversation) *conversation {
 	return &conversation{
 		ID:            model.ID,
 		ApplicationID: model.ApplicationID,
+		AssigneeID:    model.AssigneeID,
+		Status:        conversationStatus(model),
 		CreatedAt:     model.CreatedAt,
 		UpdateAt:      model.UpdatedAt,
 		SessionChannel: SessionChannel{
@@ -9,10 +9,12 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
-	"sync"
+	"time"
 
+	"github.com/dgrijalva/jwt-go"
 	"github.com/dvgavrilov/gochat/service/source/config"
 	"github.com/dvgavrilov/gochat/service/source/customerrors"
+	"github.com/dvgavrilov/gochat/service/source/metrics"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/jwtauth"
 	"github.com/gorilla/websocket"
@@ -34,6 +36,12 @@ var (
 	ErrTokenBadStructure = errors.New("received token has wrong structure")
 	// ErrNoChatterMatch error
 	ErrNoChatterMatch = errors.New("error finding the chatters to broadcast the message")
+	// ErrSubjectInvalid error
+	ErrSubjectInvalid = errors.New("token subject claim is missing or is not a user id")
+	// ErrSubjectMismatch error
+	ErrSubjectMismatch = errors.New("the sid parameter does not match the token subject")
+	// ErrHubDraining error
+	ErrHubDraining = errors.New("the server is shutting down and does not accept new chatters")
 )
 
 const (
@@ -43,11 +51,14 @@ const (
 
 var hub *Hub
 
-// Hub структура
+// Hub структура. Хаб построен по модели актора: Rooms и Chatters принадлежат
+// единственной горутине run, все остальные обращаются к ним через exec.
 type Hub struct {
-	mux      sync.Mutex
 	Rooms    map[string]*chatRoom
 	Chatters map[*Chatter]uint
+
+	ops      chan func()
+	draining bool
 }
 
 type predicate func(*Chatter) bool
@@ -69,11 +80,26 @@ type WebSocket struct {
 }
 
 // Init Функция
-func Init(r *chi.Mux) {
-	r.Use(verifier(jwtauth.New("HS256", jwtSecret, nil)))
+// Init проверяет ключи подписи и регистрирует /ws в r. JWT middleware применяются ко всему r,
+// поэтому маршруты, не требующие токена, регистрируются вне него
+func Init(r chi.Router) error {
+	err := ReloadKeys()
+	if err != nil {
+		return err
+	}
+
+	r.Use(verifier)
 	r.Use(authorize)
 
 	registerWsListener(r)
+
+	err = metrics.Register(hubCollector{})
+	if err != nil {
+		return err
+	}
+
+	go watchSLA()
+	return nil
 }
 
 var upgrader = websocket.Upgrader{
@@ -81,7 +107,8 @@ var upgrader = websocket.Upgrader{
 	ReadBufferSize:  config.MainConfiguration.WebSocketSettings.ReadBufferSize,
 	WriteBufferSize: config.MainConfiguration.WebSocketSettings.WriteBufferSize,
 	CheckOrigin: func(r *http.Request) bool {
-		if config.MainConfiguration.WebSocketSettings.Origin == "" {
+		origin := config.Current().WebSocketSettings.Origin
+		if origin == "" {
 			return true
 		}
 
@@ -90,19 +117,27 @@ var upgrader = websocket.Upgrader{
 			return false
 		}
 
-		if strings.ToLower(host) == strings.ToLower(config.MainConfiguration.WebSocketSettings.Origin) {
+		if strings.ToLower(host) == strings.ToLower(origin) {
 			return true
 		}
 		return false
 	},
 }
 
-func registerWsListener(r *chi.Mux) {
-	hub = &Hub{
+func newHub() *Hub {
+	h := &Hub{
 		Chatters: make(map[*Chatter]uint),
 		Rooms:    make(map[string]*chatRoom),
+		ops:      make(chan func()),
 	}
 
+	go h.run()
+	return h
+}
+
+func registerWsListener(r chi.Router) {
+	hub = newHub()
+
 	r.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		handleRequests(w, r)
 	})
@@ -111,57 +146,60 @@ func registerWsListener(r *chi.Mux) {
 func handleRequests(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	sid, err := getSenderID(r)
-	if err != nil {
-		logrus.Error(err)
-		http.Error(w, "the sid parameter is invalid", http.StatusBadRequest)
+	if hub.isDraining() {
+		metrics.UpgradeFailures.WithLabelValues("draining").Inc()
+		w.Header().Set("Retry-After", fmt.Sprintf("%v", int(reconnectDelay.Seconds())))
+		http.Error(w, ErrHubDraining.Error(), http.StatusServiceUnavailable)
 		return
 	}
 
-	// if _, ok := hub.Chatters[sid]; ok {
-	// 	logrus.Error(ErrChatterDuplicate)
-	// 	http.Error(w, "the sid parameter is invalid", http.StatusBadRequest)
-	// 	return
-	// }
-
 	_, claims, _ := jwtauth.FromContext(r.Context())
 	if claims == nil {
+		metrics.UpgradeFailures.WithLabelValues("claims").Inc()
 		http.Error(w, ErrTokenBadStructure.Error(), http.StatusBadRequest)
 		return
 	}
 
-	var iscustomer bool
-	if _, ok := claims[requestID]; ok {
-		iscustomer = true
+	sid, err := getChatterID(r, claims)
+	if err != nil {
+		metrics.UpgradeFailures.WithLabelValues("subject").Inc()
+		logrus.Error(err)
+		if err == ErrSubjectMismatch {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	var isadmin bool
-	if _, ok := claims[adminID]; ok {
-		isadmin = true
+	role, err := RoleFromClaims(claims)
+	if err != nil {
+		metrics.UpgradeFailures.WithLabelValues("role").Inc()
+		logrus.Error(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	if iscustomer && isadmin {
-		logrus.Error(fmt.Sprintf("token contains both parameters: a request_id and an admin_id"))
+	expiresAt, err := expiryFromClaims(claims)
+	if err != nil {
+		metrics.UpgradeFailures.WithLabelValues("expiry").Inc()
+		logrus.Error(err)
 		http.Error(w, ErrTokenBadStructure.Error(), http.StatusBadRequest)
 		return
 	}
 
 	conn, err := upgrader.Upgrade(w, r, getUpgraderWebSocketHeader())
 	if err != nil {
+		metrics.UpgradeFailures.WithLabelValues("upgrade").Inc()
 		logrus.Error(err)
 		http.Error(w, "unable to upgrade", http.StatusInternalServerError)
 		return
 	}
 
-	chatter := &Chatter{
-		UserID:      sid,
-		IsCustomer:  iscustomer,
-		IsModerator: isadmin,
-		WebSocket:   &WebSocket{Conn: conn},
-		Rooms:       make(map[string]*chatRoom),
-		Events:      make(map[string]EventHandler),
-		Out:         make(chan []byte),
-	}
+	chatter := newChatter(sid, role, &WebSocket{Conn: conn})
+	chatter.expiresAt = expiresAt
+	chatter.applications = applicationsFromClaims(claims)
+	chatter.RemoteAddr = r.RemoteAddr
 
 	chatter.On(GetConversationListEvent, onGetConversationList)
 	chatter.On(AddConversationEvent, onAddConversation)
@@ -170,15 +208,87 @@ func handleRequests(w http.ResponseWriter, r *http.Request) {
 	chatter.On(ReadMessageEvent, onReadMessage)
 	chatter.On(GetUnreadInfoEvent, onGetUnreadInfo)
 	chatter.On(GetUnreadMessagesEvent, onGetUnreadMessagesList)
-
-	hub.register(chatter)
+	chatter.On(RefreshTokenEvent, onRefreshToken)
+	chatter.On(AssignConversationEvent, onAssignConversation)
+	chatter.On(ResolveConversationEvent, onResolveConversation)
+	chatter.On(ReopenConversationEvent, onReopenConversation)
+	chatter.On(TransferConversationEvent, onTransferConversation)
+	chatter.On(GetTransferHistoryEvent, onGetTransferHistory)
+	chatter.On(ListCannedResponsesEvent, onListCannedResponses)
+	chatter.On(SaveCannedResponseEvent, onSaveCannedResponse)
+	chatter.On(DeleteCannedResponseEvent, onDeleteCannedResponse)
+	chatter.On(SendCannedResponseEvent, onSendCannedResponse)
+	chatter.On(GetConversationStatsEvent, onGetConversationStats)
+
+	err = hub.register(chatter)
+	if err != nil {
+		metrics.UpgradeFailures.WithLabelValues("register").Inc()
+		logrus.Error(err)
+		conn.WriteControl(websocket.CloseMessage, goingAwayMessage(), time.Now().Add(writeWait))
+		conn.Close()
+		return
+	}
 
 	logrus.Info(fmt.Sprintf("A chatter with id %v registered and created a socket for it.", sid))
 
+	if chatter.IsModerator {
+		go routing.drain()
+	}
+
 	go chatter.Reader()
 	go chatter.Writer()
 }
 
+// getChatterID возвращает идентификатор пользователя из проверенного токена.
+// Параметр sid, если он передан, должен совпадать с ним. В режиме совместимости
+// LegacySidParameter идентификатор, как и раньше, берётся из sid.
+func getChatterID(r *http.Request, claims jwt.MapClaims) (uint, error) {
+	settings := config.Current().JWTSettings
+	if settings.LegacySidParameter {
+		return getSenderID(r)
+	}
+
+	subject, err := subjectFromClaims(claims, settings.SubjectClaim)
+	if err != nil {
+		return 0, err
+	}
+
+	if r.FormValue("sid") != "" {
+		sid, err := getSenderID(r)
+		if err != nil || sid != subject {
+			return 0, ErrSubjectMismatch
+		}
+	}
+
+	return subject, nil
+}
+
+func subjectFromClaims(claims jwt.MapClaims, name string) (uint, error) {
+	if name == "" {
+		name = "sub"
+	}
+
+	var value uint64
+	var err error
+	switch v := claims[name].(type) {
+	case string:
+		value, err = strconv.ParseUint(v, 10, 32)
+	case float64:
+		if v < 0 || v != float64(uint32(v)) {
+			err = ErrSubjectInvalid
+		}
+		value = uint64(v)
+	default:
+		err = ErrSubjectInvalid
+	}
+
+	if err != nil {
+		return 0, ErrSubjectInvalid
+	}
+
+	return uint(value), nil
+}
+
 func getSenderID(r *http.Request) (uint, error) {
 
 	sid, err := strconv.ParseUint(r.FormValue("sid"), 10, 32)
@@ -190,18 +300,45 @@ func getSenderID(r *http.Request) (uint, error) {
 	return uint(sid), nil
 }
 
-func (h *Hub) register(chatter *Chatter) error {
-	h.mux.Lock()
-	defer h.mux.Unlock()
+func (h *Hub) run() {
+	for op := range h.ops {
+		op()
+	}
+}
 
+// exec выполняет fn в горутине хаба и дожидается её завершения.
+// Только внутри fn разрешено читать и изменять Rooms, Chatters и Chatter.rooms.
+func (h *Hub) exec(fn func()) {
+	done := make(chan struct{})
+	h.ops <- func() {
+		defer close(done)
+		fn()
+	}
+	<-done
+}
+
+func (h *Hub) register(chatter *Chatter) error {
 	if chatter == nil {
 		return customerrors.ErrArgumentNilError
 	}
 
-	// if _, ok := h.Chatters[chatter.UserID]; ok {
-	// 	return ErrChatterDuplicate
-	// }
-	h.Chatters[chatter] = chatter.UserID
+	var err error
+	h.exec(func() {
+		if h.draining {
+			err = ErrHubDraining
+			return
+		}
+
+		h.Chatters[chatter] = chatter.UserID
+		// Writer запускается только для чаттеров с сокетом и вызывает Done при выходе
+		if chatter.WebSocket != nil {
+			writers.Add(1)
+		}
+	})
+
+	if err != nil {
+		return err
+	}
 
 	logrus.Info(fmt.Sprintf("A new chatter with id %v was registered", chatter.UserID))
 
@@ -209,32 +346,93 @@ func (h *Hub) register(chatter *Chatter) error {
 }
 
 func (h *Hub) unregister(chatter *Chatter) error {
-	h.mux.Lock()
-	defer h.mux.Unlock()
-
-	if _, ok := h.Chatters[chatter]; ok {
-		delete(h.Chatters, chatter)
+	if chatter == nil {
+		return customerrors.ErrArgumentNilError
 	}
 
+	h.exec(func() {
+		h.drop(chatter)
+	})
+
 	return nil
 }
 
-func (h *Hub) join(chatter *Chatter, chatID string) (*chatRoom, error) {
+func (h *Hub) join(chatter *Chatter, chatID string) error {
+	if h == nil || chatter == nil {
+		return customerrors.ErrArgumentNilError
+	}
+
+	var err error
+	h.exec(func() {
+		if _, ok := h.Chatters[chatter]; !ok {
+			err = ErrUnknownChatter
+			return
+		}
+
+		err = h.addToRoom(chatter, chatID)
+	})
+
+	return err
+}
 
-	h.mux.Lock()
-	defer h.mux.Unlock()
+// joinUser добавляет в комнату все сокеты пользователя, возвращает false, если пользователь не в сети
+func (h *Hub) joinUser(userID uint, chatID string) (bool, error) {
+	var found bool
+	var err error
+	h.exec(func() {
+		for chatter := range h.Chatters {
+			if chatter.UserID != userID {
+				continue
+			}
+
+			found = true
+			if e := h.addToRoom(chatter, chatID); e != nil {
+				err = e
+			}
+		}
+	})
 
+	return found, err
+}
+
+// leave удаляет чаттера из комнаты chatID
+func (h *Hub) leave(chatter *Chatter, chatID string) error {
 	if h == nil || chatter == nil {
-		return nil, customerrors.ErrArgumentNilError
+		return customerrors.ErrArgumentNilError
+	}
+
+	var err error
+	h.exec(func() {
+		if _, ok := chatter.rooms[chatID]; !ok {
+			err = ErrChatRoomNotFound
+			return
+		}
+
+		h.removeFromRoom(chatter, chatID)
+	})
+
+	return err
+}
+
+// removeFromRoom выполняется в горутине хаба, пустая комната удаляется
+func (h *Hub) removeFromRoom(chatter *Chatter, chatID string) {
+	delete(chatter.rooms, chatID)
+
+	room, ok := h.Rooms[chatID]
+	if !ok {
+		return
 	}
 
-	if _, ok := h.Chatters[chatter]; !ok {
-		return nil, ErrUnknownChatter
+	delete(room.Chatters, chatter)
+	if len(room.Chatters) == 0 {
+		delete(h.Rooms, chatID)
 	}
+}
 
-	var ch *chatRoom
-	var ok bool
-	if ch, ok = h.Rooms[chatID]; !ok {
+// addToRoom выполняется в горутине хаба
+func (h *Hub) addToRoom(chatter *Chatter, chatID string) error {
+	ch, ok := h.Rooms[chatID]
+	if !ok {
 		ch = &chatRoom{
 			ID:       chatID,
 			Chatters: make(map[*Chatter]bool),
@@ -242,75 +440,135 @@ func (h *Hub) join(chatter *Chatter, chatID string) (*chatRoom, error) {
 		h.Rooms[chatID] = ch
 	}
 
-	if len(h.Rooms[chatID].Chatters) == config.MainConfiguration.ChatRoomSettings.MaxValueOfChatters {
-		logrus.Info(fmt.Sprintf("The limit of chatters exceeds in %s chat room", chatID))
-		return nil, ErrLimitChattersExceed
+	if _, ok = ch.Chatters[chatter]; ok {
+		return nil
 	}
 
-	if _, ok = h.Rooms[chatID].Chatters[chatter]; !ok {
-		h.Rooms[chatID].Chatters[chatter] = true
-		logrus.Info(fmt.Sprintf("Chatter with id %v joined the %s chat room", chatter.UserID, chatID))
+	if len(ch.Chatters) >= config.Current().ChatRoomSettings.MaxValueOfChatters {
+		logrus.Info(fmt.Sprintf("The limit of chatters exceeds in %s chat room", chatID))
+		if len(ch.Chatters) == 0 {
+			delete(h.Rooms, chatID)
+		}
+		return ErrLimitChattersExceed
 	}
 
-	return ch, nil
+	ch.Chatters[chatter] = true
+	chatter.rooms[chatID] = ch
+	logrus.Info(fmt.Sprintf("Chatter with id %v joined the %s chat room", chatter.UserID, chatID))
+	return nil
 }
 
-func (h *Hub) leave(chatter *Chatter) error {
-	h.mux.Lock()
-	defer h.mux.Unlock()
-
-	if len(chatter.Rooms) > 0 {
-		for key := range chatter.Rooms {
-			if room, ok := h.Rooms[key]; ok {
-				if _, ok = room.Chatters[chatter]; ok {
-					delete(h.Rooms[key].Chatters, chatter)
-					logrus.Info(fmt.Sprintf("Chatter with id %v left the %s chat room", chatter.UserID, key))
-					if len(room.Chatters) == 0 {
-						delete(h.Rooms, key)
-					}
-				}
+func (h *Hub) broadcast(message []byte, fn predicate) error {
+
+	if h == nil {
+		log.Panic("receiver is null")
+	}
+
+	recipients := 0
+	h.exec(func() {
+		for k := range h.Chatters {
+			if fn(k) {
+				h.deliver(k, message)
+				recipients++
 			}
 		}
-	}
+	})
 
-	return nil
+	observeFanout("all", recipients)
+	if recipients > 0 {
+		return nil
+	}
+	return ErrNoChatterMatch
 }
 
-func (h *Hub) broadcast(message []byte, fn predicate) error {
+// broadcastRoom рассылает сообщение участникам комнаты chatID, в которой состоит sender
+func (h *Hub) broadcastRoom(sender *Chatter, chatID string, message []byte, fn predicate) error {
 
 	if h == nil {
 		log.Panic("receiver is null")
 	}
 
-	atleastonce := false
-	for k := range h.Chatters {
-		if fn(k) {
-			k.Out <- message
-			atleastonce = true
+	var err error
+	recipients := 0
+	h.exec(func() {
+		room, ok := sender.rooms[chatID]
+		if !ok {
+			err = ErrChatRoomNotFound
+			return
 		}
-	}
 
-	if atleastonce {
+		for k := range room.Chatters {
+			if fn(k) {
+				h.deliver(k, message)
+				recipients++
+			}
+		}
+	})
+
+	if err != nil {
+		return err
+	}
+	observeFanout("room", recipients)
+	if recipients > 0 {
 		return nil
 	}
 	return ErrNoChatterMatch
 }
 
-func (cr *chatRoom) broadcast(message []byte, fn predicate) error {
-	if cr == nil {
+// broadcastToRoom рассылает сообщение всем участникам комнаты chatID, если она существует
+func (h *Hub) broadcastToRoom(chatID string, message []byte, fn predicate) error {
+
+	if h == nil {
 		log.Panic("receiver is null")
 	}
 
-	atleastonce := false
-	for k := range cr.Chatters {
-		if fn(k) {
-			k.Out <- message
-			atleastonce = true
+	recipients := 0
+	h.exec(func() {
+		room, ok := h.Rooms[chatID]
+		if !ok {
+			return
 		}
-	}
 
-	if atleastonce {
+		for k := range room.Chatters {
+			if fn(k) {
+				h.deliver(k, message)
+				recipients++
+			}
+		}
+	})
+
+	observeFanout("room", recipients)
+	if recipients > 0 {
 		return nil
 	}
 	return ErrNoChatterMatch
 }
+
+// deliver ставит сообщение в очередь чаттера, не блокируя хаб.
+// Чаттер, который не успевает разбирать свою очередь, отключается.
+func (h *Hub) deliver(chatter *Chatter, message []byte) {
+	if chatter.send(message) {
+		return
+	}
+
+	logrus.Warn(fmt.Sprintf("The outgoing queue of chatter with id %v is full, disconnecting", chatter.UserID))
+	metrics.OutQueueOverflows.Inc()
+	h.drop(chatter)
+}
+
+// drop удаляет чаттера из всех комнат и из хаба, вызывается только в горутине хаба
+func (h *Hub) drop(chatter *Chatter) {
+	for key, room := range chatter.rooms {
+		if _, ok := room.Chatters[chatter]; ok {
+			delete(room.Chatters, chatter)
+			logrus.Info(fmt.Sprintf("Chatter with id %v left the %s chat room", chatter.UserID, key))
+			if len(room.Chatters) == 0 {
+				delete(h.Rooms, key)
+			}
+		}
+		delete(chatter.rooms, key)
+	}
+
+	delete(h.Chatters, chatter)
+	chatter.close()
+}
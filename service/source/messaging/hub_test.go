@@ -0,0 +1,231 @@
+package messaging
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/dvgavrilov/gochat/service/source/config"
+	"github.com/dvgavrilov/gochat/service/source/models"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	stressChatters = 3000
+	stressRooms    = 30
+	// stressRoomSize участников в каждой комнате
+	stressRoomSize = stressChatters / stressRooms
+	// stressSenders число чаттеров, рассылающих сообщение всем
+	stressSenders = stressChatters / stressRooms
+)
+
+func stressRoom(i int) string {
+	return "room-" + strconv.Itoa(i%stressRooms)
+}
+
+// stressLeaver половина участников каждой комнаты, которая её покидает
+func stressLeaver(i int) bool {
+	return (i/stressRooms)%2 == 0
+}
+
+// parallel вызывает fn для каждого чаттера в отдельной горутине и ждёт завершения всех
+func parallel(chatters []*Chatter, fn func(i int, c *Chatter)) {
+	var wg sync.WaitGroup
+	wg.Add(len(chatters))
+	for i, c := range chatters {
+		go func(i int, c *Chatter) {
+			defer wg.Done()
+			fn(i, c)
+		}(i, c)
+	}
+	wg.Wait()
+}
+
+// newStressHub возвращает хаб и функцию, восстанавливающую настройки после теста
+func newStressHub() (*Hub, func()) {
+	level := logrus.GetLevel()
+	limit := config.MainConfiguration.ChatRoomSettings.MaxValueOfChatters
+	logrus.SetLevel(logrus.WarnLevel)
+	config.MainConfiguration.ChatRoomSettings.MaxValueOfChatters = stressChatters
+
+	return newHub(), func() {
+		logrus.SetLevel(level)
+		config.MainConfiguration.ChatRoomSettings.MaxValueOfChatters = limit
+	}
+}
+
+func TestHubConcurrentMembershipAndDelivery(t *testing.T) {
+	h, restore := newStressHub()
+	defer restore()
+
+	chatters := make([]*Chatter, stressChatters)
+	for i := range chatters {
+		chatters[i] = newChatter(uint(i+1), models.RoleAgent, nil)
+	}
+
+	parallel(chatters, func(i int, c *Chatter) {
+		if err := h.register(c); err != nil {
+			t.Errorf("register %v: %v", c.UserID, err)
+			return
+		}
+		if err := h.join(c, stressRoom(i)); err != nil {
+			t.Errorf("join %v: %v", c.UserID, err)
+		}
+	})
+
+	h.exec(func() {
+		if len(h.Chatters) != stressChatters {
+			t.Errorf("hub has %v chatters, want %v", len(h.Chatters), stressChatters)
+		}
+		if len(h.Rooms) != stressRooms {
+			t.Errorf("hub has %v rooms, want %v", len(h.Rooms), stressRooms)
+		}
+		for key, room := range h.Rooms {
+			if len(room.Chatters) != stressRoomSize {
+				t.Errorf("room %s has %v chatters, want %v", key, len(room.Chatters), stressRoomSize)
+			}
+		}
+	})
+
+	// Каждый получает по сообщению от остальных участников своей комнаты, от каждого из stressSenders
+	// и одно от broadcastToRoom. Всё вместе меньше outQueueSize, поэтому очереди не переполняются.
+	parallel(chatters, func(i int, c *Chatter) {
+		if err := h.broadcastRoom(c, stressRoom(i), []byte("room"), func(o *Chatter) bool { return o != c }); err != nil {
+			t.Errorf("broadcastRoom %v: %v", c.UserID, err)
+		}
+		if i%stressRooms == 0 {
+			if err := h.broadcast([]byte("all"), func(*Chatter) bool { return true }); err != nil {
+				t.Errorf("broadcast %v: %v", c.UserID, err)
+			}
+		}
+		if i < stressRooms {
+			if err := h.broadcastToRoom(stressRoom(i), []byte("notice"), func(*Chatter) bool { return true }); err != nil {
+				t.Errorf("broadcastToRoom %s: %v", stressRoom(i), err)
+			}
+		}
+	})
+
+	want := stressRoomSize - 1 + stressSenders + 1
+	for _, c := range chatters {
+		if got := len(c.Out); got != want {
+			t.Fatalf("chatter %v received %v messages, want %v", c.UserID, got, want)
+		}
+		for len(c.Out) > 0 {
+			<-c.Out
+		}
+	}
+
+	// Половина чаттеров покидает комнаты, пока остальные рассылают по ним сообщения
+	parallel(chatters, func(i int, c *Chatter) {
+		if stressLeaver(i) {
+			if err := h.leave(c, stressRoom(i)); err != nil {
+				t.Errorf("leave %v: %v", c.UserID, err)
+			}
+			return
+		}
+		h.broadcastRoom(c, stressRoom(i), []byte("room"), func(o *Chatter) bool { return o != c })
+	})
+
+	h.exec(func() {
+		for i, c := range chatters {
+			_, member := h.Rooms[stressRoom(i)].Chatters[c]
+			if member == stressLeaver(i) || member != (len(c.rooms) == 1) {
+				t.Errorf("chatter %v membership is %v after leave", c.UserID, member)
+			}
+		}
+		for key, room := range h.Rooms {
+			if len(room.Chatters) != stressRoomSize/2 {
+				t.Errorf("room %s has %v chatters, want %v", key, len(room.Chatters), stressRoomSize/2)
+			}
+		}
+	})
+
+	// Оставшиеся участники получили сообщения друг от друга, ушедшие получили
+	// только то, что было разослано до их ухода
+	for i, c := range chatters {
+		got := len(c.Out)
+		if !stressLeaver(i) && got != stressRoomSize/2-1 {
+			t.Fatalf("chatter %v received %v messages, want %v", c.UserID, got, stressRoomSize/2-1)
+		}
+		if got > stressRoomSize/2 {
+			t.Fatalf("chatter %v received %v messages, want at most %v", c.UserID, got, stressRoomSize/2)
+		}
+	}
+
+	parallel(chatters, func(i int, c *Chatter) {
+		if err := h.unregister(c); err != nil {
+			t.Errorf("unregister %v: %v", c.UserID, err)
+		}
+	})
+
+	h.exec(func() {
+		if len(h.Chatters) != 0 || len(h.Rooms) != 0 {
+			t.Errorf("hub still has %v chatters and %v rooms", len(h.Chatters), len(h.Rooms))
+		}
+	})
+
+	for _, c := range chatters {
+		select {
+		case <-c.done:
+		default:
+			t.Fatalf("chatter %v is not closed after unregister", c.UserID)
+		}
+	}
+}
+
+// TestHubConcurrentChurn смешивает все операции хаба одновременно, проверяя отсутствие гонок
+// и то, что после ухода всех чаттеров в хабе не остаётся ни чаттеров, ни комнат
+func TestHubConcurrentChurn(t *testing.T) {
+	h, restore := newStressHub()
+	defer restore()
+
+	chatters := make([]*Chatter, stressChatters)
+	for i := range chatters {
+		chatters[i] = newChatter(uint(i+1), models.RoleAgent, nil)
+	}
+
+	var received sync.WaitGroup
+	received.Add(len(chatters))
+	for _, c := range chatters {
+		go func(c *Chatter) {
+			defer received.Done()
+			for {
+				select {
+				case <-c.Out:
+				case <-c.done:
+					return
+				}
+			}
+		}(c)
+	}
+
+	parallel(chatters, func(i int, c *Chatter) {
+		if err := h.register(c); err != nil {
+			t.Errorf("register %v: %v", c.UserID, err)
+			return
+		}
+
+		room := stressRoom(i)
+		other := stressRoom(i + 1)
+		h.join(c, room)
+		h.join(c, other)
+		h.broadcastRoom(c, room, []byte("room"), func(o *Chatter) bool { return o != c })
+		h.leave(c, other)
+		h.broadcastToRoom(other, []byte("notice"), func(*Chatter) bool { return true })
+		if i%stressRooms == 0 {
+			h.broadcast([]byte("all"), func(o *Chatter) bool { return o.UserID%2 == 0 })
+		}
+
+		if err := h.unregister(c); err != nil {
+			t.Errorf("unregister %v: %v", c.UserID, err)
+		}
+	})
+
+	received.Wait()
+
+	h.exec(func() {
+		if len(h.Chatters) != 0 || len(h.Rooms) != 0 {
+			t.Errorf("hub still has %v chatters and %v rooms", len(h.Chatters), len(h.Rooms))
+		}
+	})
+}
@@ -0,0 +1,132 @@
+package messaging
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+)
+
+var (
+	// ErrJWKSEmpty error
+	ErrJWKSEmpty = errors.New("no signing keys for the configured algorithm were found")
+)
+
+// jwk ключ в формате RFC 7517, поддерживаются типы RSA, EC (P-256) и oct
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	// oct
+	K string `json:"k"`
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+// readJWKS читает локальный JWKS файл и возвращает ключи для алгоритма algorithm, сгруппированные по kid
+func readJWKS(path string, algorithm string) (map[string]interface{}, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	set := &jwks{}
+	err = json.Unmarshal(raw, set)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(map[string]interface{})
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		if k.Alg != "" && k.Alg != algorithm {
+			continue
+		}
+
+		key, err := k.publicKey(algorithm)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %v", k.Kid, err)
+		}
+
+		if key == nil {
+			continue
+		}
+
+		ret[k.Kid] = key
+	}
+
+	if len(ret) == 0 {
+		return nil, ErrJWKSEmpty
+	}
+
+	return ret, nil
+}
+
+// publicKey возвращает ключ проверки подписи или nil, если тип ключа не подходит алгоритму
+func (k jwk) publicKey(algorithm string) (interface{}, error) {
+	switch {
+	case k.Kty == "RSA" && algorithm == "RS256":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case k.Kty == "EC" && algorithm == "ES256":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("curve %q is not supported", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		curve := elliptic.P256()
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the P-256 curve")
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case k.Kty == "oct" && algorithm == "HS256":
+		return base64.RawURLEncoding.DecodeString(k.K)
+	}
+
+	return nil, nil
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(raw), nil
+}
@@ -1,22 +1,154 @@
 package messaging
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	"strings"
+	"sync/atomic"
 
-	"github.com/sirupsen/logrus"
-
+	"github.com/dgrijalva/jwt-go"
+	"github.com/dvgavrilov/gochat/service/source/config"
 	"github.com/go-chi/jwtauth"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
 )
 
 const (
 	// SecWebSocketProtocol const
 	SecWebSocketProtocol = "Sec-WebSocket-Protocol"
+
+	bearerPrefix = "bearer "
+)
+
+var (
+	// ErrTokenAlgorithm error
+	ErrTokenAlgorithm = errors.New("token is signed with an unexpected algorithm")
+	// ErrTokenKidMissing error
+	ErrTokenKidMissing = errors.New("token has no kid header and several keys are active")
+	// ErrTokenUnknownKid error
+	ErrTokenUnknownKid = errors.New("token is signed with an unknown key")
+	// ErrTokenExpMissing error
+	ErrTokenExpMissing = errors.New("token has no exp claim")
+	// ErrTokenIssuer error
+	ErrTokenIssuer = errors.New("token issuer is not accepted")
+	// ErrTokenAudience error
+	ErrTokenAudience = errors.New("token audience is not accepted")
 )
 
-var jwtSecret = []byte("!!SECRET!!")
 var tokenStart = "access_token"
 
+// keySet набор активных ключей проверки подписи, выбираемых по kid
+type keySet struct {
+	settings config.JWTSettings
+	keys     map[string]interface{}
+}
+
+var activeKeys atomic.Value
+
+// ReloadKeys загружает алгоритм, ключи и требования к claims из текущей конфигурации.
+// Используется при старте и при перезагрузке конфигурации для ротации ключей.
+func ReloadKeys() error {
+	settings := config.Current().JWTSettings
+
+	keys := make(map[string]interface{})
+	if settings.JWKSFile != "" {
+		var err error
+		keys, err = readJWKS(settings.JWKSFile, settings.Algorithm)
+		if err != nil {
+			return err
+		}
+	}
+
+	if settings.Secret != "" && settings.Algorithm == "HS256" {
+		keys[""] = []byte(settings.Secret)
+	}
+
+	if len(keys) == 0 {
+		return ErrJWKSEmpty
+	}
+
+	activeKeys.Store(&keySet{settings: settings, keys: keys})
+
+	logrus.Info(fmt.Sprintf("JWT verification uses %s with %v active keys", settings.Algorithm, len(keys)))
+	return nil
+}
+
+func currentKeySet() *keySet {
+	ks, _ := activeKeys.Load().(*keySet)
+	return ks
+}
+
+func (ks *keySet) keyFunc(token *jwt.Token) (interface{}, error) {
+	if token.Method.Alg() != ks.settings.Algorithm {
+		return nil, ErrTokenAlgorithm
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	if key, ok := ks.keys[kid]; ok {
+		return key, nil
+	}
+
+	if kid != "" {
+		return nil, ErrTokenUnknownKid
+	}
+
+	if len(ks.keys) != 1 {
+		return nil, ErrTokenKidMissing
+	}
+
+	for _, key := range ks.keys {
+		return key, nil
+	}
+
+	return nil, ErrTokenUnknownKid
+}
+
+// parse проверяет подпись и claims токена. exp и nbf проверяются библиотекой,
+// наличие exp, а также iss и aud проверяются здесь.
+func (ks *keySet) parse(raw string) (*jwt.Token, error) {
+	parser := &jwt.Parser{ValidMethods: []string{ks.settings.Algorithm}}
+	token, err := parser.Parse(raw, ks.keyFunc)
+	if err != nil {
+		return token, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return token, ErrTokenBadStructure
+	}
+
+	if _, ok := claims["exp"]; !ok {
+		return token, ErrTokenExpMissing
+	}
+
+	if ks.settings.Issuer != "" && !claims.VerifyIssuer(ks.settings.Issuer, true) {
+		return token, ErrTokenIssuer
+	}
+
+	if ks.settings.Audience != "" && !hasAudience(claims, ks.settings.Audience) {
+		return token, ErrTokenAudience
+	}
+
+	return token, nil
+}
+
+// hasAudience поддерживает aud как в виде строки, так и в виде массива строк
+func hasAudience(claims jwt.MapClaims, audience string) bool {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
 func tokenFromWsRequest(r *http.Request) string {
 	// there is no way to send authorization header,
 	// so, we decided to use the Sec-WebSocket-Protocol header
@@ -32,16 +164,44 @@ func tokenFromWsRequest(r *http.Request) string {
 	return strings.TrimSpace(values[1])
 }
 
+// tokenFromRequest берёт токен из Sec-WebSocket-Protocol, а для обычных HTTP запросов
+// (админка, отчёты, аудит) также из заголовка Authorization: Bearer
+func tokenFromRequest(r *http.Request) string {
+	if raw := tokenFromWsRequest(r); raw != "" || websocket.IsWebSocketUpgrade(r) {
+		return raw
+	}
+
+	header := r.Header.Get("Authorization")
+	if len(header) <= len(bearerPrefix) || strings.ToLower(header[:len(bearerPrefix)]) != bearerPrefix {
+		return ""
+	}
+
+	return strings.TrimSpace(header[len(bearerPrefix):])
+}
+
 func getUpgraderWebSocketHeader() http.Header {
 	h := make(http.Header)
 	h.Add(SecWebSocketProtocol, tokenStart)
 	return h
 }
 
-func verifier(ja *jwtauth.JWTAuth) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return jwtauth.Verify(ja, tokenFromWsRequest)(next)
-	}
+// verifier проверяет токен активным набором ключей и кладёт результат в контекст,
+// откуда его читают authorize и jwtauth.FromContext
+func verifier(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw := tokenFromRequest(r)
+
+		var token *jwt.Token
+		var err error
+		if raw == "" {
+			err = jwtauth.ErrUnauthorized
+		} else {
+			token, err = currentKeySet().parse(raw)
+		}
+
+		ctx := jwtauth.NewContext(r.Context(), token, err)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
 }
 
 func authorize(next http.Handler) http.Handler {
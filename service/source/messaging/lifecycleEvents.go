@@ -0,0 +1,130 @@
+package messaging
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/dvgavrilov/gochat/service/source/audit"
+	"github.com/dvgavrilov/gochat/service/source/models"
+	"github.com/dvgavrilov/gochat/service/source/persistence"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrStatusTransition error
+	ErrStatusTransition = errors.New("conversation can not be moved to the requested status")
+	// ErrStatusInvalid error
+	ErrStatusInvalid = errors.New("unknown conversation status")
+	// ErrUpdateConversation error
+	ErrUpdateConversation = errors.New("error while updating a conversation")
+)
+
+const (
+	// ResolveConversationEvent const
+	ResolveConversationEvent = "Event.ResolveConversation"
+	// ReopenConversationEvent const
+	ReopenConversationEvent = "Event.ReopenConversation"
+	// ConversationStatusChangedEvent const
+	ConversationStatusChangedEvent = "Event.ConversationStatusChanged"
+)
+
+type conversationStatusEventArgs struct {
+	SessionChannel string `json:"session_channel"`
+}
+
+func onResolveConversation(e *Event, c *Chatter) (*EventResult, error) {
+	return onChangeConversationStatus(e, c, models.ConversationResolved)
+}
+
+func onReopenConversation(e *Event, c *Chatter) (*EventResult, error) {
+	return onChangeConversationStatus(e, c, models.ConversationOpen)
+}
+
+func onChangeConversationStatus(e *Event, c *Chatter, status string) (*EventResult, error) {
+	args := &conversationStatusEventArgs{}
+	err := convertFromRaw([]byte(reflect.ValueOf(e.Args).String()), args)
+	if err != nil {
+		logrus.Error(err)
+		return e.getErrorResponse(ErrMarschalingMessage), nil
+	}
+
+	sc, err := ParseSessionChannel(args.SessionChannel)
+	if err != nil {
+		logrus.Error(err)
+		return e.getErrorResponse(err), nil
+	}
+
+	logrus.Info(fmt.Sprintf("Received a new %v event with following parameters: SessionChannel:%s", e.Name, sc.ToString()))
+
+	conversation, err := loadConversation(c, e.Name, sc)
+	if err != nil {
+		return e.getErrorResponse(err), nil
+	}
+
+	from := conversationStatus(conversation)
+	err = changeConversationStatus(conversation, status)
+	if err != nil {
+		return e.getErrorResponse(err), nil
+	}
+
+	audit.Record(c.actor(), audit.ConversationStatus, audit.TargetConversation, conversation.ID,
+		map[string]interface{}{"from": from, "to": status})
+
+	return &EventResult{
+		Name:   (*e).Name,
+		Ok:     true,
+		Result: convertConversation(conversation),
+	}, nil
+}
+
+// changeConversationStatus проверяет допустимость перехода, сохраняет новое состояние
+// и сообщает о нём участникам комнаты беседы
+func changeConversationStatus(conv *models.Conversation, status string) error {
+	from := conversationStatus(conv)
+	if from == status {
+		return nil
+	}
+
+	if !models.CanTransition(from, status) {
+		return ErrStatusTransition
+	}
+
+	err := persistence.GetConversationsProvider().SetStatus(conv.ID, status)
+	if err != nil {
+		logrus.Error(err)
+		return ErrUpdateConversation
+	}
+
+	conv.Status = status
+	logrus.Info(fmt.Sprintf("Conversation %v moved from %s to %s", conv.ID, from, status))
+
+	if status == models.ConversationResolved {
+		recordResolution(conv)
+	}
+
+	raw, err := json.Marshal(&EventResult{
+		Name:   ConversationStatusChangedEvent,
+		Ok:     true,
+		Result: convertConversation(conv),
+	})
+	if err != nil {
+		logrus.Error(err)
+		return nil
+	}
+
+	hub.broadcastToRoom(SessionChannel{ApplicationID: conv.ApplicationID}.ToString(), raw,
+		func(toCheck *Chatter) bool { return true })
+
+	return nil
+}
+
+// conversationStatus считает беседы без состояния, созданные до его появления, открытыми
+func conversationStatus(conv *models.Conversation) string {
+	if conv.Status == "" {
+		return models.ConversationOpen
+	}
+
+	return conv.Status
+}
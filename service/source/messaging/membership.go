@@ -0,0 +1,105 @@
+package messaging
+
+import (
+	"errors"
+
+	"github.com/dvgavrilov/gochat/service/source/audit"
+	"github.com/dvgavrilov/gochat/service/source/config"
+	"github.com/dvgavrilov/gochat/service/source/models"
+	"github.com/dvgavrilov/gochat/service/source/persistence"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrNotConversationMember error
+	ErrNotConversationMember = errors.New("you are not a participant of this conversation")
+)
+
+// loadConversation находит беседу по сессионному каналу и проверяет, что чаттер может
+// выполнить в ней действие action. Все события, работающие с беседой, проходят через неё.
+func loadConversation(c *Chatter, action string, sc *SessionChannel) (*models.Conversation, error) {
+	conv, err := getConversation(sc)
+	if err != nil {
+		logrus.Error(err)
+		return nil, ErrGettingConversation
+	}
+
+	if conv == nil {
+		return nil, ErrConversationNotFound
+	}
+
+	err = authorizeConversation(c, action, conv)
+	if err != nil {
+		return nil, err
+	}
+
+	return conv, nil
+}
+
+// authorizeConversation пропускает участников беседы, а также роли, которым
+// MembershipSettings.Overrides разрешает действие action без участия в беседе
+func authorizeConversation(c *Chatter, action string, conv *models.Conversation) error {
+	member, err := isParticipant(conv.ID, c.UserID)
+	if err != nil {
+		logrus.Error(err)
+		return ErrGettingConversation
+	}
+
+	if member || canOverrideMembership(c.Role, action) {
+		return nil
+	}
+
+	auditMembershipDenial(c, action, conv)
+	return ErrNotConversationMember
+}
+
+// isParticipant читает участников из базы, а не из conv.Participants, который может быть взят из кэша
+func isParticipant(conversationID uint, userID uint) (bool, error) {
+	participants, err := persistence.GetParticipantsProvider().GetByConversationID(conversationID)
+	if err != nil {
+		return false, err
+	}
+
+	for _, p := range *participants {
+		if p.UserID == userID {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func canOverrideMembership(role string, action string) bool {
+	for _, a := range config.Current().MembershipSettings.Overrides[role] {
+		if a == action {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasApplication проверяет, что приложение указано в токене чаттера
+func (c *Chatter) hasApplication(applicationID uint) bool {
+	for _, id := range c.applications {
+		if id == applicationID {
+			return true
+		}
+	}
+
+	return false
+}
+
+func auditMembershipDenial(c *Chatter, action string, conv *models.Conversation) {
+	logrus.WithFields(logrus.Fields{
+		"audit":           "membership_denied",
+		"actor_id":        c.UserID,
+		"actor_role":      c.Role,
+		"action":          action,
+		"conversation_id": conv.ID,
+		"application_id":  conv.ApplicationID,
+	}).Warn("conversation access denied")
+
+	audit.Record(c.actor(), audit.MembershipDenied, audit.TargetConversation, conv.ID,
+		map[string]interface{}{"action": action})
+}
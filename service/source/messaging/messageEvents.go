@@ -6,8 +6,11 @@ import (
 	"fmt"
 
 	"reflect"
+	"strings"
 	"time"
 
+	"github.com/dvgavrilov/gochat/service/source/audit"
+	"github.com/dvgavrilov/gochat/service/source/filters"
 	"github.com/dvgavrilov/gochat/service/source/models"
 	"github.com/dvgavrilov/gochat/service/source/persistence"
 	"github.com/sirupsen/logrus"
@@ -36,6 +39,10 @@ var (
 	ErrUpdateMessage = errors.New("error while updating a message")
 	// ErrChatRoomNotFound error
 	ErrChatRoomNotFound = errors.New("error finding a chat room, you shoud join first")
+	// ErrMessageNotFound error
+	ErrMessageNotFound = errors.New("message not found")
+	// ErrMessageRejected error
+	ErrMessageRejected = errors.New("message was rejected by the content filter")
 )
 
 const (
@@ -51,11 +58,15 @@ const (
 	GetUnreadInfoEvent = "Event.GetUnreadInfo"
 	// GetUnreadMessagesEvent const
 	GetUnreadMessagesEvent = "Event.GetUnreadMessages"
+
+	// sendInternalNoteAction действие, позволяющее оставлять в беседе внутренние заметки
+	sendInternalNoteAction = "Action.SendInternalNote"
+	// readInternalNotesAction действие, позволяющее видеть внутренние заметки
+	readInternalNotesAction = "Action.ReadInternalNotes"
 )
 
 type getMessageListEventArgs struct {
 	SessionChannel string `json:"session_channel"`
-	ExecutorID     uint   `json:"executor_id"`
 }
 
 type getMessageListEventResult struct {
@@ -66,7 +77,7 @@ type sendMessageEventArgs struct {
 	SessionChannel string `json:"session_channel"`
 	Content        string `json:"content"`
 	ContentType    uint   `json:"content_type"` // 1 or 2. 1 is a text, and 2 is an image. If no content type, we treat it as text.
-	SenderID       uint   `json:"sender_id"`
+	Internal       bool   `json:"internal"`     // internal note, visible to moderators only
 }
 
 type sendMessageEventResult struct {
@@ -78,8 +89,7 @@ type receiveMessageEventResult struct {
 }
 
 type readMessageEventArgs struct {
-	ExecutorID uint `json:"executor_id"`
-	MessageID  uint `json:"message_id"`
+	MessageID uint `json:"message_id"`
 }
 
 type readMessageEventResult struct {
@@ -93,45 +103,25 @@ type message struct {
 	Content        string    `json:"content"`
 	ContentType    uint      `json:"content_type"`
 	SenderID       uint      `json:"sender_id"`
+	Internal       bool      `json:"internal"`
+	FilterAction   string    `json:"filter_action,omitempty"`
+	FilterReasons  string    `json:"filter_reasons,omitempty"`
 	Read           bool      `json:"read"`
 	CreatedAt      time.Time `json:"create_at"`
 	UpdateAt       time.Time `json:"update_at"`
 }
 
-type getUnreadInfoArgs struct {
-	UserID uint `json:"user_id"`
-}
-
 type getUnreadInfoResult struct {
 	UserID      uint `json:"user_id"`
 	UnreadCount int  `json:"unread_count"`
 }
 
-type getUnreadMessagesEventArgs struct {
-	ExecutorID uint `json:"executor_id"`
-}
-
 type getUnreadMessagesEventResult struct {
 	Messages []*message
 }
 
 func onGetUnreadMessagesList(e *Event, c *Chatter) (*EventResult, error) {
-	if !c.IsModerator {
-		return e.getErrorResponse(ErrUnauthorized), nil
-	}
-
-	args := &getUnreadMessagesEventArgs{}
-	err := convertFromRaw([]byte(reflect.ValueOf(e.Args).String()), args)
-	if err != nil {
-		logrus.Error(err)
-		return e.getErrorResponse(ErrMarschalingMessage), nil
-	}
-
-	if args.ExecutorID != c.UserID {
-		return e.getErrorResponse(ErrUnauthorized), nil
-	}
-
-	messages, err := persistence.GetMessagesProvider().GetUnreadMessages(c.UserID)
+	messages, err := persistence.GetMessagesProvider().GetUnreadMessages(c.UserID, canReadInternalNotes(c))
 	if err != nil {
 		logrus.Error(err)
 		return e.getErrorResponse(ErrReadMessages), nil
@@ -162,16 +152,12 @@ func onGetMessageList(e *Event, c *Chatter) (*EventResult, error) {
 
 	logrus.Info(fmt.Sprintf("Received a new %v event with following parameters: SessionChannel:%s", e.Name, sc.ToString()))
 
-	if args.ExecutorID != c.UserID {
-		return e.getErrorResponse(ErrUnauthorized), nil
-	}
-
-	conversation, err := getConversation(sc)
+	conversation, err := loadConversation(c, e.Name, sc)
 	if err != nil {
-		return e.getErrorResponse(ErrConversationNotFound), nil
+		return e.getErrorResponse(err), nil
 	}
 
-	messages, err := persistence.GetMessagesProvider().GetMessages(conversation.ID)
+	messages, err := persistence.GetMessagesProvider().GetMessages(conversation.ID, canReadInternalNotes(c))
 	if err != nil {
 		logrus.Error(err)
 		return nil, ErrGetMessages
@@ -181,6 +167,11 @@ func onGetMessageList(e *Event, c *Chatter) (*EventResult, error) {
 		(*messages)[i].Read = isMessageRead(&((*messages)[i]), c.UserID)
 	}
 
+	if !c.IsCustomer {
+		audit.Record(c.actor(), audit.ConversationRead, audit.TargetConversation, conversation.ID,
+			map[string]interface{}{"session_channel": sc.ToString(), "messages": len(*messages)})
+	}
+
 	return &EventResult{
 		Name: (*e).Name,
 		Ok:   true,
@@ -198,10 +189,6 @@ func onSendMessage(e *Event, c *Chatter) (*EventResult, error) {
 		return e.getErrorResponse(ErrMarschalingMessage), nil
 	}
 
-	if c.UserID != args.SenderID {
-		return e.getErrorResponse(ErrUnauthorized), nil
-	}
-
 	sc, err := ParseSessionChannel(args.SessionChannel)
 	if err != nil {
 		logrus.Error(err)
@@ -210,18 +197,19 @@ func onSendMessage(e *Event, c *Chatter) (*EventResult, error) {
 
 	logrus.Info(fmt.Sprintf("Received a new %v event with following parameters: SessionChannel:%s", e.Name, sc.ToString()))
 
-	conversation, err := getConversation(sc)
-	if err != nil {
-		return e.getErrorResponse(ErrConversationNotFound), nil
+	if args.Internal && !IsAllowed(c.Role, sendInternalNoteAction) {
+		return e.getErrorResponse(ErrForbidden), nil
 	}
 
-	if conversation == nil {
-		return e.getErrorResponse(ErrConversationNotFound), nil
+	conversation, err := loadConversation(c, e.Name, sc)
+	if err != nil {
+		return e.getErrorResponse(err), nil
 	}
 
 	msg := &models.Message{
-		SenderID:       args.SenderID,
+		SenderID:       c.UserID,
 		Content:        args.Content,
+		Internal:       args.Internal,
 		ConversationID: conversation.ID,
 		ApplicationID:  conversation.ApplicationID,
 		CreatedAt:      time.Now().UTC(),
@@ -234,14 +222,41 @@ func onSendMessage(e *Event, c *Chatter) (*EventResult, error) {
 		msg.ContentType = args.ContentType
 	}
 
+	// фильтры проверяют только текст, у изображения в Content ссылка на вложение
+	if msg.ContentType == models.ContentText {
+		decision := filters.Apply(conversation.ApplicationID, c.Role, msg.Content)
+		if decision.Rejected() {
+			logrus.Warn(fmt.Sprintf("message of user %v to %s was rejected by content filters %v", c.UserID, sc.ToString(), decision.Reasons))
+			return e.getErrorResponse(ErrMessageRejected), nil
+		}
+
+		msg.Content = decision.Content
+		msg.FilterAction = decision.Action
+		msg.FilterReasons = strings.Join(decision.Reasons, ",")
+	}
+
 	msg, err = persistence.GetMessagesProvider().AddMessage(msg)
 	if err != nil {
 		logrus.Error(err)
 		return nil, ErrAddMessage
 	}
 
+	// клиент написал снова - беседа открывается, модератор ответил - беседа ждёт клиента.
+	// Внутренняя заметка ответом не считается.
+	if c.IsCustomer {
+		err = changeConversationStatus(conversation, models.ConversationOpen)
+	} else if c.IsModerator && !msg.Internal && conversationStatus(conversation) == models.ConversationOpen {
+		err = changeConversationStatus(conversation, models.ConversationPending)
+	}
+	if err != nil {
+		logrus.Error(err)
+	}
+
+	recordMessageStats(conversation, msg, c)
+
 	// A message was added, now, we need to add an unread information, so,
-	// all participants will be able to mark that the message was read by him
+	// all participants will be able to mark that the message was read by him.
+	// Internal notes are filtered out of customer lists and counts when read
 	if len(conversation.Participants) > 0 {
 		for _, p := range conversation.Participants {
 			if p.UserID == msg.SenderID {
@@ -268,23 +283,19 @@ func onSendMessage(e *Event, c *Chatter) (*EventResult, error) {
 	}
 
 	key := fmt.Sprintf("%v", sc.ApplicationID)
-	if room, ok := c.Rooms[key]; ok {
-		err = room.broadcast(
-			raw,
-			func(toCheck *Chatter) bool { return c != toCheck })
-
-		if err == ErrNoChatterMatch {
-			err = hub.broadcast(raw,
-				func(toCheck *Chatter) bool {
-					return c != toCheck && toCheck.IsModerator
-				})
-
-			insertUnreadInfoGlobal(msg)
-		}
-	} else {
+	err = hub.broadcastRoom(c, key,
+		raw,
+		func(toCheck *Chatter) bool { return c != toCheck && (!msg.Internal || canReadInternalNotes(toCheck)) })
+
+	if err == ErrChatRoomNotFound {
 		return e.getErrorResponse(ErrChatRoomNotFound), nil
 	}
 
+	// в комнате никого нет, сообщение клиента получает только ответственный модератор
+	if err == ErrNoChatterMatch && c.IsCustomer && !msg.Internal {
+		deliverToAssignee(conversation, msg, raw)
+	}
+
 	return &EventResult{
 		Name: (*e).Name,
 		Ok:   true,
@@ -305,8 +316,24 @@ func onReadMessage(e *Event, c *Chatter) (*EventResult, error) {
 
 	logrus.Info(fmt.Sprintf("Received a new %v event", e.Name))
 
-	if c.UserID != args.ExecutorID {
-		return e.getErrorResponse(ErrUnauthorized), nil
+	msg, err := persistence.GetMessagesProvider().GetMessage(args.MessageID)
+	if err != nil {
+		logrus.Error(err)
+		return e.getErrorResponse(ErrGetMessage), nil
+	}
+
+	// о внутренних заметках тем, кто не может их читать, ничего не сообщается
+	if msg == nil || (msg.Internal && !canReadInternalNotes(c)) {
+		return e.getErrorResponse(ErrMessageNotFound), nil
+	}
+
+	// отметка о прочтении, в том числе общая отметка модераторов, ставится только в доступной беседе
+	_, err = loadConversation(c, e.Name, &SessionChannel{ApplicationID: msg.ApplicationID})
+	if err == ErrNotConversationMember {
+		return e.getErrorResponse(ErrForbidden), nil
+	}
+	if err != nil {
+		return e.getErrorResponse(err), nil
 	}
 
 	if c.IsModerator {
@@ -314,6 +341,8 @@ func onReadMessage(e *Event, c *Chatter) (*EventResult, error) {
 		if err != nil {
 			return e.getErrorResponse(ErrUpdateMessage), nil
 		}
+
+		audit.Record(c.actor(), audit.UnreadGlobalMarkedRead, audit.TargetMessage, args.MessageID, nil)
 	}
 
 	err = persistence.GetUnreadInfoManager().MarkAsRead(args.MessageID, c.UserID)
@@ -325,7 +354,7 @@ func onReadMessage(e *Event, c *Chatter) (*EventResult, error) {
 		Name: (*e).Name,
 		Ok:   true,
 		Result: readMessageEventResult{
-			ExecutorID: args.ExecutorID,
+			ExecutorID: c.UserID,
 			MessageID:  args.MessageID,
 		},
 	}, nil
@@ -333,25 +362,15 @@ func onReadMessage(e *Event, c *Chatter) (*EventResult, error) {
 
 func onGetUnreadInfo(e *Event, c *Chatter) (*EventResult, error) {
 
-	args := &getUnreadInfoArgs{}
-	err := convertFromRaw([]byte(reflect.ValueOf(e.Args).String()), args)
-	if err != nil {
-		logrus.Error(err)
-		return e.getErrorResponse(ErrMarschalingMessage), nil
-	}
-
-	if c.UserID != args.UserID {
-		return e.getErrorResponse(ErrUnauthorized), nil
-	}
-
-	logrus.Info(fmt.Sprintf("Received a new %v event with following parameters: UserID:%v", e.Name, args.UserID))
+	logrus.Info(fmt.Sprintf("Received a new %v event with following parameters: UserID:%v", e.Name, c.UserID))
 
 	var count int
+	var err error
 	if c.IsModerator {
-		count, err = persistence.GetUnreadInfoManager().GetForUserAndGlobal(args.UserID)
+		count, err = persistence.GetUnreadInfoManager().GetForUserAndGlobal(c.UserID)
 
 	} else {
-		count, err = persistence.GetUnreadInfoManager().GetForUser(args.UserID)
+		count, err = persistence.GetUnreadInfoManager().GetForUser(c.UserID, canReadInternalNotes(c))
 	}
 
 	if err != nil {
@@ -362,7 +381,7 @@ func onGetUnreadInfo(e *Event, c *Chatter) (*EventResult, error) {
 		Name: (*e).Name,
 		Ok:   true,
 		Result: getUnreadInfoResult{
-			UserID:      args.UserID,
+			UserID:      c.UserID,
 			UnreadCount: count,
 		},
 	}, nil
@@ -385,19 +404,51 @@ func convertMessages(messages *[]models.Message) []*message {
 
 func convertMessage(model *models.Message) *message {
 	return &message{
-		ID:          model.ID,
-		SenderID:    model.SenderID,
-		Content:     model.Content,
-		ContentType: model.ContentType,
-		Read:        model.Read,
-		CreatedAt:   model.CreatedAt,
-		UpdateAt:    model.UpdatedAt,
+		ID:            model.ID,
+		SenderID:      model.SenderID,
+		Internal:      model.Internal,
+		Content:       model.Content,
+		FilterAction:  model.FilterAction,
+		FilterReasons: model.FilterReasons,
+		ContentType:   model.ContentType,
+		Read:          model.Read,
+		CreatedAt:     model.CreatedAt,
+		UpdateAt:      model.UpdatedAt,
 		SessionChannel: SessionChannel{
 			ApplicationID: model.ApplicationID,
 		}.ToString(),
 	}
 }
 
+// deliverToAssignee отправляет сообщение ответственному за беседу модератору, назначая его при необходимости.
+// Пока беседа ждёт в очереди, сообщение помечается непрочитанным для всех модераторов.
+func deliverToAssignee(conv *models.Conversation, msg *models.Message, raw []byte) {
+	assignee, err := routing.route(conv)
+	if err != nil {
+		if err != ErrNoModeratorAvailable {
+			logrus.Error(err)
+		}
+
+		insertUnreadInfoGlobal(msg)
+		return
+	}
+
+	hub.sendToUser(assignee, raw)
+
+	for _, p := range conv.Participants {
+		if p.UserID == assignee {
+			return
+		}
+	}
+
+	insertUnreadInfo(msg, assignee)
+}
+
+// canReadInternalNotes решает по роли, получает ли чаттер внутренние заметки
+func canReadInternalNotes(c *Chatter) bool {
+	return IsAllowed(c.Role, readInternalNotesAction)
+}
+
 func insertUnreadInfoGlobal(msg *models.Message) error {
 	uinfo := &models.UnreadInfo{
 		MessageID:      msg.ID,
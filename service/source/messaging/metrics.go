@@ -0,0 +1,78 @@
+package messaging
+
+import (
+	"github.com/dvgavrilov/gochat/service/source/metrics"
+	"github.com/dvgavrilov/gochat/service/source/models"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	connectedChattersDesc = prometheus.NewDesc("gochat_connected_chatters",
+		"Connected chatters by role.", []string{"role"}, nil)
+	chatRoomsDesc = prometheus.NewDesc("gochat_chat_rooms",
+		"Active chat rooms.", nil, nil)
+	chatRoomSizeDesc = prometheus.NewDesc("gochat_chat_room_size",
+		"Number of chatters in active chat rooms.", nil, nil)
+	outQueueLengthDesc = prometheus.NewDesc("gochat_out_queue_length",
+		"Messages waiting in Out queues of connected chatters.", nil, nil)
+)
+
+var chatRoomSizeBuckets = []float64{1, 2, 3, 5, 10, 20, 50, 100}
+
+// hubCollector снимает состояние хаба в момент запроса метрик
+type hubCollector struct{}
+
+func (c hubCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- connectedChattersDesc
+	ch <- chatRoomsDesc
+	ch <- chatRoomSizeDesc
+	ch <- outQueueLengthDesc
+}
+
+func (c hubCollector) Collect(ch chan<- prometheus.Metric) {
+	byRole := make(map[string]int)
+	for _, r := range models.Roles {
+		byRole[r] = 0
+	}
+
+	sizes := make([]int, 0)
+	queued := 0
+	if hub == nil {
+		return
+	}
+
+	hub.exec(func() {
+		for chatter := range hub.Chatters {
+			byRole[chatter.Role]++
+			queued += len(chatter.Out)
+		}
+
+		for _, room := range hub.Rooms {
+			sizes = append(sizes, len(room.Chatters))
+		}
+	})
+
+	for role, count := range byRole {
+		ch <- prometheus.MustNewConstMetric(connectedChattersDesc, prometheus.GaugeValue, float64(count), role)
+	}
+
+	ch <- prometheus.MustNewConstMetric(chatRoomsDesc, prometheus.GaugeValue, float64(len(sizes)))
+	ch <- prometheus.MustNewConstMetric(outQueueLengthDesc, prometheus.GaugeValue, float64(queued))
+
+	buckets := make(map[float64]uint64)
+	sum := 0
+	for _, size := range sizes {
+		sum += size
+		for _, b := range chatRoomSizeBuckets {
+			if float64(size) <= b {
+				buckets[b]++
+			}
+		}
+	}
+
+	ch <- prometheus.MustNewConstHistogram(chatRoomSizeDesc, uint64(len(sizes)), float64(sum), buckets)
+}
+
+func observeFanout(kind string, recipients int) {
+	metrics.BroadcastFanout.WithLabelValues(kind).Observe(float64(recipients))
+}
@@ -0,0 +1,94 @@
+package messaging
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/dvgavrilov/gochat/service/source/config"
+	"github.com/dvgavrilov/gochat/service/source/models"
+)
+
+var (
+	// ErrRoleMissing error
+	ErrRoleMissing = errors.New("token does not define a role")
+	// ErrRoleUnknown error
+	ErrRoleUnknown = errors.New("token role is unknown")
+	// ErrForbidden error
+	ErrForbidden = errors.New("your role is not allowed to perform this action")
+)
+
+// RoleFromClaims возвращает роль пользователя из claim, заданного RoleClaim.
+// Для старых токенов без роли request_id означает customer, а admin_id означает agent.
+func RoleFromClaims(claims jwt.MapClaims) (string, error) {
+	name := config.Current().JWTSettings.RoleClaim
+	if name == "" {
+		name = "role"
+	}
+
+	if value, ok := claims[name]; ok {
+		role, _ := value.(string)
+		for _, r := range models.Roles {
+			if r == role {
+				return role, nil
+			}
+		}
+
+		return "", ErrRoleUnknown
+	}
+
+	_, iscustomer := claims[requestID]
+	_, isadmin := claims[adminID]
+
+	switch {
+	case iscustomer && isadmin:
+		return "", ErrTokenBadStructure
+	case iscustomer:
+		return models.RoleCustomer, nil
+	case isadmin:
+		return models.RoleAgent, nil
+	}
+
+	return "", ErrRoleMissing
+}
+
+// applicationsFromClaims возвращает приложения из claim, заданного ApplicationClaim.
+// Claim может содержать один идентификатор или список, числами или строками
+func applicationsFromClaims(claims jwt.MapClaims) []uint {
+	name := config.Current().JWTSettings.ApplicationClaim
+	if name == "" {
+		name = "application_id"
+	}
+
+	values, ok := claims[name].([]interface{})
+	if !ok {
+		values = []interface{}{claims[name]}
+	}
+
+	ret := make([]uint, 0, len(values))
+	for _, v := range values {
+		switch id := v.(type) {
+		case float64:
+			if id > 0 && id == float64(uint32(id)) {
+				ret = append(ret, uint(id))
+			}
+		case string:
+			if n, err := strconv.ParseUint(id, 10, 32); err == nil && n > 0 {
+				ret = append(ret, uint(n))
+			}
+		}
+	}
+
+	return ret
+}
+
+// IsAllowed проверяет по матрице PermissionSettings, разрешено ли роли событие или действие action
+func IsAllowed(role string, action string) bool {
+	for _, r := range config.Current().PermissionSettings.Events[action] {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,381 @@
+package messaging
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/dvgavrilov/gochat/service/source/config"
+	"github.com/dvgavrilov/gochat/service/source/models"
+	"github.com/dvgavrilov/gochat/service/source/persistence"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrNoModeratorAvailable error
+	ErrNoModeratorAvailable = errors.New("no moderator is available, the conversation is queued")
+	// ErrAssignConversation error
+	ErrAssignConversation = errors.New("error while assigning a conversation")
+	// ErrConversationClosed error
+	ErrConversationClosed = errors.New("resolved or archived conversation can not be assigned")
+)
+
+// Стратегии выбора модератора для неназначенной беседы
+const (
+	RoutingRoundRobin = "round_robin"
+	RoutingLeastBusy  = "least_busy"
+	RoutingSticky     = "sticky"
+)
+
+// routingStrategy выбирает модератора из candidates, отсортированных по возрастанию идентификатора
+type routingStrategy interface {
+	pick(conv *models.Conversation, candidates []uint) (uint, error)
+}
+
+type roundRobinStrategy struct {
+	last uint
+}
+
+func (s *roundRobinStrategy) pick(conv *models.Conversation, candidates []uint) (uint, error) {
+	for _, id := range candidates {
+		if id > s.last {
+			s.last = id
+			return id, nil
+		}
+	}
+
+	s.last = candidates[0]
+	return s.last, nil
+}
+
+type leastBusyStrategy struct{}
+
+func (s leastBusyStrategy) pick(conv *models.Conversation, candidates []uint) (uint, error) {
+	best, bestCount := uint(0), -1
+	for _, id := range candidates {
+		count, err := persistence.GetConversationsProvider().CountByAssignee(id)
+		if err != nil {
+			return 0, err
+		}
+
+		if bestCount == -1 || count < bestCount {
+			best, bestCount = id, count
+		}
+	}
+
+	return best, nil
+}
+
+// stickyStrategy возвращает беседу предыдущему ответственному, если он в сети
+type stickyStrategy struct {
+	fallback routingStrategy
+}
+
+func (s stickyStrategy) pick(conv *models.Conversation, candidates []uint) (uint, error) {
+	for _, id := range candidates {
+		if conv.LastAssigneeID != 0 && id == conv.LastAssigneeID {
+			return id, nil
+		}
+	}
+
+	return s.fallback.pick(conv, candidates)
+}
+
+// conversationRouter ведёт очередь неназначенных бесед и назначает их модераторам.
+// Решения о назначении принимаются последовательно под mux, чтобы одну беседу
+// не получили два модератора.
+type conversationRouter struct {
+	mux        sync.Mutex
+	queue      []uint
+	strategies map[string]routingStrategy
+}
+
+var routing = newConversationRouter()
+
+func newConversationRouter() *conversationRouter {
+	return &conversationRouter{
+		queue: make([]uint, 0),
+		strategies: map[string]routingStrategy{
+			RoutingRoundRobin: &roundRobinStrategy{},
+			RoutingLeastBusy:  leastBusyStrategy{},
+			RoutingSticky:     stickyStrategy{fallback: leastBusyStrategy{}},
+		},
+	}
+}
+
+func (r *conversationRouter) strategy() routingStrategy {
+	if s, ok := r.strategies[config.Current().RoutingSettings.Strategy]; ok {
+		return s
+	}
+
+	return r.strategies[RoutingLeastBusy]
+}
+
+// route возвращает модератора, которому принадлежит беседа. Если ответственный не в сети,
+// беседа назначается другому модератору по стратегии, а если в сети нет никого, ставится в очередь.
+func (r *conversationRouter) route(conv *models.Conversation) (uint, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if conv.AssigneeID != 0 && hub.isConnected(conv.AssigneeID) {
+		return conv.AssigneeID, nil
+	}
+
+	candidates := hub.connectedModerators()
+	if len(candidates) == 0 {
+		r.enqueue(conv.ApplicationID)
+		return 0, ErrNoModeratorAvailable
+	}
+
+	assignee, err := r.strategy().pick(conv, candidates)
+	if err != nil {
+		return 0, err
+	}
+
+	err = r.assign(conv, assignee)
+	if err != nil {
+		return 0, err
+	}
+
+	return assignee, nil
+}
+
+// assignTo назначает беседу выбранному модератору вне зависимости от стратегии
+func (r *conversationRouter) assignTo(conv *models.Conversation, assignee uint) error {
+	if !isAssignable(conv) {
+		return ErrConversationClosed
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	return r.assign(conv, assignee)
+}
+
+// isAssignable решённые и архивные беседы не назначаются, пока их не откроют снова
+func isAssignable(conv *models.Conversation) bool {
+	status := conversationStatus(conv)
+	return status != models.ConversationResolved && status != models.ConversationArchived
+}
+
+// drain раздаёт беседы из очереди, вызывается при подключении модератора
+func (r *conversationRouter) drain() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	for len(r.queue) > 0 {
+		candidates := hub.connectedModerators()
+		if len(candidates) == 0 {
+			return
+		}
+
+		conv, err := persistence.GetConversationsProvider().GetByApplicationID(r.queue[0])
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+
+		if conv == nil || !isAssignable(conv) || (conv.AssigneeID != 0 && hub.isConnected(conv.AssigneeID)) {
+			r.queue = r.queue[1:]
+			continue
+		}
+
+		assignee, err := r.strategy().pick(conv, candidates)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+
+		err = r.assign(conv, assignee)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+	}
+}
+
+// assign вызывается под mux
+func (r *conversationRouter) assign(conv *models.Conversation, assignee uint) error {
+	err := r.setAssignee(conv, assignee)
+	if err != nil {
+		return err
+	}
+
+	notifyConversationAssigned(conv)
+	return nil
+}
+
+// setAssignee сохраняет ответственного без уведомления, вызывается под mux
+func (r *conversationRouter) setAssignee(conv *models.Conversation, assignee uint) error {
+	last := conv.LastAssigneeID
+	if conv.AssigneeID != 0 && conv.AssigneeID != assignee {
+		last = conv.AssigneeID
+	}
+
+	err := persistence.GetConversationsProvider().SetAssignee(conv.ID, assignee, last)
+	if err != nil {
+		logrus.Error(err)
+		return ErrAssignConversation
+	}
+
+	conv.AssigneeID = assignee
+	conv.LastAssigneeID = last
+	r.dequeue(conv.ApplicationID)
+
+	logrus.Info(fmt.Sprintf("Conversation %v was assigned to moderator %v", conv.ID, assignee))
+	return nil
+}
+
+// transfer передаёт беседу модератору to или, если to равен 0, одному из модераторов team.
+// Из команды выбираются модераторы в сети, а если в сети никого нет - все участники команды.
+// Возвращает модератора, получившего беседу.
+func (r *conversationRouter) transfer(conv *models.Conversation, to uint, team string, from uint) (uint, error) {
+	if !isAssignable(conv) {
+		return 0, ErrConversationClosed
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if to == 0 {
+		members, ok := config.Current().RoutingSettings.Teams[team]
+		if !ok {
+			return 0, ErrTeamNotFound
+		}
+
+		candidates := teamCandidates(members, from)
+		if len(candidates) == 0 {
+			return 0, ErrTransferTarget
+		}
+
+		var err error
+		to, err = r.strategy().pick(conv, candidates)
+		if err != nil {
+			logrus.Error(err)
+			return 0, ErrAssignConversation
+		}
+	}
+
+	err := r.setAssignee(conv, to)
+	if err != nil {
+		return 0, err
+	}
+
+	return to, nil
+}
+
+// teamCandidates возвращает отсортированных участников команды кроме from, предпочитая тех, кто в сети
+func teamCandidates(members []uint, from uint) []uint {
+	connected := make(map[uint]bool)
+	for _, id := range hub.connectedModerators() {
+		connected[id] = true
+	}
+
+	online, all := make([]uint, 0), make([]uint, 0)
+	for _, id := range members {
+		if id == from {
+			continue
+		}
+
+		all = append(all, id)
+		if connected[id] {
+			online = append(online, id)
+		}
+	}
+
+	ret := all
+	if len(online) > 0 {
+		ret = online
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
+
+func (r *conversationRouter) enqueue(applicationID uint) {
+	for _, id := range r.queue {
+		if id == applicationID {
+			return
+		}
+	}
+
+	r.queue = append(r.queue, applicationID)
+	logrus.Info(fmt.Sprintf("Conversation of application %v is queued, %v conversations are waiting", applicationID, len(r.queue)))
+}
+
+func (r *conversationRouter) dequeue(applicationID uint) {
+	for i, id := range r.queue {
+		if id == applicationID {
+			r.queue = append(r.queue[:i], r.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+func notifyConversationAssigned(conv *models.Conversation) {
+	raw, err := json.Marshal(&EventResult{
+		Name:   ConversationAssignedEvent,
+		Ok:     true,
+		Result: convertConversation(conv),
+	})
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+
+	hub.sendToUser(conv.AssigneeID, raw)
+}
+
+// connectedModerators возвращает отсортированные идентификаторы модераторов в сети
+func (h *Hub) connectedModerators() []uint {
+	ret := make([]uint, 0)
+	h.exec(func() {
+		seen := make(map[uint]bool)
+		for c := range h.Chatters {
+			if c.IsModerator && !seen[c.UserID] {
+				seen[c.UserID] = true
+				ret = append(ret, c.UserID)
+			}
+		}
+	})
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
+
+func (h *Hub) isConnected(userID uint) bool {
+	var ret bool
+	h.exec(func() {
+		for c := range h.Chatters {
+			if c.UserID == userID {
+				ret = true
+				return
+			}
+		}
+	})
+
+	return ret
+}
+
+// sendToUser доставляет сообщение во все сокеты пользователя
+func (h *Hub) sendToUser(userID uint, message []byte) error {
+	return h.broadcast(message, func(c *Chatter) bool { return c.UserID == userID })
+}
+
+// teamsOf возвращает отсортированные имена команд, в которые входит модератор
+func teamsOf(userID uint) []string {
+	ret := make([]string, 0)
+	for team, members := range config.Current().RoutingSettings.Teams {
+		for _, id := range members {
+			if id == userID {
+				ret = append(ret, team)
+				break
+			}
+		}
+	}
+
+	sort.Strings(ret)
+	return ret
+}
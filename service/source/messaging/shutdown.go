@@ -0,0 +1,96 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// reconnectDelay подсказка клиентам, через сколько переподключаться после остановки сервера
+	reconnectDelay = 5 * time.Second
+
+	drainPollInterval = 50 * time.Millisecond
+)
+
+// inflight количество обработчиков событий, выполняющихся в данный момент
+var inflight int64
+
+// writers горутины Writer, ещё не закрывшие свои сокеты. Add вызывается в горутине хаба
+// до перехода в режим остановки, поэтому Wait в Shutdown не пересекается с новыми Add
+var writers sync.WaitGroup
+
+// Shutdown функция переводит хаб в режим остановки: новые чаттеры больше не принимаются,
+// всем подключенным отправляется close frame "going away" с подсказкой о переподключении,
+// после чего функция ожидает завершения выполняющихся обработчиков событий и того, что каждый Writer
+// отправил close frame и закрыл сокет, но не дольше истечения ctx.
+func Shutdown(ctx context.Context) error {
+	stopSLAWatcher()
+
+	if hub == nil {
+		return nil
+	}
+
+	closed := 0
+	hub.exec(func() {
+		hub.draining = true
+		for c := range hub.Chatters {
+			c.closeWith(websocket.CloseGoingAway, goingAwayReason())
+			closed++
+		}
+	})
+
+	logrus.Info(fmt.Sprintf("Hub is draining, %v chatters were asked to reconnect", closed))
+
+	for atomic.LoadInt64(&inflight) > 0 {
+		select {
+		case <-ctx.Done():
+			logrus.Warn(fmt.Sprintf("Shutdown deadline reached with %v event handlers still running", atomic.LoadInt64(&inflight)))
+			return ctx.Err()
+		case <-time.After(drainPollInterval):
+		}
+	}
+
+	// server.Shutdown не отслеживает сокеты после upgrade, поэтому их закрытия ждём здесь
+	closedAll := make(chan struct{})
+	go func() {
+		writers.Wait()
+		close(closedAll)
+	}()
+
+	select {
+	case <-closedAll:
+	case <-ctx.Done():
+		logrus.Warn("Shutdown deadline reached before all web sockets were closed")
+		return ctx.Err()
+	}
+
+	return nil
+}
+
+// IsDraining возвращает true, если сервер останавливается и не принимает новых чаттеров
+func IsDraining() bool {
+	return hub != nil && hub.isDraining()
+}
+
+func (h *Hub) isDraining() bool {
+	var ret bool
+	h.exec(func() {
+		ret = h.draining
+	})
+
+	return ret
+}
+
+func goingAwayReason() string {
+	return fmt.Sprintf("server is shutting down, reconnect in %v seconds", int(reconnectDelay.Seconds()))
+}
+
+func goingAwayMessage() []byte {
+	return websocket.FormatCloseMessage(websocket.CloseGoingAway, goingAwayReason())
+}
@@ -5,24 +5,32 @@ const getMessagesList = "Event.GetMessageList"
 const readMessage = "Event.ReadMessage"
 const unreadCount = "Event.GetUnreadInfo"
 const getUnreadMessages = "Event.GetUnreadMessages"
+const refreshToken = "Event.RefreshToken"
+const assignConversation = "Event.AssignConversation"
+const resolveConversation = "Event.ResolveConversation"
+const reopenConversation = "Event.ReopenConversation"
+const transferConversation = "Event.TransferConversation"
+const getTransferHistory = "Event.GetTransferHistory"
+const listCannedResponses = "Event.ListCannedResponses"
+const saveCannedResponse = "Event.SaveCannedResponse"
+const deleteCannedResponse = "Event.DeleteCannedResponse"
+const sendCannedResponse = "Event.SendCannedResponse"
+const getConversationStats = "Event.GetConversationStats"
 
-function SendGetConversationListEvent(user){
+function SendGetConversationListEvent(){
     var json = JSON.stringify({
         name: getConversationListEvent,
-        args : JSON.stringify({
-           user_id: user,
-        })
+        args : JSON.stringify({})
     })
    
     ws.send(json)
 }
 
 
-function SendAddConversationEvent(applicationID, userID){
+function SendAddConversationEvent(applicationID){
     var json = JSON.stringify({
         name: addConversationEvent,
         args : JSON.stringify({
-            user_id: userID,
             application_id: applicationID
         })
     })
@@ -30,12 +38,11 @@ function SendAddConversationEvent(applicationID, userID){
     ws.send(json)
 }
 
-function SendGetMessagesListEvent(sessionChannel,  executorid){
+function SendGetMessagesListEvent(sessionChannel){
     var json = JSON.stringify({
         name: getMessagesList,
         args: JSON.stringify({
-            session_channel: sessionChannel,
-            executor_id: executorid
+            session_channel: sessionChannel
         })
     })
 
@@ -43,12 +50,11 @@ function SendGetMessagesListEvent(sessionChannel,  executorid){
 }
 
 
-function SendSendMessageEvent(sessionChannel, sender, content){
+function SendSendMessageEvent(sessionChannel, content){
     var json = JSON.stringify({
         name: addSendMessageEvent,
         args : JSON.stringify({
             session_channel:sessionChannel,
-            sender_id: sender,
             content: content
         })
     })
@@ -56,11 +62,24 @@ function SendSendMessageEvent(sessionChannel, sender, content){
     ws.send(json)
 }
 
-function SendReadMessageEvent(sessionChannel, executor_id, messageid){
+// moderators only, the note is delivered to moderators in the room and hidden from customers
+function SendInternalNoteEvent(sessionChannel, content){
+    var json = JSON.stringify({
+        name: addSendMessageEvent,
+        args : JSON.stringify({
+            session_channel:sessionChannel,
+            content: content,
+            internal: true
+        })
+    })
+
+    ws.send(json)
+}
+
+function SendReadMessageEvent(messageid){
     var json = JSON.stringify({
         name: readMessage,
         args : JSON.stringify({
-            executor_id: executor_id,
             message_id: messageid
         })
     })
@@ -68,29 +87,180 @@ function SendReadMessageEvent(sessionChannel, executor_id, messageid){
     ws.send(json)
 }
 
-function SendGetUnreadInfoEvent(userID){
+function SendGetUnreadInfoEvent(){
     var json = JSON.stringify({
         name: unreadCount,
-        args : JSON.stringify({
-            user_id: userID
-        })
+        args : JSON.stringify({})
     })
    
     ws.send(json)
 }
 
-function SendGetUnreadMessages(executorID){
+function SendGetUnreadMessages(){
     var json = JSON.stringify({
         name: getUnreadMessages,
+        args : JSON.stringify({})
+    })
+   
+    ws.send(json)
+}
+
+// moderators only, assigneeID 0 takes the conversation for yourself.
+// The new owner receives Event.ConversationAssigned
+function SendAssignConversationEvent(sessionChannel, assigneeID){
+    var json = JSON.stringify({
+        name: assignConversation,
         args : JSON.stringify({
-            executor_id: executorID
+            session_channel: sessionChannel,
+            assignee_id: assigneeID
         })
     })
-   
+
+    ws.send(json)
+}
+
+// moderators only, pass either assigneeID or team (a key of RoutingSettings.Teams), the other one empty.
+// The receiver gets Event.ConversationTransferred with the private note and joins the room if connected
+function SendTransferConversationEvent(sessionChannel, assigneeID, team, note){
+    var json = JSON.stringify({
+        name: transferConversation,
+        args : JSON.stringify({
+            session_channel: sessionChannel,
+            assignee_id: assigneeID,
+            team: team,
+            note: note
+        })
+    })
+
+    ws.send(json)
+}
+
+function SendGetTransferHistoryEvent(sessionChannel){
+    var json = JSON.stringify({
+        name: getTransferHistory,
+        args : JSON.stringify({
+            session_channel: sessionChannel
+        })
+    })
+
+    ws.send(json)
+}
+
+function SendListCannedResponsesEvent(){
+    var json = JSON.stringify({
+        name: listCannedResponses,
+        args : JSON.stringify({})
+    })
+
+    ws.send(json)
+}
+
+// id 0 creates a new response, an empty team makes it personal.
+// content may use {{conversation_id}}, {{application_id}}, {{session_channel}}, {{status}},
+// {{assignee_id}}, {{agent_id}}, {{date}}, {{time}} and any variable passed on send
+function SendSaveCannedResponseEvent(id, team, title, content){
+    var json = JSON.stringify({
+        name: saveCannedResponse,
+        args : JSON.stringify({
+            id: id,
+            team: team,
+            title: title,
+            content: content
+        })
+    })
+
+    ws.send(json)
+}
+
+function SendDeleteCannedResponseEvent(id){
+    var json = JSON.stringify({
+        name: deleteCannedResponse,
+        args : JSON.stringify({
+            id: id
+        })
+    })
+
+    ws.send(json)
+}
+
+// variables, e.g. {customer_name: "Anna"}, override the ones taken from the conversation
+function SendCannedResponseEvent(sessionChannel, cannedResponseID, variables){
+    var json = JSON.stringify({
+        name: sendCannedResponse,
+        args : JSON.stringify({
+            session_channel: sessionChannel,
+            canned_response_id: cannedResponseID,
+            variables: variables
+        })
+    })
+
+    ws.send(json)
+}
+
+// staff only, durations are in seconds. Moderators also receive Event.SLAWarning
+// when a customer has been waiting close to SLASettings.ResponseTime
+function SendGetConversationStatsEvent(sessionChannel){
+    var json = JSON.stringify({
+        name: getConversationStats,
+        args : JSON.stringify({
+            session_channel: sessionChannel
+        })
+    })
+
+    ws.send(json)
+}
+
+// room members receive Event.ConversationStatusChanged,
+// a customer message reopens a resolved conversation on its own
+function SendResolveConversationEvent(sessionChannel){
+    var json = JSON.stringify({
+        name: resolveConversation,
+        args : JSON.stringify({
+            session_channel: sessionChannel
+        })
+    })
+
+    ws.send(json)
+}
+
+function SendReopenConversationEvent(sessionChannel){
+    var json = JSON.stringify({
+        name: reopenConversation,
+        args : JSON.stringify({
+            session_channel: sessionChannel
+        })
+    })
+
+    ws.send(json)
+}
+
+// statuses filters the list, open and pending conversations are returned by default
+function SendGetConversationListByStatusEvent(statuses){
+    var json = JSON.stringify({
+        name: getConversationListEvent,
+        args : JSON.stringify({
+            statuses: statuses
+        })
+    })
+
+    ws.send(json)
+}
+
+// send a fresh token before the current one expires, the server warns with Event.TokenExpiring
+// and closes the socket with code 4001 once the token has expired
+function SendRefreshTokenEvent(token){
+    var json = JSON.stringify({
+        name: refreshToken,
+        args : JSON.stringify({
+            token: token
+        })
+    })
+
     ws.send(json)
 }
 
-var ws = new WebSocket("ws://localhost:8888/ws?sid=1")   // debug
+// the user id is taken from the token subject, sid is only checked against it
+var ws = new WebSocket("ws://localhost:8888/ws")   // debug
 
 ws.addEventListener("message", function (data){
     console.log(data.data)
@@ -0,0 +1,367 @@
+package messaging
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dvgavrilov/gochat/service/source/config"
+	"github.com/dvgavrilov/gochat/service/source/models"
+	"github.com/dvgavrilov/gochat/service/source/persistence"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrGetStats error
+	ErrGetStats = errors.New("error while getting conversation stats")
+)
+
+const (
+	// GetConversationStatsEvent const
+	GetConversationStatsEvent = "Event.GetConversationStats"
+	// SLAWarningEvent const
+	SLAWarningEvent = "Event.SLAWarning"
+)
+
+// statsMux упорядочивает чтение и запись показателей, которые обновляются из обработчиков разных чаттеров
+var statsMux sync.Mutex
+
+type getConversationStatsEventArgs struct {
+	SessionChannel string `json:"session_channel"`
+}
+
+type conversationStats struct {
+	ConversationID uint   `json:"conversation_id"`
+	SessionChannel string `json:"session_channel"`
+	// длительности в секундах
+	FirstResponseTime   int64      `json:"first_response_time"`
+	AverageResponseTime int64      `json:"average_response_time"`
+	ResolutionTime      int64      `json:"resolution_time"`
+	Responses           int        `json:"responses"`
+	SLABreaches         int        `json:"sla_breaches"`
+	AwaitingSince       *time.Time `json:"awaiting_since"`
+	ResolvedAt          *time.Time `json:"resolved_at"`
+}
+
+type slaWarningEventResult struct {
+	Conversation  *conversation `json:"conversation"`
+	AwaitingSince time.Time     `json:"awaiting_since"`
+	BreachAt      time.Time     `json:"breach_at"`
+}
+
+func onGetConversationStats(e *Event, c *Chatter) (*EventResult, error) {
+	args := &getConversationStatsEventArgs{}
+	err := convertFromRaw([]byte(reflect.ValueOf(e.Args).String()), args)
+	if err != nil {
+		logrus.Error(err)
+		return e.getErrorResponse(ErrMarschalingMessage), nil
+	}
+
+	sc, err := ParseSessionChannel(args.SessionChannel)
+	if err != nil {
+		logrus.Error(err)
+		return e.getErrorResponse(err), nil
+	}
+
+	logrus.Info(fmt.Sprintf("Received a new %v event with following parameters: SessionChannel:%s", e.Name, sc.ToString()))
+
+	conversation, err := loadConversation(c, e.Name, sc)
+	if err != nil {
+		return e.getErrorResponse(err), nil
+	}
+
+	stats, err := persistence.GetStatsProvider().Get(conversation.ID)
+	if err != nil {
+		logrus.Error(err)
+		return e.getErrorResponse(ErrGetStats), nil
+	}
+
+	if stats == nil {
+		stats = &models.ConversationStats{ConversationID: conversation.ID, ApplicationID: conversation.ApplicationID}
+	}
+
+	return &EventResult{
+		Name:   (*e).Name,
+		Ok:     true,
+		Result: convertStats(stats),
+	}, nil
+}
+
+// recordMessageStats обновляет показатели беседы по сохранённому сообщению: сообщение клиента
+// начинает ожидание ответа, первое сообщение модератора после него это ожидание завершает
+func recordMessageStats(conv *models.Conversation, msg *models.Message, c *Chatter) {
+	if msg.Internal || (!c.IsCustomer && !c.IsModerator) {
+		return
+	}
+
+	statsMux.Lock()
+	defer statsMux.Unlock()
+
+	stats, err := loadStats(conv)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+
+	at := msg.CreatedAt
+	if c.IsCustomer {
+		if stats.FirstCustomerMessageAt == nil {
+			stats.FirstCustomerMessageAt = &at
+		}
+		if stats.AwaitingSince != nil {
+			return
+		}
+
+		stats.AwaitingSince = &at
+		stats.SLAWarned = false
+	} else {
+		if stats.AwaitingSince == nil {
+			return
+		}
+
+		wait := at.Sub(*stats.AwaitingSince)
+		if stats.FirstResponseAt == nil {
+			stats.FirstResponseAt = &at
+			stats.FirstResponseTime = int64(wait.Seconds())
+		}
+
+		stats.ResponseCount++
+		stats.TotalResponseTime += int64(wait.Seconds())
+		if wait > slaResponseTime(conv.ApplicationID) {
+			stats.SLABreaches++
+		}
+
+		stats.AwaitingSince = nil
+		stats.SLAWarned = false
+	}
+
+	saveStats(stats)
+}
+
+// recordResolution запоминает время закрытия беседы, закрытая беседа ответа больше не ждёт.
+// Если клиент к моменту закрытия ждал ответа дольше порога, это засчитывается как нарушение SLA
+func recordResolution(conv *models.Conversation) {
+	statsMux.Lock()
+	defer statsMux.Unlock()
+
+	stats, err := loadStats(conv)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+
+	now := time.Now().UTC()
+	stats.ResolvedAt = &now
+	stats.ResolutionTime = int64(now.Sub(conv.CreatedAt).Seconds())
+	if stats.AwaitingSince != nil && now.Sub(*stats.AwaitingSince) > slaResponseTime(conv.ApplicationID) {
+		stats.SLABreaches++
+	}
+	stats.AwaitingSince = nil
+	stats.SLAWarned = false
+
+	saveStats(stats)
+}
+
+// loadStats вызывается под statsMux
+func loadStats(conv *models.Conversation) (*models.ConversationStats, error) {
+	stats, err := persistence.GetStatsProvider().Get(conv.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if stats == nil {
+		stats = &models.ConversationStats{ConversationID: conv.ID, ApplicationID: conv.ApplicationID}
+	}
+
+	return stats, nil
+}
+
+func saveStats(stats *models.ConversationStats) {
+	stats.UpdatedAt = time.Now().UTC()
+	err := persistence.GetStatsProvider().Save(stats)
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+// slaResponseTime порог ответа для приложения, SLASettings.Applications имеет приоритет
+func slaResponseTime(applicationID uint) time.Duration {
+	sla := config.Current().SLASettings
+	seconds := sla.ResponseTime
+	if s, ok := sla.Applications[strconv.FormatUint(uint64(applicationID), 10)]; ok {
+		seconds = s
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+var slaStop = make(chan struct{})
+var slaStopOnce sync.Once
+
+// watchSLA периодически проверяет беседы, ждущие ответа, до вызова stopSLAWatcher
+func watchSLA() {
+	interval := time.Duration(config.MainConfiguration.SLASettings.CheckInterval) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-slaStop:
+			return
+		case <-ticker.C:
+			checkSLA(time.Now().UTC())
+		}
+	}
+}
+
+func stopSLAWatcher() {
+	slaStopOnce.Do(func() { close(slaStop) })
+}
+
+// checkSLA предупреждает модераторов о беседах, порог ответа по которым истечёт
+// не позже чем через SLASettings.WarningBefore. О каждом ожидании предупреждение отправляется один раз.
+func checkSLA(now time.Time) {
+	statsMux.Lock()
+	defer statsMux.Unlock()
+
+	awaiting, err := persistence.GetStatsProvider().GetAwaiting()
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+
+	warnBefore := time.Duration(config.Current().SLASettings.WarningBefore) * time.Second
+	for i := range *awaiting {
+		stats := &(*awaiting)[i]
+		breachAt := stats.AwaitingSince.Add(slaResponseTime(stats.ApplicationID))
+		if now.Before(breachAt.Add(-warnBefore)) {
+			continue
+		}
+
+		conv, err := persistence.GetConversationsProvider().GetByApplicationID(stats.ApplicationID)
+		if err != nil {
+			logrus.Error(err)
+			continue
+		}
+
+		if conv == nil {
+			continue
+		}
+
+		notifySLAWarning(conv, *stats.AwaitingSince, breachAt)
+
+		stats.SLAWarned = true
+		saveStats(stats)
+	}
+}
+
+// notifySLAWarning отправляет предупреждение ответственному модератору, а если его нет в сети - всем модераторам
+func notifySLAWarning(conv *models.Conversation, awaitingSince time.Time, breachAt time.Time) {
+	raw, err := json.Marshal(&EventResult{
+		Name: SLAWarningEvent,
+		Ok:   true,
+		Result: slaWarningEventResult{
+			Conversation:  convertConversation(conv),
+			AwaitingSince: awaitingSince,
+			BreachAt:      breachAt,
+		},
+	})
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+
+	logrus.Warn(fmt.Sprintf("Conversation %v is waiting for a response since %v, SLA is breached at %v", conv.ID, awaitingSince, breachAt))
+
+	if conv.AssigneeID != 0 && hub.sendToUser(conv.AssigneeID, raw) == nil {
+		return
+	}
+
+	hub.broadcast(raw, func(c *Chatter) bool { return c.IsModerator })
+}
+
+// SLAReport сводные показатели бесед за период, длительности в секундах
+type SLAReport struct {
+	From                      time.Time            `json:"from"`
+	To                        time.Time            `json:"to"`
+	Conversations             int                  `json:"conversations"`
+	Responded                 int                  `json:"responded"`
+	Resolved                  int                  `json:"resolved"`
+	AverageFirstResponseTime  int64                `json:"average_first_response_time"`
+	AverageResponseTime       int64                `json:"average_response_time"`
+	AverageResolutionTime     int64                `json:"average_resolution_time"`
+	SLABreaches               int                  `json:"sla_breaches"`
+	ConversationsWithBreaches int                  `json:"conversations_with_breaches"`
+	ConversationsStats        []*conversationStats `json:"conversations_stats"`
+}
+
+// BuildSLAReport собирает отчёт по беседам, клиент которых впервые написал в период [from, to)
+func BuildSLAReport(from time.Time, to time.Time) (*SLAReport, error) {
+	list, err := persistence.GetStatsProvider().GetByPeriod(from, to)
+	if err != nil {
+		logrus.Error(err)
+		return nil, ErrGetStats
+	}
+
+	report := &SLAReport{
+		From:               from,
+		To:                 to,
+		ConversationsStats: make([]*conversationStats, 0),
+	}
+
+	var firstResponse, responses, resolution int64
+	var responseCount int
+	for i := range *list {
+		s := &(*list)[i]
+		report.Conversations++
+		report.ConversationsStats = append(report.ConversationsStats, convertStats(s))
+
+		if s.FirstResponseAt != nil {
+			report.Responded++
+			firstResponse += s.FirstResponseTime
+		}
+
+		if s.ResolvedAt != nil {
+			report.Resolved++
+			resolution += s.ResolutionTime
+		}
+
+		responseCount += s.ResponseCount
+		responses += s.TotalResponseTime
+
+		report.SLABreaches += s.SLABreaches
+		if s.SLABreaches > 0 {
+			report.ConversationsWithBreaches++
+		}
+	}
+
+	if report.Responded > 0 {
+		report.AverageFirstResponseTime = firstResponse / int64(report.Responded)
+	}
+	if responseCount > 0 {
+		report.AverageResponseTime = responses / int64(responseCount)
+	}
+	if report.Resolved > 0 {
+		report.AverageResolutionTime = resolution / int64(report.Resolved)
+	}
+
+	return report, nil
+}
+
+func convertStats(model *models.ConversationStats) *conversationStats {
+	return &conversationStats{
+		ConversationID:      model.ConversationID,
+		SessionChannel:      SessionChannel{ApplicationID: model.ApplicationID}.ToString(),
+		FirstResponseTime:   model.FirstResponseTime,
+		AverageResponseTime: model.AverageResponseTime(),
+		ResolutionTime:      model.ResolutionTime,
+		Responses:           model.ResponseCount,
+		SLABreaches:         model.SLABreaches,
+		AwaitingSince:       model.AwaitingSince,
+		ResolvedAt:          model.ResolvedAt,
+	}
+}
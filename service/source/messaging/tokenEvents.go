@@ -0,0 +1,150 @@
+package messaging
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/dvgavrilov/gochat/service/source/config"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrTokenRefreshInvalid error
+	ErrTokenRefreshInvalid = errors.New("received token is invalid")
+	// ErrTokenRefreshSubject error
+	ErrTokenRefreshSubject = errors.New("received token belongs to another user or role")
+)
+
+const (
+	// RefreshTokenEvent const
+	RefreshTokenEvent = "Event.RefreshToken"
+	// TokenExpiringEvent const
+	TokenExpiringEvent = "Event.TokenExpiring"
+
+	// CloseTokenExpired код закрытия сокета, когда срок действия токена истёк
+	CloseTokenExpired = 4001
+
+	// tokenExpiryWarning за сколько до истечения токена клиент получает TokenExpiringEvent
+	tokenExpiryWarning = 2 * time.Minute
+)
+
+type refreshTokenEventArgs struct {
+	Token string `json:"token"`
+}
+
+type tokenExpiryEventResult struct {
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func onRefreshToken(e *Event, c *Chatter) (*EventResult, error) {
+	args := &refreshTokenEventArgs{}
+	err := convertFromRaw([]byte(reflect.ValueOf(e.Args).String()), args)
+	if err != nil {
+		logrus.Error(err)
+		return e.getErrorResponse(ErrMarschalingMessage), nil
+	}
+
+	token, err := currentKeySet().parse(args.Token)
+	if err != nil {
+		logrus.Error(err)
+		return e.getErrorResponse(ErrTokenRefreshInvalid), nil
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	if !config.Current().JWTSettings.LegacySidParameter {
+		subject, err := subjectFromClaims(claims, config.Current().JWTSettings.SubjectClaim)
+		if err != nil || subject != c.UserID {
+			return e.getErrorResponse(ErrTokenRefreshSubject), nil
+		}
+	}
+
+	role, err := RoleFromClaims(claims)
+	if err != nil || role != c.Role {
+		return e.getErrorResponse(ErrTokenRefreshSubject), nil
+	}
+
+	expiresAt, err := expiryFromClaims(claims)
+	if err != nil {
+		return e.getErrorResponse(ErrTokenRefreshInvalid), nil
+	}
+
+	select {
+	case c.refresh <- expiresAt:
+	case <-c.done:
+	}
+
+	logrus.Info(fmt.Sprintf("Chatter with id %v refreshed the token, it expires at %v", c.UserID, expiresAt))
+
+	return &EventResult{
+		Name: (*e).Name,
+		Ok:   true,
+		Result: tokenExpiryEventResult{
+			ExpiresAt: expiresAt,
+		},
+	}, nil
+}
+
+func expiryFromClaims(claims jwt.MapClaims) (time.Time, error) {
+	switch exp := claims["exp"].(type) {
+	case float64:
+		return time.Unix(int64(exp), 0).UTC(), nil
+	case json.Number:
+		v, err := exp.Int64()
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(v, 0).UTC(), nil
+	}
+
+	return time.Time{}, ErrTokenExpMissing
+}
+
+// tokenTimers отслеживает срок действия токена чаттера, используется только в Writer
+type tokenTimers struct {
+	expiresAt time.Time
+	warning   *time.Timer
+	expiry    *time.Timer
+}
+
+func newTokenTimers(expiresAt time.Time) *tokenTimers {
+	return &tokenTimers{
+		expiresAt: expiresAt,
+		warning:   time.NewTimer(time.Until(expiresAt.Add(-tokenExpiryWarning))),
+		expiry:    time.NewTimer(time.Until(expiresAt)),
+	}
+}
+
+func (t *tokenTimers) reset(expiresAt time.Time) {
+	t.expiresAt = expiresAt
+	resetTimer(t.warning, time.Until(expiresAt.Add(-tokenExpiryWarning)))
+	resetTimer(t.expiry, time.Until(expiresAt))
+}
+
+func (t *tokenTimers) stop() {
+	t.warning.Stop()
+	t.expiry.Stop()
+}
+
+func (t *tokenTimers) warningMessage() ([]byte, error) {
+	return json.Marshal(&EventResult{
+		Name: TokenExpiringEvent,
+		Ok:   true,
+		Result: tokenExpiryEventResult{
+			ExpiresAt: t.expiresAt,
+		},
+	})
+}
+
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
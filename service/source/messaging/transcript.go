@@ -0,0 +1,379 @@
+package messaging
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dvgavrilov/gochat/service/source/audit"
+	"github.com/dvgavrilov/gochat/service/source/models"
+	"github.com/dvgavrilov/gochat/service/source/persistence"
+	"github.com/sirupsen/logrus"
+)
+
+// Форматы выгрузки истории беседы
+const (
+	TranscriptJSON = "json"
+	TranscriptCSV  = "csv"
+	TranscriptHTML = "html"
+)
+
+const (
+	// ExportTranscriptAction действие в матрице PermissionSettings, разрешающее выгрузку истории
+	ExportTranscriptAction = "Action.ExportTranscript"
+	transcriptPageSize     = 200
+)
+
+var (
+	// ErrTranscriptFormat error
+	ErrTranscriptFormat = errors.New("transcript format must be json, csv or html")
+	// ErrExportTranscript error
+	ErrExportTranscript = errors.New("error while exporting a transcript")
+)
+
+// Transcript история беседы, доступная автору запроса. Сообщения читаются
+// постранично во время записи, поэтому выгрузка не держит всю историю в памяти.
+type Transcript struct {
+	conversation    *models.Conversation
+	participants    []uint
+	includeInternal bool
+	actor           audit.Actor
+}
+
+type transcriptConversation struct {
+	ID             uint      `json:"id"`
+	SessionChannel string    `json:"session_channel"`
+	ApplicationID  uint      `json:"application_id"`
+	AssigneeID     uint      `json:"assignee_id"`
+	Status         string    `json:"status"`
+	Participants   []uint    `json:"participants"`
+	CreatedAt      time.Time `json:"create_at"`
+	ExportedAt     time.Time `json:"exported_at"`
+}
+
+type transcriptMessage struct {
+	ID          uint   `json:"id"`
+	SenderID    uint   `json:"sender_id"`
+	ContentType string `json:"content_type"`
+	Content     string `json:"content"`
+	// Attachment ссылка на вложение, для изображений это содержимое сообщения
+	Attachment string `json:"attachment,omitempty"`
+	Internal   bool   `json:"internal"`
+	// ReadBy и UnreadBy участники, прочитавшие и не прочитавшие сообщение,
+	// 0 означает общую отметку для модераторов
+	ReadBy    []uint    `json:"read_by"`
+	UnreadBy  []uint    `json:"unread_by"`
+	CreatedAt time.Time `json:"create_at"`
+}
+
+type transcriptWriter interface {
+	begin(conv *transcriptConversation) error
+	message(msg *transcriptMessage) error
+	end() error
+}
+
+type flusher interface {
+	Flush()
+}
+
+// IsTranscriptFormat проверяет, что format один из поддерживаемых форматов
+func IsTranscriptFormat(format string) bool {
+	return format == TranscriptJSON || format == TranscriptCSV || format == TranscriptHTML
+}
+
+// TranscriptContentType тип содержимого для формата format
+func TranscriptContentType(format string) string {
+	switch format {
+	case TranscriptCSV:
+		return "text/csv; charset=utf-8"
+	case TranscriptHTML:
+		return "text/html; charset=utf-8"
+	}
+
+	return "application/json"
+}
+
+// OpenTranscript проверяет доступ actor к беседе и готовит её к выгрузке. Беседу могут выгрузить
+// её участники, а также роли, которым MembershipSettings.Overrides разрешает Action.ExportTranscript
+func OpenTranscript(actor audit.Actor, sessionChannel string) (*Transcript, error) {
+	sc, err := ParseSessionChannel(sessionChannel)
+	if err != nil {
+		return nil, err
+	}
+
+	logrus.Info(fmt.Sprintf("Exporting a transcript with following parameters: SessionChannel:%s, UserID:%v", sc.ToString(), actor.ID))
+
+	c := &Chatter{
+		UserID:     actor.ID,
+		Role:       actor.Role,
+		IsCustomer: actor.Role == models.RoleCustomer,
+		RemoteAddr: actor.RemoteAddr,
+	}
+
+	conv, err := loadConversation(c, ExportTranscriptAction, sc)
+	if err != nil {
+		return nil, err
+	}
+
+	participants, err := persistence.GetParticipantsProvider().GetByConversationID(conv.ID)
+	if err != nil {
+		logrus.Error(err)
+		return nil, ErrGettingConversation
+	}
+
+	ids := make([]uint, 0, len(*participants))
+	for _, p := range *participants {
+		ids = append(ids, p.UserID)
+	}
+
+	return &Transcript{
+		conversation:    conv,
+		participants:    ids,
+		includeInternal: canReadInternalNotes(c),
+		actor:           actor,
+	}, nil
+}
+
+// Filename имя файла выгрузки
+func (t *Transcript) Filename(format string) string {
+	return fmt.Sprintf("transcript-%v-%s.%s", t.conversation.ApplicationID, time.Now().UTC().Format("20060102-150405"), format)
+}
+
+// Write пишет историю беседы в w в формате format. Если w умеет Flush, данные отправляются после каждой страницы.
+// Ошибка после начала записи означает, что выгрузка оборвана на середине.
+func (t *Transcript) Write(w io.Writer, format string) error {
+	var tw transcriptWriter
+	switch format {
+	case TranscriptJSON:
+		tw = &jsonTranscriptWriter{w: w}
+	case TranscriptCSV:
+		tw = &csvTranscriptWriter{w: csv.NewWriter(w)}
+	case TranscriptHTML:
+		tw = &htmlTranscriptWriter{w: w}
+	default:
+		return ErrTranscriptFormat
+	}
+
+	err := tw.begin(&transcriptConversation{
+		ID:             t.conversation.ID,
+		SessionChannel: SessionChannel{ApplicationID: t.conversation.ApplicationID}.ToString(),
+		ApplicationID:  t.conversation.ApplicationID,
+		AssigneeID:     t.conversation.AssigneeID,
+		Status:         conversationStatus(t.conversation),
+		Participants:   t.participants,
+		CreatedAt:      t.conversation.CreatedAt,
+		ExportedAt:     time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	var afterID uint
+	for {
+		messages, err := persistence.GetMessagesProvider().GetMessagesPage(t.conversation.ID, t.includeInternal, afterID, transcriptPageSize)
+		if err != nil {
+			logrus.Error(err)
+			return ErrExportTranscript
+		}
+
+		for i := range *messages {
+			err = tw.message(convertTranscriptMessage(&(*messages)[i]))
+			if err != nil {
+				return err
+			}
+		}
+
+		count += len(*messages)
+		if f, ok := w.(flusher); ok {
+			f.Flush()
+		}
+
+		if len(*messages) < transcriptPageSize {
+			break
+		}
+		afterID = (*messages)[len(*messages)-1].ID
+	}
+
+	err = tw.end()
+	if err != nil {
+		return err
+	}
+
+	if t.actor.Role != models.RoleCustomer {
+		audit.Record(t.actor, audit.ConversationExport, audit.TargetConversation, t.conversation.ID,
+			map[string]interface{}{"format": format, "messages": count, "internal": t.includeInternal})
+	}
+
+	return nil
+}
+
+func convertTranscriptMessage(model *models.Message) *transcriptMessage {
+	ret := &transcriptMessage{
+		ID:          model.ID,
+		SenderID:    model.SenderID,
+		ContentType: "text",
+		Content:     model.Content,
+		Internal:    model.Internal,
+		ReadBy:      make([]uint, 0),
+		UnreadBy:    make([]uint, 0),
+		CreatedAt:   model.CreatedAt,
+	}
+
+	if model.ContentType == models.ContentImage {
+		ret.ContentType = "image"
+		ret.Attachment = model.Content
+	}
+
+	for _, ui := range model.UnreadInfo {
+		if ui.Read {
+			ret.ReadBy = append(ret.ReadBy, ui.ParticipantID)
+		} else {
+			ret.UnreadBy = append(ret.UnreadBy, ui.ParticipantID)
+		}
+	}
+
+	return ret
+}
+
+// jsonTranscriptWriter пишет {"conversation": {...}, "messages": [...]}, по одному сообщению за раз
+type jsonTranscriptWriter struct {
+	w       io.Writer
+	written int
+}
+
+func (j *jsonTranscriptWriter) begin(conv *transcriptConversation) error {
+	raw, err := json.Marshal(conv)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(j.w, `{"conversation":%s,"messages":[`, raw)
+	return err
+}
+
+func (j *jsonTranscriptWriter) message(msg *transcriptMessage) error {
+	raw, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	if j.written > 0 {
+		raw = append([]byte(","), raw...)
+	}
+	j.written++
+
+	_, err = j.w.Write(raw)
+	return err
+}
+
+func (j *jsonTranscriptWriter) end() error {
+	_, err := io.WriteString(j.w, "]}")
+	return err
+}
+
+// csvTranscriptWriter пишет по строке на сообщение, данные беседы повторяются в первых колонках
+type csvTranscriptWriter struct {
+	w    *csv.Writer
+	conv *transcriptConversation
+}
+
+func (c *csvTranscriptWriter) begin(conv *transcriptConversation) error {
+	c.conv = conv
+	return c.w.Write([]string{"conversation_id", "session_channel", "participants", "message_id", "created_at",
+		"sender_id", "content_type", "content", "attachment", "internal", "read_by", "unread_by"})
+}
+
+func (c *csvTranscriptWriter) message(msg *transcriptMessage) error {
+	return c.w.Write([]string{
+		strconv.FormatUint(uint64(c.conv.ID), 10),
+		CSVCell(c.conv.SessionChannel),
+		joinIDs(c.conv.Participants),
+		strconv.FormatUint(uint64(msg.ID), 10),
+		msg.CreatedAt.Format(time.RFC3339),
+		strconv.FormatUint(uint64(msg.SenderID), 10),
+		msg.ContentType,
+		CSVCell(msg.Content),
+		CSVCell(msg.Attachment),
+		strconv.FormatBool(msg.Internal),
+		joinIDs(msg.ReadBy),
+		joinIDs(msg.UnreadBy),
+	})
+}
+
+// CSVCell защищает от выполнения формул при открытии выгрузки в табличном редакторе:
+// значение, начинающееся с =, +, -, @, табуляции или перевода строки, предваряется апострофом
+func CSVCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+
+	return value
+}
+
+func (c *csvTranscriptWriter) end() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+var transcriptTemplates = template.Must(template.New("begin").Funcs(template.FuncMap{
+	"ids":  joinIDs,
+	"time": func(t time.Time) string { return t.Format(time.RFC3339) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Conversation {{.SessionChannel}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+tr.internal { background: #fff8dc; }
+.meta { color: #666; font-size: 0.9em; }
+</style>
+</head>
+<body>
+<h1>Conversation {{.SessionChannel}}</h1>
+<p class="meta">Status: {{.Status}}, assignee: {{.AssigneeID}}, participants: {{ids .Participants}}</p>
+<p class="meta">Created {{time .CreatedAt}}, exported {{time .ExportedAt}}</p>
+<table>
+<tr><th>Time</th><th>Sender</th><th>Message</th><th>Read by</th><th>Unread by</th></tr>
+`))
+
+func init() {
+	template.Must(transcriptTemplates.New("message").Parse(`<tr{{if .Internal}} class="internal"{{end}}><td>{{time .CreatedAt}}</td><td>{{.SenderID}}</td><td>{{if .Attachment}}<a href="{{.Attachment}}">{{.Attachment}}</a>{{else}}{{.Content}}{{end}}{{if .Internal}} <em>(internal note)</em>{{end}}</td><td>{{ids .ReadBy}}</td><td>{{ids .UnreadBy}}</td></tr>
+`))
+}
+
+// htmlTranscriptWriter пишет самодостаточную страницу без внешних стилей и скриптов
+type htmlTranscriptWriter struct {
+	w io.Writer
+}
+
+func (h *htmlTranscriptWriter) begin(conv *transcriptConversation) error {
+	return transcriptTemplates.ExecuteTemplate(h.w, "begin", conv)
+}
+
+func (h *htmlTranscriptWriter) message(msg *transcriptMessage) error {
+	return transcriptTemplates.ExecuteTemplate(h.w, "message", msg)
+}
+
+func (h *htmlTranscriptWriter) end() error {
+	_, err := io.WriteString(h.w, "</table>\n</body>\n</html>\n")
+	return err
+}
+
+func joinIDs(ids []uint) string {
+	parts := make([]string, 0, len(ids))
+	for _, id := range ids {
+		parts = append(parts, strconv.FormatUint(uint64(id), 10))
+	}
+
+	return strings.Join(parts, " ")
+}
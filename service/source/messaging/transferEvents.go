@@ -0,0 +1,270 @@
+package messaging
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/dvgavrilov/gochat/service/source/audit"
+	"github.com/dvgavrilov/gochat/service/source/config"
+	"github.com/dvgavrilov/gochat/service/source/models"
+	"github.com/dvgavrilov/gochat/service/source/persistence"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrTransferTarget error
+	ErrTransferTarget = errors.New("conversation can be transferred only to another moderator")
+	// ErrTeamNotFound error
+	ErrTeamNotFound = errors.New("team not found")
+	// ErrGetTransfers error
+	ErrGetTransfers = errors.New("error while getting the transfer history")
+)
+
+const (
+	// TransferConversationEvent const
+	TransferConversationEvent = "Event.TransferConversation"
+	// ConversationTransferredEvent const
+	ConversationTransferredEvent = "Event.ConversationTransferred"
+	// GetTransferHistoryEvent const
+	GetTransferHistoryEvent = "Event.GetTransferHistory"
+)
+
+type transferConversationEventArgs struct {
+	SessionChannel string `json:"session_channel"`
+	// AssigneeID или Team - кому передаётся беседа, указывается что-то одно
+	AssigneeID uint   `json:"assignee_id"`
+	Team       string `json:"team"`
+	// Note заметка для принимающего модератора
+	Note string `json:"note"`
+}
+
+type transferConversationEventResult struct {
+	Conversation *conversation `json:"conversation"`
+	Transfer     *transfer     `json:"transfer"`
+	History      []*transfer   `json:"history"`
+}
+
+type getTransferHistoryEventArgs struct {
+	SessionChannel string `json:"session_channel"`
+}
+
+type getTransferHistoryEventResult struct {
+	History []*transfer `json:"history"`
+}
+
+type transfer struct {
+	ID        uint      `json:"id"`
+	FromID    uint      `json:"from_id"`
+	ToID      uint      `json:"to_id"`
+	Team      string    `json:"team"`
+	Note      string    `json:"note"`
+	CreatedAt time.Time `json:"create_at"`
+}
+
+func onTransferConversation(e *Event, c *Chatter) (*EventResult, error) {
+	args := &transferConversationEventArgs{}
+	err := convertFromRaw([]byte(reflect.ValueOf(e.Args).String()), args)
+	if err != nil {
+		logrus.Error(err)
+		return e.getErrorResponse(ErrMarschalingMessage), nil
+	}
+
+	sc, err := ParseSessionChannel(args.SessionChannel)
+	if err != nil {
+		logrus.Error(err)
+		return e.getErrorResponse(err), nil
+	}
+
+	logrus.Info(fmt.Sprintf("Received a new %v event with following parameters: SessionChannel:%s, AssigneeID:%v, Team:%s", e.Name, sc.ToString(), args.AssigneeID, args.Team))
+
+	if (args.AssigneeID == 0) == (args.Team == "") {
+		return e.getErrorResponse(ErrBadEventArgs), nil
+	}
+
+	if args.AssigneeID == c.UserID {
+		return e.getErrorResponse(ErrTransferTarget), nil
+	}
+
+	conversation, err := loadConversation(c, e.Name, sc)
+	if err != nil {
+		return e.getErrorResponse(err), nil
+	}
+
+	if !isAssignable(conversation) {
+		return e.getErrorResponse(ErrConversationClosed), nil
+	}
+
+	// чужую беседу передаёт только тот, кому разрешено назначать беседы другим
+	if conversation.AssigneeID != 0 && conversation.AssigneeID != c.UserID && !IsAllowed(c.Role, assignToOthersAction) {
+		return e.getErrorResponse(ErrForbidden), nil
+	}
+
+	if args.AssigneeID != 0 && !isModeratorID(args.AssigneeID) {
+		return e.getErrorResponse(ErrTransferTarget), nil
+	}
+
+	to, err := routing.transfer(conversation, args.AssigneeID, args.Team, c.UserID)
+	if err != nil {
+		return e.getErrorResponse(err), nil
+	}
+
+	audit.Record(c.actor(), audit.ConversationTransfer, audit.TargetConversation, conversation.ID,
+		map[string]interface{}{"to": to, "team": args.Team, "with_note": args.Note != ""})
+
+	err = ensureParticipant(conversation, to)
+	if err != nil {
+		logrus.Error(err)
+	}
+
+	record := &models.Transfer{
+		ConversationID: conversation.ID,
+		FromID:         c.UserID,
+		ToID:           to,
+		Team:           args.Team,
+		Note:           args.Note,
+		CreatedAt:      time.Now().UTC(),
+	}
+
+	err = persistence.GetTransfersProvider().Add(record)
+	if err != nil {
+		logrus.Error(err)
+	}
+
+	history, err := persistence.GetTransfersProvider().GetByConversationID(conversation.ID)
+	if err != nil {
+		logrus.Error(err)
+		history = &[]models.Transfer{*record}
+	}
+
+	key := fmt.Sprintf("%v", conversation.ApplicationID)
+	connected, err := hub.joinUser(to, key)
+	if err != nil {
+		logrus.Error(err)
+	}
+
+	result := transferConversationEventResult{
+		Conversation: convertConversation(conversation),
+		Transfer:     convertTransfer(record),
+		History:      convertTransfers(history),
+	}
+
+	if connected {
+		notifyConversationTransferred(to, result)
+	}
+
+	return &EventResult{
+		Name:   (*e).Name,
+		Ok:     true,
+		Result: result,
+	}, nil
+}
+
+func onGetTransferHistory(e *Event, c *Chatter) (*EventResult, error) {
+	args := &getTransferHistoryEventArgs{}
+	err := convertFromRaw([]byte(reflect.ValueOf(e.Args).String()), args)
+	if err != nil {
+		logrus.Error(err)
+		return e.getErrorResponse(ErrMarschalingMessage), nil
+	}
+
+	sc, err := ParseSessionChannel(args.SessionChannel)
+	if err != nil {
+		logrus.Error(err)
+		return e.getErrorResponse(err), nil
+	}
+
+	logrus.Info(fmt.Sprintf("Received a new %v event with following parameters: SessionChannel:%s", e.Name, sc.ToString()))
+
+	conversation, err := loadConversation(c, e.Name, sc)
+	if err != nil {
+		return e.getErrorResponse(err), nil
+	}
+
+	history, err := persistence.GetTransfersProvider().GetByConversationID(conversation.ID)
+	if err != nil {
+		logrus.Error(err)
+		return e.getErrorResponse(ErrGetTransfers), nil
+	}
+
+	return &EventResult{
+		Name: (*e).Name,
+		Ok:   true,
+		Result: getTransferHistoryEventResult{
+			History: convertTransfers(history),
+		},
+	}, nil
+}
+
+func notifyConversationTransferred(to uint, result transferConversationEventResult) {
+	raw, err := json.Marshal(&EventResult{
+		Name:   ConversationTransferredEvent,
+		Ok:     true,
+		Result: result,
+	})
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+
+	hub.sendToUser(to, raw)
+}
+
+// isModeratorID роль пользователя известна только по его токену, поэтому модератором
+// считается подключенный модератор или участник одной из команд
+func isModeratorID(userID uint) bool {
+	for _, id := range hub.connectedModerators() {
+		if id == userID {
+			return true
+		}
+	}
+
+	for _, members := range config.Current().RoutingSettings.Teams {
+		for _, id := range members {
+			if id == userID {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// ensureParticipant делает принимающего модератора участником беседы
+func ensureParticipant(conv *models.Conversation, userID uint) error {
+	found, err := isParticipant(conv.ID, userID)
+	if err != nil || found {
+		return err
+	}
+
+	return persistence.GetParticipantsProvider().Add(&models.Participant{
+		ConversationID: conv.ID,
+		UserID:         userID,
+	})
+}
+
+func convertTransfers(transfers *[]models.Transfer) []*transfer {
+	ret := make([]*transfer, 0)
+	if transfers == nil {
+		return ret
+	}
+
+	for i := range *transfers {
+		ret = append(ret, convertTransfer(&(*transfers)[i]))
+	}
+
+	return ret
+}
+
+func convertTransfer(model *models.Transfer) *transfer {
+	return &transfer{
+		ID:        model.ID,
+		FromID:    model.FromID,
+		ToID:      model.ToID,
+		Team:      model.Team,
+		Note:      model.Note,
+		CreatedAt: model.CreatedAt,
+	}
+}
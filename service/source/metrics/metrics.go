@@ -0,0 +1,133 @@
+// Package metrics описывает метрики сервера в формате Prometheus
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "gochat"
+
+// Результаты обработки события
+const (
+	OutcomeOk        = "ok"
+	OutcomeError     = "error"
+	OutcomeFailed    = "failed"
+	OutcomeForbidden = "forbidden"
+	OutcomeUnknown   = "unknown"
+	OutcomeMalformed = "malformed"
+)
+
+// Хранилища, время обращения к которым измеряется
+const (
+	StorePostgres = "postgres"
+	StoreRedis    = "redis"
+)
+
+var (
+	// EventsReceived события, полученные от чаттеров, по имени и результату
+	EventsReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_received_total",
+		Help:      "Events received from chatters by name and outcome.",
+	}, []string{"event", "outcome"})
+
+	// EventDuration время выполнения обработчиков событий
+	EventDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "event_handler_duration_seconds",
+		Help:      "Event handler latency by event name.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"event"})
+
+	// BroadcastFanout количество получателей одной рассылки
+	BroadcastFanout = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "broadcast_fanout",
+		Help:      "Number of chatters a single broadcast was delivered to.",
+		Buckets:   []float64{0, 1, 2, 5, 10, 25, 50, 100, 250, 1000},
+	}, []string{"kind"})
+
+	// OutQueueDepth длина очереди Out в момент отправки сообщения
+	OutQueueDepth = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "out_queue_depth",
+		Help:      "Messages left in a chatter Out queue when the writer takes the next one.",
+		Buckets:   []float64{0, 1, 2, 4, 8, 16, 32, 64, 128, 256},
+	})
+
+	// OutQueueOverflows чаттеры, отключенные из-за переполнения очереди Out
+	OutQueueOverflows = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "out_queue_overflows_total",
+		Help:      "Chatters disconnected because their Out queue was full.",
+	})
+
+	// WriteFailures ошибки записи в web socket
+	WriteFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "websocket_write_failures_total",
+		Help:      "Websocket write failures by stage.",
+	}, []string{"stage"})
+
+	// UpgradeFailures отклонённые подключения по причине
+	UpgradeFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "websocket_upgrade_failures_total",
+		Help:      "Websocket connections rejected before or during the upgrade, by reason.",
+	}, []string{"reason"})
+
+	// StoreDuration время обращения к хранилищу
+	StoreDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "store_call_duration_seconds",
+		Help:      "Postgres and Redis call latency by operation.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"store", "operation"})
+
+	// StoreErrors ошибки обращения к хранилищу
+	StoreErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "store_call_errors_total",
+		Help:      "Postgres and Redis call errors by operation.",
+	}, []string{"store", "operation"})
+
+	// FilterMatches срабатывания фильтров содержимого по имени фильтра и действию
+	FilterMatches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "content_filter_matches_total",
+		Help:      "Messages matched by a content filter, by filter name and action.",
+	}, []string{"filter", "action"})
+)
+
+// ObserveStoreCall учитывает обращение к хранилищу, начатое в start
+func ObserveStoreCall(store string, operation string, start time.Time, err error) {
+	StoreDuration.WithLabelValues(store, operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		StoreErrors.WithLabelValues(store, operation).Inc()
+	}
+}
+
+// Register добавляет в реестр дополнительные сборщики, например, снимающие состояние хаба
+func Register(collectors ...prometheus.Collector) error {
+	for _, c := range collectors {
+		err := prometheus.Register(c)
+		if _, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Handler отдаёт метрики в формате Prometheus
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
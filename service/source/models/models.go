@@ -11,6 +11,64 @@ const (
 	ContentImage = 2 // image
 )
 
+// Решения фильтров содержимого, записываемые в сообщение. Отклонённые сообщения не сохраняются
+const (
+	FilterMasked  = "masked"
+	FilterFlagged = "flagged"
+)
+
+// Роли пользователей, роль передаётся в claim токена
+const (
+	RoleCustomer   = "customer"
+	RoleAgent      = "agent"
+	RoleSupervisor = "supervisor"
+	RoleAuditor    = "auditor"
+	RoleBot        = "bot"
+)
+
+// Roles все известные роли
+var Roles = []string{RoleCustomer, RoleAgent, RoleSupervisor, RoleAuditor, RoleBot}
+
+// IsModeratorRole роли, которые обслуживают клиентов
+func IsModeratorRole(role string) bool {
+	return role == RoleAgent || role == RoleSupervisor
+}
+
+// Состояния беседы
+const (
+	ConversationOpen     = "open"
+	ConversationPending  = "pending"
+	ConversationResolved = "resolved"
+	ConversationArchived = "archived"
+)
+
+// ActiveConversationStatuses состояния, в которых беседа требует внимания
+var ActiveConversationStatuses = []string{ConversationOpen, ConversationPending}
+
+var conversationTransitions = map[string][]string{
+	ConversationOpen:     {ConversationPending, ConversationResolved},
+	ConversationPending:  {ConversationOpen, ConversationResolved},
+	ConversationResolved: {ConversationOpen, ConversationArchived},
+	ConversationArchived: {ConversationOpen},
+}
+
+// IsConversationStatus проверяет, что status одно из известных состояний
+func IsConversationStatus(status string) bool {
+	_, ok := conversationTransitions[status]
+	return ok
+}
+
+// CanTransition проверяет, разрешён ли переход беседы из состояния from в состояние to
+func CanTransition(from string, to string) bool {
+	for _, s := range conversationTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+
+	return false
+}
+
 // Message struct
 type Message struct {
 	ID             uint
@@ -18,11 +76,21 @@ type Message struct {
 	ConversationID uint
 	ApplicationID  uint
 	ContentType    uint
-	UnreadInfo     []UnreadInfo
-	Read           bool `gorm:"-"`
-	Content        string
-	CreatedAt      time.Time
-	UpdatedAt      time.Time
+	// Internal заметка модератора, клиенту не показывается
+	Internal   bool `gorm:"not null;default:false"`
+	UnreadInfo []UnreadInfo
+	Read       bool   `gorm:"-"`
+	Content    string `gorm:"type:text"`
+	// KeyVersion версия мастер-ключа, которым зашифрован DataKey, 0 если Content не зашифрован.
+	// Хранилище расшифровывает Content при чтении, поэтому вне него Content всегда открытый текст
+	KeyVersion uint   `gorm:"not null;default:0" json:"-"`
+	DataKey    string `json:"-"`
+	// FilterAction решение фильтров содержимого, пустое, если ни один фильтр не сработал
+	FilterAction string
+	// FilterReasons имена сработавших фильтров через запятую
+	FilterReasons string
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
 }
 
 // UnreadInfo struct
@@ -44,7 +112,115 @@ type Conversation struct {
 	ID            uint
 	Participants  []Participant
 	ApplicationID uint
-	CreatedAt     time.Time
-	UpdatedAt     time.Time
-	UnreadCount   uint `gorm:"-"`
+	// AssigneeID модератор, которому назначена беседа, 0 если беседа не назначена
+	AssigneeID uint
+	// LastAssigneeID предыдущий ответственный, используется стратегией sticky
+	LastAssigneeID uint
+	Status         string `gorm:"default:'open'"`
+	// ResolvedAt время последнего перехода в resolved, в отличие от UpdatedAt другие изменения его не сдвигают
+	ResolvedAt  *time.Time
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	UnreadCount uint `gorm:"-"`
+}
+
+// CannedResponse сохранённый ответ модератора. Личный ответ принадлежит OwnerID,
+// ответ команды задаётся Team и доступен всем её участникам.
+type CannedResponse struct {
+	ID      uint
+	OwnerID uint
+	Team    string
+	Title   string
+	// Content текст ответа, может содержать переменные вида {{name}}
+	Content   string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// ConversationStats показатели времени ответа по беседе, длительности хранятся в секундах
+type ConversationStats struct {
+	ConversationID uint `gorm:"primary_key;auto_increment:false"`
+	ApplicationID  uint
+	// FirstCustomerMessageAt время первого сообщения клиента
+	FirstCustomerMessageAt *time.Time
+	FirstResponseAt        *time.Time
+	FirstResponseTime      int64
+	// ResponseCount и TotalResponseTime дают среднее время ответа
+	ResponseCount     int
+	TotalResponseTime int64
+	// AwaitingSince время первого сообщения клиента, оставшегося без ответа
+	AwaitingSince *time.Time
+	// SLAWarned модераторы уже предупреждены о текущем ожидании
+	SLAWarned   bool `gorm:"not null;default:false"`
+	SLABreaches int
+	ResolvedAt  *time.Time
+	// ResolutionTime время от создания беседы до её последнего закрытия
+	ResolutionTime int64
+	UpdatedAt      time.Time
+}
+
+// AverageResponseTime среднее время ответа модератора в секундах
+func (s *ConversationStats) AverageResponseTime() int64 {
+	if s.ResponseCount == 0 {
+		return 0
+	}
+
+	return s.TotalResponseTime / int64(s.ResponseCount)
+}
+
+// AuditEntry запись журнала аудита, записи только добавляются
+type AuditEntry struct {
+	ID         uint
+	ActorID    uint
+	ActorRole  string
+	Action     string
+	TargetType string
+	TargetID   string
+	// Metadata данные запроса в формате json: адрес, user agent, параметры действия
+	Metadata   string `gorm:"type:text"`
+	RemoteAddr string
+	CreatedAt  time.Time
+}
+
+// AuditFilter условия поиска по журналу аудита, пустые поля не учитываются
+type AuditFilter struct {
+	ActorID    uint
+	TargetType string
+	TargetID   string
+	From       time.Time
+	To         time.Time
+	Limit      int
+	Offset     int
+}
+
+// RetentionScope приложения, к которым применяется политика хранения. Нулевой ApplicationID
+// означает все приложения, кроме Exclude, у которых есть своя политика
+type RetentionScope struct {
+	ApplicationID uint
+	Exclude       []uint
+}
+
+// ErasureResult сколько строк затронуло удаление данных пользователя
+type ErasureResult struct {
+	Messages        int `json:"messages"`
+	UnreadInfos     int `json:"unread_infos"`
+	Participants    int `json:"participants"`
+	Assignments     int `json:"assignments"`
+	Transfers       int `json:"transfers"`
+	CannedResponses int `json:"canned_responses"`
+	// ConversationIDs беседы, в которых были данные пользователя
+	ConversationIDs []uint `json:"conversation_ids"`
+}
+
+// Transfer запись о передаче беседы от одного модератора другому
+type Transfer struct {
+	ID             uint
+	ConversationID uint
+	FromID         uint
+	ToID           uint
+	// Team команда, которой передавалась беседа, пустая при передаче конкретному модератору
+	Team string
+	// Note заметка для принимающего модератора, клиенту не показывается
+	Note      string
+	CreatedAt time.Time
 }
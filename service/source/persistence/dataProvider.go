@@ -1,6 +1,7 @@
 package persistence
 
 import (
+	"context"
 	"io"
 
 	"github.com/dvgavrilov/gochat/service/source/interfaces"
@@ -29,6 +30,16 @@ func DataSourceCloser() io.Closer {
 	return dsNew
 }
 
+// Ping проверяет доступность хранилищ
+func Ping(ctx context.Context) map[string]error {
+	err := Init()
+	if err != nil {
+		return map[string]error{"postgres": err}
+	}
+
+	return dsNew.Ping(ctx)
+}
+
 // GetConversationsProvider func
 func GetConversationsProvider() interfaces.ConversationsProvider {
 	Init()
@@ -47,6 +58,54 @@ func GetParticipantsProvider() interfaces.ParticipantsProvider {
 	return dsNew.ParticipantStore
 }
 
+// GetTransfersProvider func
+func GetTransfersProvider() interfaces.TransfersProvider {
+	Init()
+	return dsNew.TransferStore
+}
+
+// GetCannedResponsesProvider func
+func GetCannedResponsesProvider() interfaces.CannedResponsesProvider {
+	Init()
+	return dsNew.CannedResponseStore
+}
+
+// GetStatsProvider func
+func GetStatsProvider() interfaces.StatsProvider {
+	Init()
+	return dsNew.StatsStore
+}
+
+// GetAuditProvider func
+func GetAuditProvider() interfaces.AuditProvider {
+	Init()
+	return dsNew.AuditStore
+}
+
+// GetRetentionProvider func
+func GetRetentionProvider() interfaces.RetentionProvider {
+	Init()
+	return dsNew.RetentionStore
+}
+
+// GetSubjectProvider func
+func GetSubjectProvider() interfaces.SubjectProvider {
+	Init()
+	return dsNew.SubjectStore
+}
+
+// InvalidateConversationCache сбрасывает кэш бесед, изменённых в обход ConversationsProvider
+func InvalidateConversationCache(conversationIDs []uint) {
+	Init()
+	dsNew.InvalidateCache(conversationIDs)
+}
+
+// GetMessageKeysProvider func
+func GetMessageKeysProvider() interfaces.MessageKeysProvider {
+	Init()
+	return dsNew.MessageKeysStore
+}
+
 // GetUnreadInfoManager func
 func GetUnreadInfoManager() interfaces.UnreadInfoManager {
 	Init()
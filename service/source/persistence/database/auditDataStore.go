@@ -0,0 +1,46 @@
+package database
+
+import "github.com/dvgavrilov/gochat/service/source/models"
+
+type auditDataStore struct {
+	connection *Connection
+}
+
+func (r auditDataStore) Add(entry *models.AuditEntry) error {
+	return r.connection.db.Create(entry).Error
+}
+
+// Find возвращает записи по возрастанию времени, To не включается в период
+func (r auditDataStore) Find(filter models.AuditFilter) (*[]models.AuditEntry, error) {
+	obj := &[]models.AuditEntry{}
+	query := r.connection.db.Model(&models.AuditEntry{})
+
+	if filter.ActorID != 0 {
+		query = query.Where("actor_id = ?", filter.ActorID)
+	}
+	if filter.TargetType != "" {
+		query = query.Where("target_type = ?", filter.TargetType)
+	}
+	if filter.TargetID != "" {
+		query = query.Where("target_id = ?", filter.TargetID)
+	}
+	if !filter.From.IsZero() {
+		query = query.Where("created_at >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		query = query.Where("created_at < ?", filter.To)
+	}
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+	if filter.Offset > 0 {
+		query = query.Offset(filter.Offset)
+	}
+
+	err := query.Order("created_at, id").Find(obj).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return obj, nil
+}
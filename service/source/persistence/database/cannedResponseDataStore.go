@@ -0,0 +1,53 @@
+package database
+
+import (
+	"github.com/dvgavrilov/gochat/service/source/models"
+	"github.com/jinzhu/gorm"
+)
+
+type cannedResponseDataStore struct {
+	connection *Connection
+}
+
+// Save создаёт ответ, если у него нет идентификатора, иначе обновляет его
+func (r cannedResponseDataStore) Save(response *models.CannedResponse) (*models.CannedResponse, error) {
+	err := r.connection.db.Save(response).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+func (r cannedResponseDataStore) GetByID(id uint) (*models.CannedResponse, error) {
+	obj := &models.CannedResponse{}
+	err := r.connection.db.Where("id = ?", id).First(obj).Error
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+// GetAvailable возвращает личные ответы ownerID и ответы команд teams
+func (r cannedResponseDataStore) GetAvailable(ownerID uint, teams []string) (*[]models.CannedResponse, error) {
+	obj := &[]models.CannedResponse{}
+	query := r.connection.db.Where("owner_id = ?", ownerID)
+	if len(teams) > 0 {
+		query = r.connection.db.Where("owner_id = ? OR team IN (?)", ownerID, teams)
+	}
+
+	err := query.Order("title, id").Find(obj).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+func (r cannedResponseDataStore) Delete(id uint) error {
+	return r.connection.db.Where("id = ?", id).Delete(&models.CannedResponse{}).Error
+}
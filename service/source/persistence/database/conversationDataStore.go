@@ -1,6 +1,8 @@
 package database
 
 import (
+	"time"
+
 	"github.com/dvgavrilov/gochat/service/source/interfaces"
 	"github.com/dvgavrilov/gochat/service/source/models"
 	"github.com/jinzhu/gorm"
@@ -44,8 +46,20 @@ func (r conversationsManager) Add(conversation *models.Conversation) (*models.Co
 	return r.conversationStore.Add(conversation)
 }
 
-func (r conversationsManager) GetByUserID(userID uint) (*[]models.Conversation, error) {
-	ret, err := r.conversationStore.GetByUserID(userID)
+func (r conversationsManager) SetAssignee(conversationID uint, assigneeID uint, lastAssigneeID uint) error {
+	return r.conversationStore.SetAssignee(conversationID, assigneeID, lastAssigneeID)
+}
+
+func (r conversationsManager) CountByAssignee(assigneeID uint) (int, error) {
+	return r.conversationStore.CountByAssignee(assigneeID)
+}
+
+func (r conversationsManager) SetStatus(conversationID uint, status string) error {
+	return r.conversationStore.SetStatus(conversationID, status)
+}
+
+func (r conversationsManager) GetByUserID(userID uint, statuses []string) (*[]models.Conversation, error) {
+	ret, err := r.conversationStore.GetByUserID(userID, statuses)
 	if err != nil {
 		return nil, err
 	}
@@ -86,16 +100,59 @@ func (r conversationDataStore) Add(conversation *models.Conversation) (*models.C
 	return conversation, err
 }
 
-func (r conversationDataStore) GetByUserID(userID uint) (*[]models.Conversation, error) {
+// GetByUserID func. Пустой statuses означает беседы в любом состоянии
+func (r conversationDataStore) GetByUserID(userID uint, statuses []string) (*[]models.Conversation, error) {
 	obj := &[]models.Conversation{}
-	err := r.connection.db.Model(models.Conversation{}).
-		Select("conversations.id, conversations.application_id, conversations.created_at, conversations.updated_at").
+	query := r.connection.db.Model(models.Conversation{}).
+		Select("conversations.id, conversations.application_id, conversations.assignee_id, conversations.last_assignee_id, conversations.status, conversations.created_at, conversations.updated_at").
 		Joins("join participants p on p.conversation_id = conversations.id").
-		Where("p.user_id = ?", userID).
-		Find(&obj).Error
+		Where("p.user_id = ?", userID)
+
+	if len(statuses) > 0 {
+		query = query.Where("conversations.status IN (?)", statuses)
+	}
+
+	err := query.Find(&obj).Error
 	if err != nil {
 		return nil, err
 	}
 
 	return obj, nil
 }
+
+// SetAssignee func
+func (r conversationDataStore) SetAssignee(conversationID uint, assigneeID uint, lastAssigneeID uint) error {
+	return r.connection.db.Model(&models.Conversation{}).
+		Where("id = ?", conversationID).
+		Updates(map[string]interface{}{
+			"assignee_id":      assigneeID,
+			"last_assignee_id": lastAssigneeID,
+			"updated_at":       time.Now().UTC(),
+		}).Error
+}
+
+// CountByAssignee число открытых и ожидающих бесед сотрудника, закрытые нагрузкой не считаются
+func (r conversationDataStore) CountByAssignee(assigneeID uint) (int, error) {
+	var count int
+	err := r.connection.db.Model(&models.Conversation{}).
+		Where("assignee_id = ? AND status IN (?)", assigneeID, models.ActiveConversationStatuses).
+		Count(&count).Error
+
+	return count, err
+}
+
+// SetStatus func
+func (r conversationDataStore) SetStatus(conversationID uint, status string) error {
+	now := time.Now().UTC()
+	values := map[string]interface{}{
+		"status":     status,
+		"updated_at": now,
+	}
+	if status == models.ConversationResolved {
+		values["resolved_at"] = now
+	}
+
+	return r.connection.db.Model(&models.Conversation{}).
+		Where("id = ?", conversationID).
+		Updates(values).Error
+}
@@ -1,13 +1,13 @@
 package database
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 
-	"strconv"
-
 	"github.com/dvgavrilov/gochat/service/source/config"
+	"github.com/dvgavrilov/gochat/service/source/encryption"
 	"github.com/dvgavrilov/gochat/service/source/interfaces"
 	"github.com/dvgavrilov/gochat/service/source/persistence/database/rediscache"
 	"github.com/dvgavrilov/gochat/service/source/persistence/migrations"
@@ -32,6 +32,11 @@ const (
 	maxHistorySize int64 = 1000
 )
 
+var (
+	// ErrNotConnected error
+	ErrNotConnected = errors.New("database connection is not established")
+)
+
 var (
 	dbConnection *gorm.DB
 	useCache     bool
@@ -49,36 +54,51 @@ type DataSourceNew struct {
 	ConversationsManager interfaces.ConversationsProvider
 	ParticipantStore     interfaces.ParticipantsProvider
 	UnreadInfoStore      interfaces.UnreadInfoManager
+	TransferStore        interfaces.TransfersProvider
+	CannedResponseStore  interfaces.CannedResponsesProvider
+	StatsStore           interfaces.StatsProvider
+	AuditStore           interfaces.AuditProvider
+	RetentionStore       interfaces.RetentionProvider
+	SubjectStore         interfaces.SubjectProvider
+	MessageKeysStore     interfaces.MessageKeysProvider
 
 	io.Closer
 }
 
 // Close func
 func (r *DataSourceNew) Close() error {
+	var cacheErr error
 	if useCache {
-		rediscache.Close()
+		cacheErr = rediscache.Close()
 	}
 
-	return r.connection.db.Close()
+	err := r.connection.db.Close()
+	if err != nil {
+		return err
+	}
+
+	return cacheErr
 }
 
 // Init func
 func (r *DataSourceNew) Init() error {
 
-	var err error
+	err := encryption.Reload()
+	if err != nil {
+		return err
+	}
+
 	dbConnection, err = gorm.Open("postgres", getConnString())
 	if err != nil {
 		return err
 	}
 
+	instrument(dbConnection)
 	(*r).connection = &Connection{dbConnection}
 
 	migrations.Migrate(dbConnection)
 
-	useCache, err = strconv.ParseBool(config.MainConfiguration.ChatRoomSettings.CacheHistory)
-	if err != nil {
-		return errors.New("error with reading config file")
-	}
+	useCache = config.MainConfiguration.ChatRoomSettings.CacheHistory
 
 	msgManager := &messagesManager{}
 	msgManager.Init(r.connection)
@@ -90,6 +110,13 @@ func (r *DataSourceNew) Init() error {
 	store.Init(r.connection)
 
 	r.UnreadInfoStore = unreadInfoDataStore{connection: r.connection}
+	r.TransferStore = transferDataStore{connection: r.connection}
+	r.CannedResponseStore = cannedResponseDataStore{connection: r.connection}
+	r.StatsStore = statsDataStore{connection: r.connection}
+	r.AuditStore = auditDataStore{connection: r.connection}
+	r.RetentionStore = retentionDataStore{connection: r.connection}
+	r.SubjectStore = subjectDataStore{connection: r.connection}
+	r.MessageKeysStore = messageKeysDataStore{connection: r.connection}
 
 	if useCache {
 		redisStore, err := rediscache.GetRedisConversationStore(store)
@@ -106,10 +133,52 @@ func (r *DataSourceNew) Init() error {
 	return nil
 }
 
+// Ping проверяет доступность Postgres и, если включено кэширование, Redis.
+// Возвращает ошибку для каждой проверенной зависимости, nil означает, что она доступна
+func (r *DataSourceNew) Ping(ctx context.Context) map[string]error {
+	ret := map[string]error{
+		"postgres": ErrNotConnected,
+	}
+
+	if r.connection != nil {
+		ret["postgres"] = r.connection.db.DB().PingContext(ctx)
+	}
+
+	if useCache {
+		ret["redis"] = rediscache.Ping(ctx)
+	}
+
+	return ret
+}
+
+// InvalidateCache сбрасывает закэшированные беседы conversationIDs, если кэширование включено
+func (r *DataSourceNew) InvalidateCache(conversationIDs []uint) {
+	if useCache {
+		rediscache.InvalidateConversations(conversationIDs)
+	}
+}
+
+// transaction выполняет fn в транзакции и откатывает её, если fn вернула ошибку
+func transaction(db *gorm.DB, fn func(tx *gorm.DB) error) error {
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	err := fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
 func getConnString() string {
 
-	return fmt.Sprintf("host=%v user=%v dbname=%v sslmode=disable password=%v",
+	return fmt.Sprintf("host=%v port=%v user=%v dbname=%v sslmode=disable password=%v",
 		config.MainConfiguration.DatabaseSettings.Server,
+		config.MainConfiguration.DatabaseSettings.Port,
 		config.MainConfiguration.DatabaseSettings.User,
 		config.MainConfiguration.DatabaseSettings.Database,
 		config.MainConfiguration.DatabaseSettings.Password)
@@ -0,0 +1,45 @@
+package database
+
+import (
+	"time"
+
+	"github.com/dvgavrilov/gochat/service/source/metrics"
+	"github.com/jinzhu/gorm"
+)
+
+const callStartKey = "metrics:call_start"
+
+// instrument измеряет время и ошибки всех запросов gorm к Postgres.
+// Операция в метке - вид запроса и таблица, например query.messages
+func instrument(db *gorm.DB) {
+	before := func(scope *gorm.Scope) {
+		scope.Set(callStartKey, time.Now())
+	}
+
+	after := func(kind string) func(scope *gorm.Scope) {
+		return func(scope *gorm.Scope) {
+			value, ok := scope.Get(callStartKey)
+			if !ok {
+				return
+			}
+
+			err := scope.DB().Error
+			if err == gorm.ErrRecordNotFound {
+				err = nil
+			}
+
+			metrics.ObserveStoreCall(metrics.StorePostgres, kind+"."+scope.TableName(), value.(time.Time), err)
+		}
+	}
+
+	db.Callback().Create().Before("gorm:begin_transaction").Register("metrics:before_create", before)
+	db.Callback().Create().After("gorm:commit_or_rollback_transaction").Register("metrics:after_create", after("create"))
+	db.Callback().Query().Before("gorm:query").Register("metrics:before_query", before)
+	db.Callback().Query().After("gorm:after_query").Register("metrics:after_query", after("query"))
+	db.Callback().Update().Before("gorm:begin_transaction").Register("metrics:before_update", before)
+	db.Callback().Update().After("gorm:commit_or_rollback_transaction").Register("metrics:after_update", after("update"))
+	db.Callback().Delete().Before("gorm:begin_transaction").Register("metrics:before_delete", before)
+	db.Callback().Delete().After("gorm:commit_or_rollback_transaction").Register("metrics:after_delete", after("delete"))
+	db.Callback().RowQuery().Before("gorm:row_query").Register("metrics:before_row_query", before)
+	db.Callback().RowQuery().After("gorm:row_query").Register("metrics:after_row_query", after("row_query"))
+}
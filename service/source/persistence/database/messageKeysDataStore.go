@@ -0,0 +1,139 @@
+package database
+
+import (
+	"fmt"
+
+	"github.com/dvgavrilov/gochat/service/source/encryption"
+	"github.com/dvgavrilov/gochat/service/source/models"
+	"github.com/sirupsen/logrus"
+)
+
+type messageKeysDataStore struct {
+	connection *Connection
+}
+
+// CountByKeyVersion считает сообщения по версиям мастер-ключа, версия 0 - незашифрованные сообщения
+func (r messageKeysDataStore) CountByKeyVersion() (map[uint]int, error) {
+	rows, err := r.connection.db.Model(&models.Message{}).
+		Select("key_version, count(*)").
+		Group("key_version").
+		Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := make(map[uint]int)
+	for rows.Next() {
+		var version uint
+		var count int
+		err = rows.Scan(&version, &count)
+		if err != nil {
+			return nil, err
+		}
+		ret[version] = count
+	}
+
+	return ret, rows.Err()
+}
+
+// Reencrypt переводит на активный мастер-ключ не больше limit сообщений с id больше afterID:
+// открытый текст шифруется, у зашифрованных сообщений перешифровывается только ключ данных.
+// Возвращает id последнего просмотренного сообщения, 0 если таких сообщений больше нет.
+// Сообщения, которые не удалось перешифровать, пропускаются и пишутся в лог
+func (r messageKeysDataStore) Reencrypt(afterID uint, limit int) (uint, int, error) {
+	active := encryption.ActiveVersion()
+	if active == 0 {
+		return 0, 0, encryption.ErrDisabled
+	}
+
+	messages := &[]models.Message{}
+	err := r.connection.db.
+		Select("id, conversation_id, content, key_version, data_key").
+		Where("id > ? AND key_version <> ?", afterID, active).
+		Order("id").
+		Limit(limit).
+		Find(messages).Error
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if len(*messages) == 0 {
+		return 0, 0, nil
+	}
+
+	updated := 0
+	for i := range *messages {
+		msg := &(*messages)[i]
+		columns := map[string]interface{}{}
+
+		if msg.KeyVersion == 0 {
+			content, dataKey, version, err := encryption.Seal(msg.Content, additionalData(msg))
+			if err != nil {
+				logrus.Error(fmt.Sprintf("message %v was not encrypted: %v", msg.ID, err))
+				continue
+			}
+			columns["content"], columns["data_key"], columns["key_version"] = content, dataKey, version
+		} else {
+			dataKey, version, err := encryption.Rewrap(msg.DataKey, msg.KeyVersion)
+			if err != nil {
+				logrus.Error(fmt.Sprintf("message %v was not re-encrypted: %v", msg.ID, err))
+				continue
+			}
+			columns["data_key"], columns["key_version"] = dataKey, version
+		}
+
+		// условие по старой версии и содержимому не даёт затереть сообщение, изменённое параллельно,
+		// например обезличенное при удалении данных субъекта: оно тоже получает key_version 0
+		res := r.connection.db.Model(&models.Message{}).
+			Where("id = ? AND key_version = ? AND content = ?", msg.ID, msg.KeyVersion, msg.Content).
+			UpdateColumns(columns)
+		if res.Error != nil {
+			return 0, updated, res.Error
+		}
+		updated += int(res.RowsAffected)
+	}
+
+	return (*messages)[len(*messages)-1].ID, updated, nil
+}
+
+// encryptMessage шифрует Content активным ключом и возвращает открытый текст.
+// Если шифрование выключено, сообщение сохраняется как есть
+func encryptMessage(msg *models.Message) (string, error) {
+	plaintext := msg.Content
+	if encryption.ActiveVersion() == 0 {
+		msg.KeyVersion, msg.DataKey = 0, ""
+		return plaintext, nil
+	}
+
+	content, dataKey, version, err := encryption.Seal(plaintext, additionalData(msg))
+	if err != nil {
+		return "", err
+	}
+
+	msg.Content, msg.DataKey, msg.KeyVersion = content, dataKey, version
+	return plaintext, nil
+}
+
+func decryptMessages(messages *[]models.Message) (*[]models.Message, error) {
+	for i := range *messages {
+		msg := &(*messages)[i]
+		if msg.KeyVersion == 0 {
+			continue
+		}
+
+		plaintext, err := encryption.Open(msg.Content, msg.DataKey, msg.KeyVersion, additionalData(msg))
+		if err != nil {
+			return nil, fmt.Errorf("message %v can not be decrypted: %v", msg.ID, err)
+		}
+
+		msg.Content = plaintext
+	}
+
+	return messages, nil
+}
+
+// additionalData привязывает шифротекст к беседе, чтобы его нельзя было перенести в другую
+func additionalData(msg *models.Message) string {
+	return fmt.Sprintf("conversation:%v", msg.ConversationID)
+}
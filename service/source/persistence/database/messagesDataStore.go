@@ -1,6 +1,9 @@
 package database
 
-import "github.com/dvgavrilov/gochat/service/source/models"
+import (
+	"github.com/dvgavrilov/gochat/service/source/models"
+	"github.com/jinzhu/gorm"
+)
 
 type messagesDataStore struct {
 	connection *Connection
@@ -16,8 +19,8 @@ func (r *messagesManager) Init(connection *Connection) {
 	r.unreadInfoStore = unreadInfoDataStore{connection: connection}
 }
 
-func (r messagesManager) GetMessages(conversationID uint) (*[]models.Message, error) {
-	ret, err := r.messagesStore.GetMessages(conversationID)
+func (r messagesManager) GetMessages(conversationID uint, includeInternal bool) (*[]models.Message, error) {
+	ret, err := r.messagesStore.GetMessages(conversationID, includeInternal)
 	if err != nil {
 		return nil, err
 	}
@@ -25,8 +28,8 @@ func (r messagesManager) GetMessages(conversationID uint) (*[]models.Message, er
 	return r.populateUnreadInfo(ret)
 }
 
-func (r messagesManager) GetUnreadMessages(userID uint) (*[]models.Message, error) {
-	ret, err := r.messagesStore.GetUnreadMessages(userID)
+func (r messagesManager) GetUnreadMessages(userID uint, includeInternal bool) (*[]models.Message, error) {
+	ret, err := r.messagesStore.GetUnreadMessages(userID, includeInternal)
 	if err != nil {
 		return nil, err
 	}
@@ -34,41 +37,104 @@ func (r messagesManager) GetUnreadMessages(userID uint) (*[]models.Message, erro
 	return r.populateUnreadInfo(ret)
 }
 
+func (r messagesManager) GetMessagesPage(conversationID uint, includeInternal bool, afterID uint, limit int) (*[]models.Message, error) {
+	ret, err := r.messagesStore.GetMessagesPage(conversationID, includeInternal, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.populateUnreadInfo(ret)
+}
+
+func (r messagesManager) GetMessage(messageID uint) (*models.Message, error) {
+	return r.messagesStore.GetMessage(messageID)
+}
+
 func (r messagesManager) AddMessage(message *models.Message) (*models.Message, error) {
 	return r.messagesStore.AddMessage(message)
 }
 
 // GetMessages func
-func (r messagesDataStore) GetMessages(conversationID uint) (*[]models.Message, error) {
+func (r messagesDataStore) GetMessages(conversationID uint, includeInternal bool) (*[]models.Message, error) {
 	obj := &[]models.Message{}
-	err := r.connection.db.Where("conversation_id = ?", conversationID).Find(obj).Error
+	query := r.connection.db.Where("conversation_id = ?", conversationID)
+	if !includeInternal {
+		query = query.Where("internal = false")
+	}
+
+	err := query.Find(obj).Error
 	if err != nil {
 		return nil, err
 	}
 
-	return obj, nil
+	return decryptMessages(obj)
 }
 
-func (r messagesDataStore) GetUnreadMessages(userID uint) (*[]models.Message, error) {
+// GetMessagesPage func
+func (r messagesDataStore) GetMessagesPage(conversationID uint, includeInternal bool, afterID uint, limit int) (*[]models.Message, error) {
 	obj := &[]models.Message{}
-	err := r.connection.db.Model(models.Message{}).
-		Select("distinct on(messages.id) messages.id, sender_id, messages.conversation_id, content_type, content, messages.created_at, messages.updated_at, messages.application_id").
+	query := r.connection.db.Where("conversation_id = ? AND id > ?", conversationID, afterID)
+	if !includeInternal {
+		query = query.Where("internal = false")
+	}
+
+	err := query.Order("id").Limit(limit).Find(obj).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return decryptMessages(obj)
+}
+
+// GetMessage func
+func (r messagesDataStore) GetMessage(messageID uint) (*models.Message, error) {
+	obj := &models.Message{}
+	err := r.connection.db.Where("id = ?", messageID).First(obj).Error
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	messages, err := decryptMessages(&[]models.Message{*obj})
+	if err != nil {
+		return nil, err
+	}
+
+	return &(*messages)[0], nil
+}
+
+func (r messagesDataStore) GetUnreadMessages(userID uint, includeInternal bool) (*[]models.Message, error) {
+	obj := &[]models.Message{}
+	query := r.connection.db.Model(models.Message{}).
+		Select("distinct on(messages.id) messages.id, sender_id, messages.conversation_id, content_type, content, messages.internal, messages.key_version, messages.data_key, messages.filter_action, messages.filter_reasons, messages.created_at, messages.updated_at, messages.application_id").
 		Joins("join conversations c on c.id= messages.conversation_id ").
 		Joins("join unread_infos ui on ui.message_id = messages.id").
-		Where("ui.participant_id IN (0, ?) AND ui.read = false", userID).
-		Find(obj).Error
+		Where("ui.participant_id IN (0, ?) AND ui.read = false", userID)
+	if !includeInternal {
+		query = query.Where("messages.internal = false")
+	}
+
+	err := query.Find(obj).Error
 
 	if err != nil {
 		return nil, err
 	}
 
-	return obj, nil
+	return decryptMessages(obj)
 }
 
-// AddMessage func
+// AddMessage func. Содержимое сохраняется зашифрованным, а вызывающему возвращается открытым
 func (r messagesDataStore) AddMessage(message *models.Message) (*models.Message, error) {
+	plaintext, err := encryptMessage(message)
+	if err != nil {
+		return nil, err
+	}
+
 	r.connection.db.NewRecord(message)
-	err := r.connection.db.Create(&message).Error
+	err = r.connection.db.Create(&message).Error
+	message.Content = plaintext
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,45 @@
+package rediscache
+
+import (
+	"context"
+	"time"
+
+	"github.com/dvgavrilov/gochat/service/source/metrics"
+	"github.com/gomodule/redigo/redis"
+)
+
+var _ redis.ConnWithContext = instrumentedConn{}
+
+// instrumentedConn измеряет время и ошибки команд Redis, отсутствие ключа ошибкой не считается
+type instrumentedConn struct {
+	redis.Conn
+}
+
+func (c instrumentedConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	start := time.Now()
+	reply, err := c.Conn.Do(commandName, args...)
+	observe(commandName, start, err)
+
+	return reply, err
+}
+
+// DoContext нужен redis.DoContext, иначе обёртка скрывает поддержку контекста у соединения
+func (c instrumentedConn) DoContext(ctx context.Context, commandName string, args ...interface{}) (interface{}, error) {
+	start := time.Now()
+	reply, err := redis.DoContext(c.Conn, ctx, commandName, args...)
+	observe(commandName, start, err)
+
+	return reply, err
+}
+
+// ReceiveContext func
+func (c instrumentedConn) ReceiveContext(ctx context.Context) (interface{}, error) {
+	return redis.ReceiveContext(c.Conn, ctx)
+}
+
+func observe(commandName string, start time.Time, err error) {
+	if err == redis.ErrNil {
+		err = nil
+	}
+	metrics.ObserveStoreCall(metrics.StoreRedis, commandName, start, err)
+}
@@ -1,10 +1,10 @@
 package rediscache
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-
-	"log"
+	"time"
 
 	"github.com/dvgavrilov/gochat/service/source/config"
 	"github.com/dvgavrilov/gochat/service/source/customerrors"
@@ -26,6 +26,9 @@ const (
 	chatApplicationPrefix   = "application"
 	chatClientLastSeqPrefix = "client.last_seq"
 	chatSeqPrefix           = "seq"
+
+	// connectTimeout ограничивает установку соединения, чтобы недоступный Redis не блокировал вызовы
+	connectTimeout = 5 * time.Second
 )
 
 var pool *redis.Pool
@@ -41,16 +44,17 @@ func GetRedisConversationStore(store interfaces.ConversationsProvider) (interfac
 	}
 
 	pool = &redis.Pool{
-		Dial: func() (redis.Conn, error) {
-			conn, err := redis.Dial("tcp", fmt.Sprintf(
+		DialContext: func(ctx context.Context) (redis.Conn, error) {
+			conn, err := redis.DialContext(ctx, "tcp", fmt.Sprintf(
 				"%s:%v",
 				config.MainConfiguration.RedisSettings.Address,
-				config.MainConfiguration.RedisSettings.Port))
+				config.MainConfiguration.RedisSettings.Port),
+				redis.DialConnectTimeout(connectTimeout))
 			if err != nil {
-				log.Panic(err)
+				return nil, err
 			}
 
-			return conn, nil
+			return instrumentedConn{conn}, nil
 		}}
 
 	r := &redisConversationDataStore{
@@ -60,6 +64,22 @@ func GetRedisConversationStore(store interfaces.ConversationsProvider) (interfac
 	return r, nil
 }
 
+// Ping проверяет соединение с Redis, соединение и ответ ограничены ctx
+func Ping(ctx context.Context) error {
+	if pool == nil {
+		return customerrors.ErrArgumentNilError
+	}
+
+	conn, err := pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = redis.DoContext(conn, ctx, "PING")
+	return err
+}
+
 // Close func
 func Close() error {
 	if pool == nil {
@@ -69,8 +89,8 @@ func Close() error {
 	return pool.Close()
 }
 
-func (r redisConversationDataStore) GetByUserID(userID uint) (*[]models.Conversation, error) {
-	return r.conversationsManager.GetByUserID(userID)
+func (r redisConversationDataStore) GetByUserID(userID uint, statuses []string) (*[]models.Conversation, error) {
+	return r.conversationsManager.GetByUserID(userID, statuses)
 }
 func (r redisConversationDataStore) GetByApplicationID(applicationID uint) (*models.Conversation, error) {
 	conn := pool.Get()
@@ -130,6 +150,48 @@ func (r redisConversationDataStore) Add(conversation *models.Conversation) (*mod
 	return r.conversationsManager.Add(conversation)
 }
 
+func (r redisConversationDataStore) SetAssignee(conversationID uint, assigneeID uint, lastAssigneeID uint) error {
+	err := r.conversationsManager.SetAssignee(conversationID, assigneeID, lastAssigneeID)
+	if err != nil {
+		return err
+	}
+
+	redisInvalidateConversation(conversationID)
+	return nil
+}
+
+func (r redisConversationDataStore) SetStatus(conversationID uint, status string) error {
+	err := r.conversationsManager.SetStatus(conversationID, status)
+	if err != nil {
+		return err
+	}
+
+	redisInvalidateConversation(conversationID)
+	return nil
+}
+
+// redisInvalidateConversation сбрасывает закэшированную беседу, чтобы следующее чтение взяло её из базы
+func redisInvalidateConversation(conversationID uint) {
+	conn := pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", chatConversationID(conversationID))
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+// InvalidateConversations сбрасывает закэшированные беседы, например, после удаления данных их участника
+func InvalidateConversations(conversationIDs []uint) {
+	for _, id := range conversationIDs {
+		redisInvalidateConversation(id)
+	}
+}
+
+func (r redisConversationDataStore) CountByAssignee(assigneeID uint) (int, error) {
+	return r.conversationsManager.CountByAssignee(assigneeID)
+}
+
 func redisGet(conn redis.Conn, key string, dest interface{}) error {
 
 	objStr, err := redis.String(conn.Do("GET", key))
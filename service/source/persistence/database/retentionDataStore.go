@@ -0,0 +1,106 @@
+package database
+
+import (
+	"time"
+
+	"github.com/dvgavrilov/gochat/service/source/models"
+	"github.com/jinzhu/gorm"
+)
+
+type retentionDataStore struct {
+	connection *Connection
+}
+
+// CountExpiredMessages считает сообщения, созданные раньше before, и их отметки о прочтении
+func (r retentionDataStore) CountExpiredMessages(scope models.RetentionScope, before time.Time) (int, int, error) {
+	var messages, unreadInfos int
+	err := inScope(r.connection.db.Model(&models.Message{}), "application_id", scope).
+		Where("created_at < ?", before).
+		Count(&messages).Error
+	if err != nil {
+		return 0, 0, err
+	}
+
+	err = inScope(r.connection.db.Model(&models.UnreadInfo{}), "m.application_id", scope).
+		Joins("join messages m on m.id = unread_infos.message_id").
+		Where("m.created_at < ?", before).
+		Count(&unreadInfos).Error
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return messages, unreadInfos, nil
+}
+
+// DeleteExpiredMessages удаляет не больше limit самых старых сообщений, созданных раньше before.
+// Отметки о прочтении ссылаются на сообщения, поэтому удаляются первыми в той же транзакции
+func (r retentionDataStore) DeleteExpiredMessages(scope models.RetentionScope, before time.Time, limit int) (int, int, error) {
+	var messages, unreadInfos int
+	err := transaction(r.connection.db, func(tx *gorm.DB) error {
+		ids := make([]uint, 0)
+		err := inScope(tx.Model(&models.Message{}), "application_id", scope).
+			Where("created_at < ?", before).
+			Order("id").
+			Limit(limit).
+			Pluck("id", &ids).Error
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+
+		res := tx.Where("message_id IN (?)", ids).Delete(&models.UnreadInfo{})
+		if res.Error != nil {
+			return res.Error
+		}
+		unreadInfos = int(res.RowsAffected)
+
+		res = tx.Where("id IN (?)", ids).Delete(&models.Message{})
+		if res.Error != nil {
+			return res.Error
+		}
+		messages = int(res.RowsAffected)
+
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return messages, unreadInfos, nil
+}
+
+// CountResolvedBefore считает беседы, закрытые раньше before
+func (r retentionDataStore) CountResolvedBefore(scope models.RetentionScope, before time.Time) (int, error) {
+	var count int
+	err := inScope(r.connection.db.Model(&models.Conversation{}), "application_id", scope).
+		Where("status = ? AND resolved_at < ?", models.ConversationResolved, before).
+		Count(&count).Error
+
+	return count, err
+}
+
+// GetResolvedBefore возвращает не больше limit бесед, закрытых раньше before
+func (r retentionDataStore) GetResolvedBefore(scope models.RetentionScope, before time.Time, limit int) (*[]models.Conversation, error) {
+	obj := &[]models.Conversation{}
+	err := inScope(r.connection.db, "application_id", scope).
+		Where("status = ? AND resolved_at < ?", models.ConversationResolved, before).
+		Order("id").
+		Limit(limit).
+		Find(obj).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+func inScope(query *gorm.DB, column string, scope models.RetentionScope) *gorm.DB {
+	if scope.ApplicationID != 0 {
+		return query.Where(column+" = ?", scope.ApplicationID)
+	}
+
+	if len(scope.Exclude) > 0 {
+		return query.Where(column+" NOT IN (?)", scope.Exclude)
+	}
+
+	return query
+}
@@ -0,0 +1,55 @@
+package database
+
+import (
+	"time"
+
+	"github.com/dvgavrilov/gochat/service/source/models"
+	"github.com/jinzhu/gorm"
+)
+
+type statsDataStore struct {
+	connection *Connection
+}
+
+func (r statsDataStore) Get(conversationID uint) (*models.ConversationStats, error) {
+	obj := &models.ConversationStats{}
+	err := r.connection.db.Where("conversation_id = ?", conversationID).First(obj).Error
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+// Save создаёт или обновляет показатели беседы
+func (r statsDataStore) Save(stats *models.ConversationStats) error {
+	return r.connection.db.Save(stats).Error
+}
+
+// GetAwaiting возвращает беседы, ждущие ответа модератора, о которых ещё не было предупреждения
+func (r statsDataStore) GetAwaiting() (*[]models.ConversationStats, error) {
+	obj := &[]models.ConversationStats{}
+	err := r.connection.db.Where("awaiting_since IS NOT NULL AND sla_warned = false").Find(obj).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+// GetByPeriod возвращает показатели бесед, клиент которых впервые написал в период [from, to)
+func (r statsDataStore) GetByPeriod(from time.Time, to time.Time) (*[]models.ConversationStats, error) {
+	obj := &[]models.ConversationStats{}
+	err := r.connection.db.
+		Where("first_customer_message_at >= ? AND first_customer_message_at < ?", from, to).
+		Order("first_customer_message_at").
+		Find(obj).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return obj, nil
+}
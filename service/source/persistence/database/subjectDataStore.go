@@ -0,0 +1,163 @@
+package database
+
+import (
+	"github.com/dvgavrilov/gochat/service/source/models"
+	"github.com/jinzhu/gorm"
+)
+
+type subjectDataStore struct {
+	connection *Connection
+}
+
+// GetConversations возвращает беседы, в которых пользователь участвовал, писал или был ответственным
+func (r subjectDataStore) GetConversations(userID uint) (*[]models.Conversation, error) {
+	obj := &[]models.Conversation{}
+	err := r.connection.db.Where(`id IN (?) OR id IN (?) OR assignee_id = ? OR last_assignee_id = ?`,
+		r.connection.db.Model(&models.Participant{}).Select("conversation_id").Where("user_id = ?", userID).QueryExpr(),
+		r.connection.db.Model(&models.Message{}).Select("conversation_id").Where("sender_id = ?", userID).QueryExpr(),
+		userID, userID).
+		Order("id").
+		Find(obj).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+// GetSentMessages возвращает не больше limit сообщений пользователя с id больше afterID, включая внутренние заметки
+func (r subjectDataStore) GetSentMessages(userID uint, afterID uint, limit int) (*[]models.Message, error) {
+	obj := &[]models.Message{}
+	err := r.connection.db.Where("sender_id = ? AND id > ?", userID, afterID).
+		Order("id").
+		Limit(limit).
+		Find(obj).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return decryptMessages(obj)
+}
+
+// GetUnreadInfos возвращает не больше limit отметок о прочтении пользователя, начиная с сообщения после afterMessageID
+func (r subjectDataStore) GetUnreadInfos(userID uint, afterMessageID uint, limit int) (*[]models.UnreadInfo, error) {
+	obj := &[]models.UnreadInfo{}
+	err := r.connection.db.Where("participant_id = ? AND message_id > ?", userID, afterMessageID).
+		Order("message_id").
+		Limit(limit).
+		Find(obj).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+func (r subjectDataStore) GetTransfers(userID uint) (*[]models.Transfer, error) {
+	obj := &[]models.Transfer{}
+	err := r.connection.db.Where("from_id = ? OR to_id = ?", userID, userID).Order("id").Find(obj).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+func (r subjectDataStore) GetCannedResponses(ownerID uint) (*[]models.CannedResponse, error) {
+	obj := &[]models.CannedResponse{}
+	err := r.connection.db.Where("owner_id = ?", ownerID).Order("id").Find(obj).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+// Erase func. Отметки о прочтении ссылаются на сообщения, поэтому при удалении сообщений
+// сначала удаляются их отметки у всех участников, иначе счётчики непрочитанного разойдутся с историей.
+// Командные заготовки ответов остаются команде без владельца, личные удаляются.
+func (r subjectDataStore) Erase(userID uint, pseudonymize bool, placeholder string) (*models.ErasureResult, error) {
+	conversations, err := r.GetConversations(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &models.ErasureResult{ConversationIDs: make([]uint, 0, len(*conversations))}
+	for _, c := range *conversations {
+		ret.ConversationIDs = append(ret.ConversationIDs, c.ID)
+	}
+
+	err = transaction(r.connection.db, func(tx *gorm.DB) error {
+		sent := tx.Model(&models.Message{}).Select("id").Where("sender_id = ?", userID).QueryExpr()
+
+		var res *gorm.DB
+		if pseudonymize {
+			res = tx.Model(&models.Message{}).Where("sender_id = ?", userID).Updates(map[string]interface{}{
+				"sender_id":    0,
+				"content":      placeholder,
+				"content_type": models.ContentText,
+				"key_version":  0,
+				"data_key":     "",
+			})
+		} else {
+			res = tx.Where("message_id IN (?)", sent).Delete(&models.UnreadInfo{})
+			if res.Error != nil {
+				return res.Error
+			}
+			ret.UnreadInfos += int(res.RowsAffected)
+
+			res = tx.Where("sender_id = ?", userID).Delete(&models.Message{})
+		}
+		if res.Error != nil {
+			return res.Error
+		}
+		ret.Messages = int(res.RowsAffected)
+
+		res = tx.Where("participant_id = ?", userID).Delete(&models.UnreadInfo{})
+		if res.Error != nil {
+			return res.Error
+		}
+		ret.UnreadInfos += int(res.RowsAffected)
+
+		res = tx.Where("user_id = ?", userID).Delete(&models.Participant{})
+		if res.Error != nil {
+			return res.Error
+		}
+		ret.Participants = int(res.RowsAffected)
+
+		for _, column := range []string{"assignee_id", "last_assignee_id"} {
+			res = tx.Model(&models.Conversation{}).Where(column+" = ?", userID).Update(column, 0)
+			if res.Error != nil {
+				return res.Error
+			}
+			ret.Assignments += int(res.RowsAffected)
+		}
+
+		for _, column := range []string{"from_id", "to_id"} {
+			res = tx.Model(&models.Transfer{}).Where(column+" = ?", userID).Update(column, 0)
+			if res.Error != nil {
+				return res.Error
+			}
+			ret.Transfers += int(res.RowsAffected)
+		}
+
+		res = tx.Where("owner_id = ? AND team = ''", userID).Delete(&models.CannedResponse{})
+		if res.Error != nil {
+			return res.Error
+		}
+		ret.CannedResponses = int(res.RowsAffected)
+
+		res = tx.Model(&models.CannedResponse{}).Where("owner_id = ?", userID).Update("owner_id", 0)
+		if res.Error != nil {
+			return res.Error
+		}
+		ret.CannedResponses += int(res.RowsAffected)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
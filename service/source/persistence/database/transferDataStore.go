@@ -0,0 +1,21 @@
+package database
+
+import "github.com/dvgavrilov/gochat/service/source/models"
+
+type transferDataStore struct {
+	connection *Connection
+}
+
+func (r transferDataStore) Add(transfer *models.Transfer) error {
+	return r.connection.db.Create(transfer).Error
+}
+
+func (r transferDataStore) GetByConversationID(conversationID uint) (*[]models.Transfer, error) {
+	obj := &[]models.Transfer{}
+	err := r.connection.db.Where("conversation_id = ?", conversationID).Order("created_at, id").Find(obj).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return obj, nil
+}
@@ -30,16 +30,21 @@ func (r unreadInfoDataStore) GetByMessageID(messageID uint) (*[]models.UnreadInf
 	return obj, nil
 }
 
-func (r unreadInfoDataStore) GetForUser(participantID uint) (int, error) {
+func (r unreadInfoDataStore) GetForUser(participantID uint, includeInternal bool) (int, error) {
 	var count int
-	err := r.connection.db.Model(&models.UnreadInfo{}).
+	query := r.connection.db.Model(&models.UnreadInfo{}).
 		Select("count(distinct(message_id))").
 		Where(
 			`
 			read = false 
 			AND
 			participant_id = ?
-			`, participantID).Count(&count).Error
+			`, participantID)
+	if !includeInternal {
+		query = query.Joins("join messages m on m.id = unread_infos.message_id").Where("m.internal = false")
+	}
+
+	err := query.Count(&count).Error
 
 	return count, err
 }
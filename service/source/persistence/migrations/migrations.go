@@ -7,19 +7,49 @@ import (
 
 func Migrate(db *gorm.DB) error {
 
-	db.AutoMigrate(&models.Message{}, &models.Conversation{}, &models.Participant{}, &models.UnreadInfo{})
+	db.AutoMigrate(&models.Message{}, &models.Conversation{}, &models.Participant{}, &models.UnreadInfo{}, &models.Transfer{}, &models.CannedResponse{}, &models.ConversationStats{}, &models.AuditEntry{})
 
 	db.Model(&models.Conversation{}).AddUniqueIndex("idx_id_appid", "id", "application_id")
 	db.Model(&models.Conversation{}).AddUniqueIndex("idx_appid", "application_id")
+	db.Model(&models.Conversation{}).AddIndex("idx_assignee", "assignee_id")
+	db.Model(&models.Conversation{}).AddIndex("idx_status", "status")
+	db.Model(&models.Conversation{}).AddIndex("idx_status_resolved", "status", "resolved_at")
+	// беседам, закрытым до появления resolved_at, время закрытия переносится из статистики
+	db.Exec(`UPDATE conversations c SET resolved_at = COALESCE(
+		(SELECT s.resolved_at FROM conversation_stats s WHERE s.conversation_id = c.id), c.updated_at)
+		WHERE c.status IN (?, ?) AND c.resolved_at IS NULL`, models.ConversationResolved, models.ConversationArchived)
 
 	db.Model(&models.Message{}).AddForeignKey("conversation_id", "conversations(id)", "RESTRICT", "RESTRICT")
 	db.Model(&models.Message{}).AddForeignKey("application_id", "conversations(application_id)", "RESTRICT", "RESTRICT")
+	db.Model(&models.Message{}).AddIndex("idx_message_convid_id", "conversation_id", "id")
+	db.Model(&models.Message{}).AddIndex("idx_message_appid_created", "application_id", "created_at")
+	db.Model(&models.Message{}).AddIndex("idx_message_key_version", "key_version")
+	// зашифрованное содержимое длиннее исходного, а AutoMigrate не меняет тип существующей колонки
+	db.Exec("ALTER TABLE messages ALTER COLUMN content TYPE text")
 
 	db.Model(&models.Participant{}).AddForeignKey("conversation_id", "conversations(id)", "RESTRICT", "RESTRICT")
 
 	db.Model(&models.UnreadInfo{}).AddForeignKey("conversation_id", "conversations(id)", "RESTRICT", "RESTRICT")
 	db.Model(&models.UnreadInfo{}).AddForeignKey("message_id", "messages(id)", "RESTRICT", "RESTRICT")
 
+	db.Model(&models.Transfer{}).AddForeignKey("conversation_id", "conversations(id)", "RESTRICT", "RESTRICT")
+	db.Model(&models.Transfer{}).AddIndex("idx_transfer_convid", "conversation_id")
+
+	db.Model(&models.CannedResponse{}).AddIndex("idx_canned_owner", "owner_id")
+	db.Model(&models.CannedResponse{}).AddIndex("idx_canned_team", "team")
+
+	db.Model(&models.ConversationStats{}).AddForeignKey("conversation_id", "conversations(id)", "RESTRICT", "RESTRICT")
+	db.Model(&models.ConversationStats{}).AddIndex("idx_stats_awaiting", "awaiting_since")
+	db.Model(&models.ConversationStats{}).AddIndex("idx_stats_first_message", "first_customer_message_at")
+
+	db.Model(&models.AuditEntry{}).AddIndex("idx_audit_actor", "actor_id", "created_at")
+	db.Model(&models.AuditEntry{}).AddIndex("idx_audit_target", "target_type", "target_id", "created_at")
+	db.Model(&models.AuditEntry{}).AddIndex("idx_audit_created", "created_at")
+
+	// журнал аудита только пополняется, изменения и удаления игнорируются на уровне базы
+	db.Exec("CREATE OR REPLACE RULE audit_entries_no_update AS ON UPDATE TO audit_entries DO INSTEAD NOTHING")
+	db.Exec("CREATE OR REPLACE RULE audit_entries_no_delete AS ON DELETE TO audit_entries DO INSTEAD NOTHING")
+
 	db.Model(&models.Participant{}).AddUniqueIndex("idx_convid_userid", "conversation_id", "user_id")
 
 	return nil
@@ -0,0 +1,93 @@
+package persistence
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dvgavrilov/gochat/service/source/config"
+	"github.com/dvgavrilov/gochat/service/source/encryption"
+	"github.com/sirupsen/logrus"
+)
+
+// ReencryptionReport результат одного прохода перешифрования
+type ReencryptionReport struct {
+	StartedAt   time.Time `json:"started_at"`
+	FinishedAt  time.Time `json:"finished_at"`
+	KeyVersion  uint      `json:"key_version"`
+	Reencrypted int       `json:"reencrypted"`
+	Error       string    `json:"error,omitempty"`
+}
+
+var (
+	reencryptMux      sync.Mutex
+	reencryptStop     = make(chan struct{})
+	reencryptStopOnce sync.Once
+)
+
+// StartReencryption раз в EncryptionSettings.ReencryptInterval переводит сообщения на активный ключ,
+// так же шифруются сообщения, сохранённые до включения шифрования
+func StartReencryption() {
+	go func() {
+		interval := time.Duration(config.MainConfiguration.EncryptionSettings.ReencryptInterval) * time.Second
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-reencryptStop:
+				return
+			case <-ticker.C:
+				if encryption.ActiveVersion() != 0 {
+					Reencrypt()
+				}
+			}
+		}
+	}()
+}
+
+// StopReencryption останавливает перешифрование и дожидается окончания текущей пачки
+func StopReencryption() {
+	reencryptStopOnce.Do(func() { close(reencryptStop) })
+
+	reencryptMux.Lock()
+	defer reencryptMux.Unlock()
+}
+
+// Reencrypt проходит все сообщения с неактивной версией ключа пачками по EncryptionSettings.ReencryptBatchSize
+func Reencrypt() *ReencryptionReport {
+	reencryptMux.Lock()
+	defer reencryptMux.Unlock()
+
+	report := &ReencryptionReport{StartedAt: time.Now().UTC(), KeyVersion: encryption.ActiveVersion()}
+	defer func() { report.FinishedAt = time.Now().UTC() }()
+
+	limit := config.Current().EncryptionSettings.ReencryptBatchSize
+	var afterID uint
+	for {
+		select {
+		case <-reencryptStop:
+			return report
+		default:
+		}
+
+		lastID, count, err := GetMessageKeysProvider().Reencrypt(afterID, limit)
+		report.Reencrypted += count
+		if err != nil {
+			logrus.Error(err)
+			report.Error = err.Error()
+			return report
+		}
+
+		if lastID == 0 {
+			break
+		}
+		afterID = lastID
+	}
+
+	if report.Reencrypted > 0 {
+		logrus.Info(fmt.Sprintf("%v messages were re-encrypted with key version %v", report.Reencrypted, report.KeyVersion))
+	}
+
+	return report
+}
@@ -0,0 +1,252 @@
+// Package privacy выполняет запросы пользователей на выгрузку и удаление их данных
+package privacy
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+
+	"github.com/dvgavrilov/gochat/service/source/audit"
+	"github.com/dvgavrilov/gochat/service/source/models"
+	"github.com/dvgavrilov/gochat/service/source/persistence"
+)
+
+// Способы удаления данных
+const (
+	ModeDelete       = "delete"
+	ModePseudonymize = "pseudonymize"
+)
+
+// ErasedPlaceholder текст, которым заменяются сообщения при псевдонимизации
+const ErasedPlaceholder = "[removed at the user's request]"
+
+const pageSize = 500
+
+var (
+	// ErrErasureMode error
+	ErrErasureMode = errors.New("erasure mode must be delete or pseudonymize")
+)
+
+// ErasureReport результат удаления данных пользователя
+type ErasureReport struct {
+	UserID   uint                  `json:"user_id"`
+	Mode     string                `json:"mode"`
+	ErasedAt time.Time             `json:"erased_at"`
+	Result   *models.ErasureResult `json:"result"`
+	// Retained данные, которые не удаляются: журнал аудита только пополняется
+	Retained []string `json:"retained"`
+}
+
+type manifest struct {
+	UserID     uint      `json:"user_id"`
+	ExportedAt time.Time `json:"exported_at"`
+	Files      []string  `json:"files"`
+}
+
+// Export пишет в w zip архив со всеми данными пользователя, по json файлу на вид данных.
+// Сообщения, отметки о прочтении и записи аудита читаются постранично
+func Export(w io.Writer, userID uint) error {
+	store := persistence.GetSubjectProvider()
+	archive := zip.NewWriter(w)
+
+	files := []struct {
+		name  string
+		write func(out *arrayWriter) error
+	}{
+		{"conversations.json", func(out *arrayWriter) error {
+			conversations, err := store.GetConversations(userID)
+			if err != nil {
+				return err
+			}
+			for i := range *conversations {
+				(*conversations)[i].Participants = nil
+				if err = out.add(&(*conversations)[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+		{"messages.json", func(out *arrayWriter) error {
+			var afterID uint
+			for {
+				messages, err := store.GetSentMessages(userID, afterID, pageSize)
+				if err != nil {
+					return err
+				}
+				for i := range *messages {
+					if err = out.add(&(*messages)[i]); err != nil {
+						return err
+					}
+				}
+				if len(*messages) < pageSize {
+					return nil
+				}
+				afterID = (*messages)[len(*messages)-1].ID
+			}
+		}},
+		{"unread_infos.json", func(out *arrayWriter) error {
+			var afterID uint
+			for {
+				infos, err := store.GetUnreadInfos(userID, afterID, pageSize)
+				if err != nil {
+					return err
+				}
+				for i := range *infos {
+					if err = out.add(&(*infos)[i]); err != nil {
+						return err
+					}
+				}
+				if len(*infos) < pageSize {
+					return nil
+				}
+				afterID = (*infos)[len(*infos)-1].MessageID
+			}
+		}},
+		{"transfers.json", func(out *arrayWriter) error {
+			transfers, err := store.GetTransfers(userID)
+			if err != nil {
+				return err
+			}
+			return out.addAll(*transfers)
+		}},
+		{"canned_responses.json", func(out *arrayWriter) error {
+			responses, err := store.GetCannedResponses(userID)
+			if err != nil {
+				return err
+			}
+			return out.addAll(*responses)
+		}},
+		{"audit_entries.json", func(out *arrayWriter) error {
+			err := exportAudit(out, models.AuditFilter{ActorID: userID})
+			if err != nil {
+				return err
+			}
+			return exportAudit(out, models.AuditFilter{TargetType: audit.TargetUser, TargetID: fmt.Sprintf("%v", userID)})
+		}},
+	}
+
+	m := manifest{UserID: userID, ExportedAt: time.Now().UTC()}
+	for _, f := range files {
+		entry, err := archive.Create(f.name)
+		if err != nil {
+			return err
+		}
+
+		out := &arrayWriter{w: entry}
+		err = f.write(out)
+		if err != nil {
+			return err
+		}
+
+		err = out.close()
+		if err != nil {
+			return err
+		}
+		m.Files = append(m.Files, f.name)
+	}
+
+	entry, err := archive.Create("manifest.json")
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(entry).Encode(m)
+	if err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+// Erase удаляет данные пользователя способом mode и сбрасывает кэш затронутых бесед.
+// Беседы остаются у остальных участников: при удалении пропадают только сообщения пользователя
+// вместе с отметками о прочтении, при псевдонимизации остаются и они, но без автора и текста
+func Erase(userID uint, mode string) (*ErasureReport, error) {
+	if mode != ModeDelete && mode != ModePseudonymize {
+		return nil, ErrErasureMode
+	}
+
+	result, err := persistence.GetSubjectProvider().Erase(userID, mode == ModePseudonymize, ErasedPlaceholder)
+	if err != nil {
+		return nil, err
+	}
+
+	persistence.InvalidateConversationCache(result.ConversationIDs)
+
+	return &ErasureReport{
+		UserID:   userID,
+		Mode:     mode,
+		ErasedAt: time.Now().UTC(),
+		Result:   result,
+		Retained: []string{"audit_entries"},
+	}, nil
+}
+
+func exportAudit(out *arrayWriter, filter models.AuditFilter) error {
+	filter.Limit = pageSize
+	for {
+		entries, err := audit.Find(filter)
+		if err != nil {
+			return err
+		}
+
+		err = out.addAll(*entries)
+		if err != nil {
+			return err
+		}
+
+		if len(*entries) < pageSize {
+			return nil
+		}
+		filter.Offset += pageSize
+	}
+}
+
+// arrayWriter пишет json массив по одному элементу, не собирая его в памяти
+type arrayWriter struct {
+	w       io.Writer
+	written int
+}
+
+func (a *arrayWriter) add(v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	prefix := ","
+	if a.written == 0 {
+		prefix = "["
+	}
+	a.written++
+
+	_, err = a.w.Write(append([]byte(prefix), raw...))
+	return err
+}
+
+// addAll добавляет все элементы среза values
+func (a *arrayWriter) addAll(values interface{}) error {
+	v := reflect.ValueOf(values)
+	for i := 0; i < v.Len(); i++ {
+		err := a.add(v.Index(i).Addr().Interface())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (a *arrayWriter) close() error {
+	end := "]"
+	if a.written == 0 {
+		end = "[]"
+	}
+
+	_, err := io.WriteString(a.w, end)
+	return err
+}
@@ -0,0 +1,253 @@
+// Package retention удаляет устаревшие данные по политикам RetentionSettings
+package retention
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dvgavrilov/gochat/service/source/audit"
+	"github.com/dvgavrilov/gochat/service/source/config"
+	"github.com/dvgavrilov/gochat/service/source/models"
+	"github.com/dvgavrilov/gochat/service/source/persistence"
+	"github.com/sirupsen/logrus"
+)
+
+const day = 24 * time.Hour
+
+// Report результат одного запуска очистки. При DryRun счётчики показывают, что было бы удалено
+type Report struct {
+	StartedAt  time.Time       `json:"started_at"`
+	FinishedAt time.Time       `json:"finished_at"`
+	DryRun     bool            `json:"dry_run"`
+	Policies   []*PolicyReport `json:"policies"`
+	Errors     []string        `json:"errors,omitempty"`
+}
+
+// PolicyReport результат применения одной политики, нулевой ApplicationID означает глобальную политику
+type PolicyReport struct {
+	ApplicationID         uint       `json:"application_id"`
+	MessagesBefore        *time.Time `json:"messages_before,omitempty"`
+	Messages              int        `json:"messages"`
+	UnreadInfos           int        `json:"unread_infos"`
+	ArchiveBefore         *time.Time `json:"archive_before,omitempty"`
+	ArchivedConversations int        `json:"archived_conversations"`
+}
+
+func (p *PolicyReport) empty() bool {
+	return p.Messages == 0 && p.UnreadInfos == 0 && p.ArchivedConversations == 0
+}
+
+var (
+	// runMux не даёт запуску по расписанию и ручному запуску идти одновременно
+	runMux     sync.Mutex
+	lastReport *Report
+	reportMux  sync.RWMutex
+
+	stop     = make(chan struct{})
+	stopOnce sync.Once
+)
+
+// Start запускает очистку каждые RetentionSettings.CheckInterval секунд до вызова Stop
+func Start() {
+	go func() {
+		interval := time.Duration(config.MainConfiguration.RetentionSettings.CheckInterval) * time.Second
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				Run(audit.Actor{Role: "system"}, config.Current().RetentionSettings.DryRun)
+			}
+		}
+	}()
+}
+
+// Stop останавливает запуски по расписанию и дожидается, пока уже начатая очистка
+// доведёт текущую пачку до конца, чтобы после возврата можно было закрыть базу
+func Stop() {
+	stopOnce.Do(func() { close(stop) })
+
+	runMux.Lock()
+	defer runMux.Unlock()
+}
+
+// LastReport отчёт последнего запуска, nil если очистка ещё не запускалась
+func LastReport() *Report {
+	reportMux.RLock()
+	defer reportMux.RUnlock()
+
+	return lastReport
+}
+
+// Run применяет все политики хранения. Ошибка одной политики не останавливает остальные
+// и попадает в Report.Errors
+func Run(actor audit.Actor, dryRun bool) *Report {
+	runMux.Lock()
+	defer runMux.Unlock()
+
+	settings := config.Current().RetentionSettings
+	report := &Report{
+		StartedAt: time.Now().UTC(),
+		DryRun:    dryRun,
+		Policies:  make([]*PolicyReport, 0),
+		Errors:    make([]string, 0),
+	}
+
+	apps := make([]uint, 0, len(settings.Applications))
+	for key := range settings.Applications {
+		id, _ := strconv.ParseUint(key, 10, 32)
+		apps = append(apps, uint(id))
+	}
+	sort.Slice(apps, func(i, j int) bool { return apps[i] < apps[j] })
+
+	global := config.RetentionPolicy{
+		MessageDays:         settings.MessageDays,
+		ArchiveResolvedDays: settings.ArchiveResolvedDays,
+	}
+	report.apply(models.RetentionScope{Exclude: apps}, global, settings.BatchSize)
+
+	for _, app := range apps {
+		policy := settings.Applications[strconv.FormatUint(uint64(app), 10)]
+		report.apply(models.RetentionScope{ApplicationID: app}, policy, settings.BatchSize)
+	}
+
+	report.FinishedAt = time.Now().UTC()
+	report.log()
+
+	if actor.ID != 0 || (!dryRun && report.removed()) {
+		audit.Record(actor, audit.RetentionPurge, audit.TargetConfig, "retention",
+			map[string]interface{}{"dry_run": dryRun, "policies": report.Policies, "errors": report.Errors})
+	}
+
+	reportMux.Lock()
+	lastReport = report
+	reportMux.Unlock()
+
+	return report
+}
+
+func (r *Report) apply(scope models.RetentionScope, policy config.RetentionPolicy, batchSize int) {
+	if policy.MessageDays == 0 && policy.ArchiveResolvedDays == 0 {
+		return
+	}
+
+	p := &PolicyReport{ApplicationID: scope.ApplicationID}
+	r.Policies = append(r.Policies, p)
+
+	if policy.MessageDays > 0 {
+		before := r.StartedAt.Add(-time.Duration(policy.MessageDays) * day)
+		p.MessagesBefore = &before
+
+		err := purgeMessages(p, scope, before, batchSize, r.DryRun)
+		if err != nil {
+			r.fail(scope, "messages", err)
+		}
+	}
+
+	if policy.ArchiveResolvedDays > 0 {
+		before := r.StartedAt.Add(-time.Duration(policy.ArchiveResolvedDays) * day)
+		p.ArchiveBefore = &before
+
+		err := archiveResolved(p, scope, before, batchSize, r.DryRun)
+		if err != nil {
+			r.fail(scope, "conversations", err)
+		}
+	}
+}
+
+func purgeMessages(p *PolicyReport, scope models.RetentionScope, before time.Time, batchSize int, dryRun bool) error {
+	store := persistence.GetRetentionProvider()
+	if dryRun {
+		messages, unreadInfos, err := store.CountExpiredMessages(scope, before)
+		p.Messages, p.UnreadInfos = messages, unreadInfos
+		return err
+	}
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+
+		messages, unreadInfos, err := store.DeleteExpiredMessages(scope, before, batchSize)
+		if err != nil {
+			return err
+		}
+
+		p.Messages += messages
+		p.UnreadInfos += unreadInfos
+		if messages < batchSize {
+			return nil
+		}
+	}
+}
+
+// archiveResolved меняет состояние через ConversationsProvider, чтобы обновился и кэш бесед
+func archiveResolved(p *PolicyReport, scope models.RetentionScope, before time.Time, batchSize int, dryRun bool) error {
+	store := persistence.GetRetentionProvider()
+	if dryRun {
+		count, err := store.CountResolvedBefore(scope, before)
+		p.ArchivedConversations = count
+		return err
+	}
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+
+		conversations, err := store.GetResolvedBefore(scope, before, batchSize)
+		if err != nil {
+			return err
+		}
+
+		for _, conv := range *conversations {
+			err = persistence.GetConversationsProvider().SetStatus(conv.ID, models.ConversationArchived)
+			if err != nil {
+				return err
+			}
+			p.ArchivedConversations++
+		}
+
+		if len(*conversations) < batchSize {
+			return nil
+		}
+	}
+}
+
+func (r *Report) fail(scope models.RetentionScope, what string, err error) {
+	logrus.Error(err)
+	r.Errors = append(r.Errors, fmt.Sprintf("application %v, %s: %v", scope.ApplicationID, what, err))
+}
+
+func (r *Report) removed() bool {
+	for _, p := range r.Policies {
+		if !p.empty() {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *Report) log() {
+	for _, p := range r.Policies {
+		logrus.WithFields(logrus.Fields{
+			"retention":              "purge",
+			"dry_run":                r.DryRun,
+			"application_id":         p.ApplicationID,
+			"messages":               p.Messages,
+			"unread_infos":           p.UnreadInfos,
+			"archived_conversations": p.ArchivedConversations,
+		}).Info("retention policy applied")
+	}
+}
@@ -0,0 +1,183 @@
+package route
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dvgavrilov/gochat/service/source/audit"
+	"github.com/dvgavrilov/gochat/service/source/messaging"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/jwtauth"
+	"github.com/go-chi/render"
+)
+
+// Действия административного API в матрице PermissionSettings
+const (
+	viewHubAction      = "Admin.ViewHub"
+	disconnectAction   = "Admin.DisconnectChatter"
+	manageRoomsAction  = "Admin.ManageRooms"
+	announcementAction = "Admin.Announce"
+	viewAuditAction    = "Admin.ViewAudit"
+)
+
+var (
+	// ErrUserIDInvalid error
+	ErrUserIDInvalid = errors.New("user id is missing or invalid")
+	// ErrAnnouncementEmpty error
+	ErrAnnouncementEmpty = errors.New("announcement text is required")
+)
+
+type disconnectArgs struct {
+	Reason string `json:"reason"`
+}
+
+type announcementArgs struct {
+	Text string `json:"text"`
+	// Room пустая, чтобы отправить объявление всем чаттерам
+	Room string `json:"room"`
+}
+
+type adminResult struct {
+	Ok       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+	Affected int    `json:"affected"`
+}
+
+func registerAdminRoutes(r chi.Router) {
+	r.Route("/admin", func(r chi.Router) {
+		r.With(requireAction(reloadConfigurationAction)).Post("/config/reload", onReloadConfiguration)
+		r.With(requireAction(viewHubAction)).Get("/chatters", onListChatters)
+		r.With(requireAction(viewHubAction)).Get("/rooms", onListRooms)
+		r.With(requireAction(disconnectAction)).Post("/chatters/{userID}/disconnect", onDisconnectChatter)
+		r.With(requireAction(manageRoomsAction)).Delete("/rooms/{roomID}/members/{userID}", onRemoveFromRoom)
+		r.With(requireAction(announcementAction)).Post("/announcements", onAnnounce)
+		r.With(requireAction(viewAuditAction)).Get("/audit", onQueryAudit)
+		r.With(requireAction(viewAuditAction)).Get("/audit/export", onExportAudit)
+		r.With(requireAction(manageRetentionAction)).Get("/retention/report", onRetentionReport)
+		r.With(requireAction(manageRetentionAction)).Post("/retention/run", onRetentionRun)
+		r.With(requireAction(exportUserDataAction)).Get("/users/{userID}/export", onExportUserData)
+		r.With(requireAction(eraseUserDataAction)).Post("/users/{userID}/erase", onEraseUserData)
+		r.With(requireAction(manageEncryptionAction)).Get("/encryption", onEncryptionStatus)
+		r.With(requireAction(manageEncryptionAction)).Post("/encryption/reencrypt", onReencrypt)
+	})
+}
+
+// requireAction пропускает запрос, только если роли из токена разрешено действие action
+func requireAction(action string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !isAllowed(r, action) {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func isAllowed(r *http.Request, action string) bool {
+	_, claims, _ := jwtauth.FromContext(r.Context())
+	role, err := messaging.RoleFromClaims(claims)
+	return err == nil && messaging.IsAllowed(role, action)
+}
+
+func onListChatters(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, messaging.ListChatters())
+}
+
+func onListRooms(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, messaging.ListRooms())
+}
+
+func onDisconnectChatter(w http.ResponseWriter, r *http.Request) {
+	userID, err := urlUserID(r)
+	if err != nil {
+		adminError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	args := &disconnectArgs{}
+	if r.ContentLength != 0 {
+		err = json.NewDecoder(r.Body).Decode(args)
+		if err != nil {
+			adminError(w, r, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	if args.Reason == "" {
+		args.Reason = "disconnected by an administrator"
+	}
+
+	closed := messaging.DisconnectUser(userID, args.Reason)
+	audit.Record(messaging.ActorFromRequest(r), audit.AdminDisconnect, audit.TargetUser, userID,
+		map[string]interface{}{"reason": args.Reason, "sockets": closed, "user_agent": r.UserAgent()})
+	render.JSON(w, r, adminResult{Ok: true, Affected: closed})
+}
+
+func onRemoveFromRoom(w http.ResponseWriter, r *http.Request) {
+	userID, err := urlUserID(r)
+	if err != nil {
+		adminError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	room := chi.URLParam(r, "roomID")
+	removed, err := messaging.RemoveFromRoom(userID, room)
+	if err == messaging.ErrChatRoomNotFound {
+		adminError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		adminError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	audit.Record(messaging.ActorFromRequest(r), audit.AdminRemoveFromRoom, audit.TargetUser, userID,
+		map[string]interface{}{"room": room, "sockets": removed, "user_agent": r.UserAgent()})
+
+	render.JSON(w, r, adminResult{Ok: true, Affected: removed})
+}
+
+func onAnnounce(w http.ResponseWriter, r *http.Request) {
+	args := &announcementArgs{}
+	err := json.NewDecoder(r.Body).Decode(args)
+	if err != nil {
+		adminError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	if strings.TrimSpace(args.Text) == "" {
+		adminError(w, r, http.StatusBadRequest, ErrAnnouncementEmpty)
+		return
+	}
+
+	recipients, err := messaging.Announce(args.Text, args.Room)
+	if err != nil {
+		adminError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	audit.Record(messaging.ActorFromRequest(r), audit.AdminAnnouncement, audit.TargetRoom, args.Room,
+		map[string]interface{}{"text": args.Text, "recipients": recipients, "user_agent": r.UserAgent()})
+
+	render.JSON(w, r, adminResult{Ok: true, Affected: recipients})
+}
+
+func urlUserID(r *http.Request) (uint, error) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "userID"), 10, 32)
+	if err != nil || id == 0 {
+		return 0, ErrUserIDInvalid
+	}
+
+	return uint(id), nil
+}
+
+func adminError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	render.Status(r, status)
+	render.JSON(w, r, adminResult{Ok: false, Error: err.Error()})
+}
@@ -1,21 +1,32 @@
 package route
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"log"
 	"net/http"
-	"strconv"
 
 	"github.com/dvgavrilov/gochat/service/source/config"
 	"github.com/dvgavrilov/gochat/service/source/logs"
 	"github.com/dvgavrilov/gochat/service/source/messaging"
+	"github.com/dvgavrilov/gochat/service/source/persistence"
+	"github.com/dvgavrilov/gochat/service/source/retention"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/render"
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	defaultShutdownTimeout = 30 * time.Second
+	// serverShutdownTimeout время на закрытие HTTP соединений после того, как сокеты закрыты
+	serverShutdownTimeout = 5 * time.Second
+)
+
 var router *chi.Mux
 
 // RegisterRoutes функция
@@ -31,23 +42,107 @@ func RegisterRoutes() error {
 	router.Use(logs.NewStructuredLogger(logger))
 	router.Use(middleware.Logger)
 
-	messaging.Init(router)
+	// проверки состояния вызывает оркестратор, токена у него нет
+	router.Get("/healthz", onLiveness)
+	router.Get("/readyz", onReadiness)
+	// сборщик метрик тоже работает без токена, доступ ограничивают MetricsSettings
+	router.Get("/metrics", onMetrics)
+
+	var err error
+	router.Group(func(r chi.Router) {
+		err = messaging.Init(r)
+
+		r.With(requireAction(slaReportAction)).Get("/reports/sla", onSLAReport)
+		r.With(requireAction(messaging.ExportTranscriptAction)).Get("/conversations/{sessionChannel}/transcript", onExportTranscript)
+		registerAdminRoutes(r)
+	})
 
-	debugStatus, err := strconv.ParseBool(config.MainConfiguration.ApplicationSettings.DebugMode)
 	if err != nil {
-		log.Println("error with reading config file", err.Error())
+		return err
+	}
+
+	retention.Start()
+	persistence.StartReencryption()
+
+	stopReload := make(chan struct{})
+	defer close(stopReload)
+	go watchConfigReload(stopReload)
+
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%v", config.MainConfiguration.WebSocketSettings.Port),
+		Handler: router,
 	}
 
-	if debugStatus {
+	serverErr := make(chan error, 1)
+	if config.MainConfiguration.ApplicationSettings.DebugMode {
 		fmt.Println(fmt.Sprintf("start listening http at port %v", config.MainConfiguration.WebSocketSettings.Port))
-		http.ListenAndServe(fmt.Sprintf(":%v", config.MainConfiguration.WebSocketSettings.Port), router)
+		go func() {
+			serverErr <- server.ListenAndServe()
+		}()
 	} else {
+		reloader, err := newCertificateReloader(config.MainConfiguration.TLSSettings)
+		if err != nil {
+			return err
+		}
+
+		stopWatch := make(chan struct{})
+		defer close(stopWatch)
+		go reloader.watch(stopWatch)
+
+		server.TLSConfig = reloader.tlsConfig()
+
 		fmt.Println(fmt.Sprintf("start listening https at port %v", config.MainConfiguration.WebSocketSettings.Port))
-		// err = http.ListenAndServeTLS(":8090", "cert file", "keyfile")
-		// if err != nil {
-		// 	return err
-		// }
+		go func() {
+			serverErr <- server.ListenAndServeTLS("", "")
+		}()
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	select {
+	case err := <-serverErr:
+		if err != http.ErrServerClosed {
+			return err
+		}
+		return nil
+	case sig := <-stop:
+		logrus.Info(fmt.Sprintf("received %v signal, shutting down", sig))
+	}
+
+	return shutdown(server)
+}
+
+// shutdown останавливает приём новых соединений, закрывает все web socket соединения
+// и дожидается завершения обработчиков, но не дольше ShutdownTimeout. Истёкшее ожидание
+// не считается ошибкой: сервер всё равно останавливается и main закрывает базу
+func shutdown(server *http.Server) error {
+	timeout := time.Duration(config.Current().ApplicationSettings.ShutdownTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	retention.Stop()
+	persistence.StopReencryption()
+
+	err := messaging.Shutdown(ctx)
+	if err != nil {
+		logrus.Warn(fmt.Sprintf("web sockets were not drained in %v: %v", timeout, err))
+	}
+
+	serverCtx, serverCancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+	defer serverCancel()
+
+	err = server.Shutdown(serverCtx)
+	if err != nil {
+		logrus.Warn(fmt.Sprintf("http server was not stopped gracefully: %v", err))
+		return nil
 	}
 
+	logrus.Info("server stopped")
 	return nil
 }
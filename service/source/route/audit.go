@@ -0,0 +1,268 @@
+package route
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dvgavrilov/gochat/service/source/audit"
+	"github.com/dvgavrilov/gochat/service/source/messaging"
+	"github.com/dvgavrilov/gochat/service/source/models"
+	"github.com/go-chi/render"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+	exportPageSize    = 500
+)
+
+var (
+	// ErrExportFormat error
+	ErrExportFormat = errors.New("export format must be csv or json")
+)
+
+type auditEntry struct {
+	ID         uint            `json:"id"`
+	ActorID    uint            `json:"actor_id"`
+	ActorRole  string          `json:"actor_role"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"target_type"`
+	TargetID   string          `json:"target_id"`
+	Metadata   json.RawMessage `json:"metadata,omitempty"`
+	RemoteAddr string          `json:"remote_addr"`
+	CreatedAt  time.Time       `json:"create_at"`
+}
+
+type auditQueryResult struct {
+	Entries []*auditEntry `json:"entries"`
+	Limit   int           `json:"limit"`
+	Offset  int           `json:"offset"`
+}
+
+// onQueryAudit ищет по журналу аудита: actor_id, target_type, target_id, from и to (RFC 3339), limit и offset
+func onQueryAudit(w http.ResponseWriter, r *http.Request) {
+	filter, err := auditFilter(r)
+	if err != nil {
+		adminError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	if filter.Limit <= 0 {
+		filter.Limit = defaultAuditLimit
+	}
+	if filter.Limit > maxAuditLimit {
+		filter.Limit = maxAuditLimit
+	}
+
+	entries, err := audit.Find(filter)
+	if err != nil {
+		logrus.Error(err)
+		adminError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	render.JSON(w, r, auditQueryResult{
+		Entries: convertAuditEntries(entries),
+		Limit:   filter.Limit,
+		Offset:  filter.Offset,
+	})
+}
+
+// onExportAudit выгружает все найденные записи в формате format=csv или json, читая журнал постранично
+func onExportAudit(w http.ResponseWriter, r *http.Request) {
+	filter, err := auditFilter(r)
+	if err != nil {
+		adminError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+
+	var export auditExporter
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		export = newCSVAuditExporter(w)
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		export = &jsonAuditExporter{w: w}
+	default:
+		adminError(w, r, http.StatusBadRequest, ErrExportFormat)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"audit-%s.%s\"", time.Now().UTC().Format("20060102-150405"), format))
+
+	filter.Limit = exportPageSize
+	filter.Offset = 0
+	for {
+		entries, err := audit.Find(filter)
+		if err != nil {
+			// заголовки уже отправлены, остаётся прервать выгрузку
+			logrus.Error(fmt.Sprintf("audit export interrupted: %v", err))
+			return
+		}
+
+		for i := range *entries {
+			err = export.write(convertAuditEntry(&(*entries)[i]))
+			if err != nil {
+				logrus.Error(fmt.Sprintf("audit export interrupted: %v", err))
+				return
+			}
+		}
+
+		if len(*entries) < exportPageSize {
+			break
+		}
+		filter.Offset += exportPageSize
+	}
+
+	err = export.close()
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+type auditExporter interface {
+	write(entry *auditEntry) error
+	close() error
+}
+
+type csvAuditExporter struct {
+	w *csv.Writer
+}
+
+func newCSVAuditExporter(w http.ResponseWriter) *csvAuditExporter {
+	e := &csvAuditExporter{w: csv.NewWriter(w)}
+	e.w.Write([]string{"id", "created_at", "actor_id", "actor_role", "action", "target_type", "target_id", "remote_addr", "metadata"})
+	return e
+}
+
+func (e *csvAuditExporter) write(entry *auditEntry) error {
+	return e.w.Write([]string{
+		strconv.FormatUint(uint64(entry.ID), 10),
+		entry.CreatedAt.Format(time.RFC3339),
+		strconv.FormatUint(uint64(entry.ActorID), 10),
+		messaging.CSVCell(entry.ActorRole),
+		messaging.CSVCell(entry.Action),
+		messaging.CSVCell(entry.TargetType),
+		messaging.CSVCell(entry.TargetID),
+		messaging.CSVCell(entry.RemoteAddr),
+		messaging.CSVCell(string(entry.Metadata)),
+	})
+}
+
+func (e *csvAuditExporter) close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type jsonAuditExporter struct {
+	w       http.ResponseWriter
+	written int
+}
+
+func (e *jsonAuditExporter) write(entry *auditEntry) error {
+	prefix := ","
+	if e.written == 0 {
+		prefix = "["
+	}
+
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	e.written++
+	_, err = e.w.Write(append([]byte(prefix), raw...))
+	return err
+}
+
+func (e *jsonAuditExporter) close() error {
+	end := "]"
+	if e.written == 0 {
+		end = "[]"
+	}
+
+	_, err := e.w.Write([]byte(end))
+	return err
+}
+
+func auditFilter(r *http.Request) (models.AuditFilter, error) {
+	q := r.URL.Query()
+	filter := models.AuditFilter{
+		TargetType: q.Get("target_type"),
+		TargetID:   q.Get("target_id"),
+	}
+
+	var err error
+	if v := q.Get("actor_id"); v != "" {
+		var id uint64
+		id, err = strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return filter, fmt.Errorf("actor_id %q is invalid", v)
+		}
+		filter.ActorID = uint(id)
+	}
+
+	for name, dst := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if v := q.Get(name); v != "" {
+			*dst, err = time.Parse(time.RFC3339, v)
+			if err != nil {
+				return filter, fmt.Errorf("%s %q is not a RFC 3339 time", name, v)
+			}
+		}
+	}
+
+	for name, dst := range map[string]*int{"limit": &filter.Limit, "offset": &filter.Offset} {
+		if v := q.Get(name); v != "" {
+			*dst, err = strconv.Atoi(v)
+			if err != nil || *dst < 0 {
+				return filter, fmt.Errorf("%s %q is invalid", name, v)
+			}
+		}
+	}
+
+	return filter, nil
+}
+
+func convertAuditEntries(entries *[]models.AuditEntry) []*auditEntry {
+	ret := make([]*auditEntry, 0)
+	if entries == nil {
+		return ret
+	}
+
+	for i := range *entries {
+		ret = append(ret, convertAuditEntry(&(*entries)[i]))
+	}
+
+	return ret
+}
+
+func convertAuditEntry(model *models.AuditEntry) *auditEntry {
+	ret := &auditEntry{
+		ID:         model.ID,
+		ActorID:    model.ActorID,
+		ActorRole:  model.ActorRole,
+		Action:     model.Action,
+		TargetType: model.TargetType,
+		TargetID:   model.TargetID,
+		RemoteAddr: model.RemoteAddr,
+		CreatedAt:  model.CreatedAt,
+	}
+
+	if model.Metadata != "" {
+		ret.Metadata = json.RawMessage(model.Metadata)
+	}
+
+	return ret
+}
@@ -0,0 +1,44 @@
+package route
+
+import (
+	"net/http"
+
+	"github.com/dvgavrilov/gochat/service/source/audit"
+	"github.com/dvgavrilov/gochat/service/source/encryption"
+	"github.com/dvgavrilov/gochat/service/source/messaging"
+	"github.com/dvgavrilov/gochat/service/source/persistence"
+	"github.com/go-chi/render"
+)
+
+const manageEncryptionAction = "Admin.ManageEncryption"
+
+type encryptionStatus struct {
+	ActiveKeyVersion uint `json:"active_key_version"`
+	// Messages количество сообщений по версиям ключа, версия 0 - незашифрованные
+	Messages map[uint]int `json:"messages"`
+}
+
+// onEncryptionStatus показывает, сколько сообщений ещё не переведено на активный ключ
+func onEncryptionStatus(w http.ResponseWriter, r *http.Request) {
+	counts, err := persistence.GetMessageKeysProvider().CountByKeyVersion()
+	if err != nil {
+		adminError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	render.JSON(w, r, encryptionStatus{ActiveKeyVersion: encryption.ActiveVersion(), Messages: counts})
+}
+
+// onReencrypt сразу переводит сообщения на активный ключ, не дожидаясь запуска по расписанию
+func onReencrypt(w http.ResponseWriter, r *http.Request) {
+	if encryption.ActiveVersion() == 0 {
+		adminError(w, r, http.StatusConflict, encryption.ErrDisabled)
+		return
+	}
+
+	report := persistence.Reencrypt()
+	audit.Record(messaging.ActorFromRequest(r), audit.Reencryption, audit.TargetConfig, "encryption",
+		map[string]interface{}{"key_version": report.KeyVersion, "reencrypted": report.Reencrypted, "error": report.Error})
+
+	render.JSON(w, r, report)
+}
@@ -0,0 +1,70 @@
+package route
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/dvgavrilov/gochat/service/source/messaging"
+	"github.com/dvgavrilov/gochat/service/source/persistence"
+	"github.com/go-chi/render"
+)
+
+const readinessTimeout = 2 * time.Second
+
+const (
+	healthOk          = "ok"
+	healthUnavailable = "unavailable"
+)
+
+type dependencyHealth struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type healthResult struct {
+	Status string                      `json:"status"`
+	Checks map[string]dependencyHealth `json:"checks,omitempty"`
+}
+
+// onLiveness отвечает, пока процесс жив и обрабатывает запросы
+func onLiveness(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, healthResult{Status: healthOk})
+}
+
+// onReadiness проверяет Postgres, Redis при включённом CacheHistory и то, что сервер не останавливается
+func onReadiness(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	result := healthResult{
+		Status: healthOk,
+		Checks: make(map[string]dependencyHealth),
+	}
+
+	check := func(name string, err error) {
+		if err != nil {
+			result.Status = healthUnavailable
+			result.Checks[name] = dependencyHealth{Status: healthUnavailable, Error: err.Error()}
+			return
+		}
+
+		result.Checks[name] = dependencyHealth{Status: healthOk}
+	}
+
+	for name, err := range persistence.Ping(ctx) {
+		check(name, err)
+	}
+
+	if messaging.IsDraining() {
+		check("server", messaging.ErrHubDraining)
+	} else {
+		check("server", nil)
+	}
+
+	if result.Status != healthOk {
+		render.Status(r, http.StatusServiceUnavailable)
+	}
+
+	render.JSON(w, r, result)
+}
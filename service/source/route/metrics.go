@@ -0,0 +1,71 @@
+package route
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/dvgavrilov/gochat/service/source/config"
+	"github.com/dvgavrilov/gochat/service/source/metrics"
+)
+
+// onMetrics отдаёт метрики Prometheus, если они включены, запрос пришёл из AllowedNetworks
+// и, когда задан MetricsSettings.Token, содержит этот токен
+func onMetrics(w http.ResponseWriter, r *http.Request) {
+	settings := config.Current().MetricsSettings
+	if !settings.Enabled {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !fromAllowedNetwork(r, settings.AllowedNetworks) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	if settings.Token != "" && !hasBearerToken(r, settings.Token) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	metrics.Handler().ServeHTTP(w, r)
+}
+
+// fromAllowedNetwork проверяет адрес соединения, заголовкам прокси не доверяет
+func fromAllowedNetwork(r *http.Request, networks []string) bool {
+	if len(networks) == 0 {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range networks {
+		_, ipnet, err := net.ParseCIDR(network)
+		if err == nil && ipnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasBearerToken(r *http.Request, token string) bool {
+	const prefix = "Bearer "
+
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, prefix) {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, prefix)), []byte(token)) == 1
+}
@@ -0,0 +1,85 @@
+package route
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/dvgavrilov/gochat/service/source/audit"
+	"github.com/dvgavrilov/gochat/service/source/messaging"
+	"github.com/dvgavrilov/gochat/service/source/privacy"
+	"github.com/go-chi/render"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	exportUserDataAction = "Admin.ExportUserData"
+	eraseUserDataAction  = "Admin.EraseUserData"
+)
+
+type eraseArgs struct {
+	// Mode delete или pseudonymize, значения по умолчанию нет
+	Mode string `json:"mode"`
+	// Reason основание запроса, например номер обращения, попадает в журнал аудита
+	Reason string `json:"reason"`
+}
+
+// onExportUserData отдаёт zip архив со всеми данными пользователя
+func onExportUserData(w http.ResponseWriter, r *http.Request) {
+	userID, err := urlUserID(r)
+	if err != nil {
+		adminError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	audit.Record(messaging.ActorFromRequest(r), audit.SubjectExport, audit.TargetUser, userID,
+		map[string]interface{}{"user_agent": r.UserAgent()})
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"user-%v-data.zip\"", userID))
+
+	err = privacy.Export(w, userID)
+	if err != nil {
+		// заголовки уже отправлены, клиент получит повреждённый архив
+		logrus.Error(fmt.Sprintf("user data export interrupted: %v", err))
+	}
+}
+
+// onEraseUserData удаляет или псевдонимизирует данные пользователя и отключает его сокеты
+func onEraseUserData(w http.ResponseWriter, r *http.Request) {
+	userID, err := urlUserID(r)
+	if err != nil {
+		adminError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	args := &eraseArgs{}
+	err = json.NewDecoder(r.Body).Decode(args)
+	if err != nil {
+		adminError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	if args.Mode != privacy.ModeDelete && args.Mode != privacy.ModePseudonymize {
+		adminError(w, r, http.StatusBadRequest, privacy.ErrErasureMode)
+		return
+	}
+
+	// сначала отключаем пользователя, чтобы он не успел записать новые данные во время удаления
+	actor := messaging.ActorFromRequest(r)
+	closed := messaging.DisconnectUser(userID, "user data is being erased")
+
+	report, err := privacy.Erase(userID, args.Mode)
+	if err != nil {
+		logrus.Error(err)
+		audit.Record(actor, audit.SubjectErasure, audit.TargetUser, userID,
+			map[string]interface{}{"mode": args.Mode, "reason": args.Reason, "error": err.Error()})
+		adminError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	audit.Record(actor, audit.SubjectErasure, audit.TargetUser, userID,
+		map[string]interface{}{"mode": args.Mode, "reason": args.Reason, "result": report.Result, "sockets": closed})
+
+	render.JSON(w, r, report)
+}
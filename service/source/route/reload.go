@@ -0,0 +1,98 @@
+package route
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/dvgavrilov/gochat/service/source/audit"
+	"github.com/dvgavrilov/gochat/service/source/config"
+	"github.com/dvgavrilov/gochat/service/source/encryption"
+	"github.com/dvgavrilov/gochat/service/source/messaging"
+	"github.com/go-chi/render"
+	"github.com/sirupsen/logrus"
+)
+
+const reloadConfigurationAction = "Admin.ReloadConfiguration"
+
+// systemRole роль в журнале аудита для действий, которые сервер выполняет сам
+const systemRole = "system"
+
+type reloadResult struct {
+	Ok      bool            `json:"ok"`
+	Error   string          `json:"error,omitempty"`
+	Changes []config.Change `json:"changes"`
+}
+
+// reloadConfiguration перечитывает конфигурацию и пишет в журнал, что изменилось
+func reloadConfiguration(actor audit.Actor, source string) ([]config.Change, error) {
+	changes, err := config.Reload()
+	if err != nil {
+		logrus.Error(fmt.Sprintf("configuration reload (%s) rejected: %v", source, err))
+		audit.Record(actor, audit.ConfigReload, audit.TargetConfig, "configuration",
+			map[string]interface{}{"source": source, "error": err.Error()})
+		return nil, err
+	}
+
+	fields := make([]string, 0, len(changes))
+	for _, c := range changes {
+		fields = append(fields, c.Field)
+	}
+	audit.Record(actor, audit.ConfigReload, audit.TargetConfig, "configuration",
+		map[string]interface{}{"source": source, "changed": fields})
+
+	// ключи перечитываются всегда, так как при ротации меняется содержимое JWKS файла, а не путь к нему
+	err = messaging.ReloadKeys()
+	if err != nil {
+		logrus.Error(fmt.Sprintf("configuration reload (%s): signing keys were not reloaded: %v", source, err))
+	}
+
+	// при ротации в файл ключей шифрования добавляется новая версия, а путь к нему остаётся прежним
+	err = encryption.Reload()
+	if err != nil {
+		logrus.Error(fmt.Sprintf("configuration reload (%s): encryption keys were not reloaded: %v", source, err))
+	}
+
+	if len(changes) == 0 {
+		logrus.Info(fmt.Sprintf("configuration reload (%s): nothing changed", source))
+	}
+
+	for _, c := range changes {
+		if c.Applied {
+			logrus.Info(fmt.Sprintf("configuration reload (%s): %s changed from %q to %q", source, c.Field, c.Old, c.New))
+		} else {
+			logrus.Warn(fmt.Sprintf("configuration reload (%s): %s changed from %q to %q, restart is required to apply it", source, c.Field, c.Old, c.New))
+		}
+	}
+
+	return changes, nil
+}
+
+// watchConfigReload перезагружает конфигурацию по сигналу SIGHUP до закрытия stop
+func watchConfigReload(stop <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hup:
+			reloadConfiguration(audit.Actor{Role: systemRole}, "SIGHUP")
+		}
+	}
+}
+
+func onReloadConfiguration(w http.ResponseWriter, r *http.Request) {
+	changes, err := reloadConfiguration(messaging.ActorFromRequest(r), fmt.Sprintf("admin endpoint, %v", r.RemoteAddr))
+	if err != nil {
+		render.Status(r, http.StatusUnprocessableEntity)
+		render.JSON(w, r, reloadResult{Ok: false, Error: err.Error(), Changes: []config.Change{}})
+		return
+	}
+
+	render.JSON(w, r, reloadResult{Ok: true, Changes: changes})
+}
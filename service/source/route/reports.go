@@ -0,0 +1,62 @@
+package route
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/dvgavrilov/gochat/service/source/messaging"
+	"github.com/go-chi/render"
+)
+
+const (
+	slaReportAction = "Report.SLA"
+
+	defaultReportPeriod = 7 * 24 * time.Hour
+)
+
+type reportError struct {
+	Ok    bool   `json:"ok"`
+	Error string `json:"error"`
+}
+
+// onSLAReport отдаёт показатели времени ответа за период from - to (RFC 3339),
+// по умолчанию за последние семь дней
+func onSLAReport(w http.ResponseWriter, r *http.Request) {
+	from, to, err := reportPeriod(r)
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, reportError{Ok: false, Error: err.Error()})
+		return
+	}
+
+	report, err := messaging.BuildSLAReport(from, to)
+	if err != nil {
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, reportError{Ok: false, Error: err.Error()})
+		return
+	}
+
+	render.JSON(w, r, report)
+}
+
+func reportPeriod(r *http.Request) (time.Time, time.Time, error) {
+	to := time.Now().UTC()
+	if value := r.URL.Query().Get("to"); value != "" {
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		to = t
+	}
+
+	from := to.Add(-defaultReportPeriod)
+	if value := r.URL.Query().Get("from"); value != "" {
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		from = t
+	}
+
+	return from, to, nil
+}
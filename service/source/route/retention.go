@@ -0,0 +1,49 @@
+package route
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/dvgavrilov/gochat/service/source/config"
+	"github.com/dvgavrilov/gochat/service/source/messaging"
+	"github.com/dvgavrilov/gochat/service/source/retention"
+	"github.com/go-chi/render"
+)
+
+const manageRetentionAction = "Admin.ManageRetention"
+
+type retentionRunArgs struct {
+	// DryRun по умолчанию берётся из RetentionSettings.DryRun
+	DryRun *bool `json:"dry_run"`
+}
+
+// onRetentionReport отдаёт отчёт последнего запуска очистки
+func onRetentionReport(w http.ResponseWriter, r *http.Request) {
+	report := retention.LastReport()
+	if report == nil {
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, adminResult{Ok: false, Error: "retention has not run yet"})
+		return
+	}
+
+	render.JSON(w, r, report)
+}
+
+// onRetentionRun применяет политики хранения сразу, не дожидаясь запуска по расписанию
+func onRetentionRun(w http.ResponseWriter, r *http.Request) {
+	args := &retentionRunArgs{}
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(args)
+		if err != nil {
+			adminError(w, r, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	dryRun := config.Current().RetentionSettings.DryRun
+	if args.DryRun != nil {
+		dryRun = *args.DryRun
+	}
+
+	render.JSON(w, r, retention.Run(messaging.ActorFromRequest(r), dryRun))
+}
@@ -0,0 +1,226 @@
+package route
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dvgavrilov/gochat/service/source/config"
+	"github.com/sirupsen/logrus"
+)
+
+const certCheckPeriod = 30 * time.Second
+
+var (
+	// ErrTLSSettingsMissing error
+	ErrTLSSettingsMissing = errors.New("TLSSettings.CertFile and TLSSettings.KeyFile are required when DebugMode is off")
+	// ErrTLSVersionInvalid error
+	ErrTLSVersionInvalid = errors.New("TLSSettings.MinVersion must be one of 1.0, 1.1, 1.2, 1.3")
+	// ErrClientCAInvalid error
+	ErrClientCAInvalid = errors.New("no certificates found in TLSSettings.ClientCAFile")
+)
+
+// certificateReloader хранит текущие сертификат и пул клиентских CA и перечитывает их с диска
+// при изменении файлов или по сигналу SIGHUP. Уже установленные соединения при этом не затрагиваются,
+// новые конфигурации применяются только к новым TLS рукопожатиям.
+type certificateReloader struct {
+	mux        sync.RWMutex
+	settings   config.TLSSettings
+	minVersion uint16
+	cert       *tls.Certificate
+	clientCAs  *x509.CertPool
+	modTimes   map[string]time.Time
+}
+
+func newCertificateReloader(settings config.TLSSettings) (*certificateReloader, error) {
+	if settings.CertFile == "" || settings.KeyFile == "" {
+		return nil, ErrTLSSettingsMissing
+	}
+
+	minVersion, err := parseTLSVersion(settings.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &certificateReloader{
+		settings:   settings,
+		minVersion: minVersion,
+	}
+
+	err = r.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *certificateReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.settings.CertFile, r.settings.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	var pool *x509.CertPool
+	if r.settings.ClientCAFile != "" {
+		raw, err := ioutil.ReadFile(r.settings.ClientCAFile)
+		if err != nil {
+			return err
+		}
+
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(raw) {
+			return ErrClientCAInvalid
+		}
+	}
+
+	modTimes := r.readModTimes()
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.cert = &cert
+	r.clientCAs = pool
+	r.modTimes = modTimes
+
+	return nil
+}
+
+func (r *certificateReloader) files() []string {
+	ret := []string{r.settings.CertFile, r.settings.KeyFile}
+	if r.settings.ClientCAFile != "" {
+		ret = append(ret, r.settings.ClientCAFile)
+	}
+
+	return ret
+}
+
+func (r *certificateReloader) readModTimes() map[string]time.Time {
+	ret := make(map[string]time.Time)
+	for _, f := range r.files() {
+		info, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		ret[f] = info.ModTime()
+	}
+
+	return ret
+}
+
+func (r *certificateReloader) changed() bool {
+	current := r.readModTimes()
+
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	for f, t := range current {
+		if !t.Equal(r.modTimes[f]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *certificateReloader) tryReload(reason string) {
+	err := r.reload()
+	if err != nil {
+		// старый сертификат остаётся в работе
+		logrus.Error(fmt.Sprintf("TLS certificates reload (%s) failed: %v", reason, err))
+		return
+	}
+
+	logrus.Info(fmt.Sprintf("TLS certificates reloaded (%s)", reason))
+}
+
+// watch отслеживает изменения файлов и сигнал SIGHUP до закрытия stop
+func (r *certificateReloader) watch(stop <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(certCheckPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hup:
+			r.tryReload("SIGHUP")
+		case <-ticker.C:
+			if r.changed() {
+				r.tryReload("files changed")
+			}
+		}
+	}
+}
+
+func (r *certificateReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	return r.cert, nil
+}
+
+func (r *certificateReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	return r.newConfig(), nil
+}
+
+// tlsConfig возвращает конфигурацию для http.Server, которая на каждое рукопожатие
+// берёт актуальные сертификаты через GetConfigForClient
+func (r *certificateReloader) tlsConfig() *tls.Config {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	ret := r.newConfig()
+	ret.GetCertificate = r.getCertificate
+	ret.GetConfigForClient = r.getConfigForClient
+
+	return ret
+}
+
+// newConfig вызывается под блокировкой mux
+func (r *certificateReloader) newConfig() *tls.Config {
+	ret := &tls.Config{
+		MinVersion:   r.minVersion,
+		Certificates: []tls.Certificate{*r.cert},
+		// web socket upgrade работает только поверх http/1.1
+		NextProtos: []string{"http/1.1"},
+	}
+
+	if r.clientCAs != nil {
+		ret.ClientCAs = r.clientCAs
+		ret.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return ret
+}
+
+func parseTLSVersion(value string) (uint16, error) {
+	switch value {
+	case "":
+		return tls.VersionTLS12, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+
+	return 0, ErrTLSVersionInvalid
+}
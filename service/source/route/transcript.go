@@ -0,0 +1,55 @@
+package route
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/dvgavrilov/gochat/service/source/messaging"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/sirupsen/logrus"
+)
+
+// onExportTranscript выгружает историю беседы в формате format=json (по умолчанию), csv или html
+func onExportTranscript(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = messaging.TranscriptJSON
+	}
+
+	if !messaging.IsTranscriptFormat(format) {
+		transcriptError(w, r, http.StatusBadRequest, messaging.ErrTranscriptFormat)
+		return
+	}
+
+	transcript, err := messaging.OpenTranscript(messaging.ActorFromRequest(r), chi.URLParam(r, "sessionChannel"))
+	switch err {
+	case nil:
+	case messaging.ErrSessionChannelInvalid:
+		transcriptError(w, r, http.StatusBadRequest, err)
+		return
+	case messaging.ErrConversationNotFound:
+		transcriptError(w, r, http.StatusNotFound, err)
+		return
+	case messaging.ErrNotConversationMember:
+		transcriptError(w, r, http.StatusForbidden, err)
+		return
+	default:
+		transcriptError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", messaging.TranscriptContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", transcript.Filename(format)))
+
+	err = transcript.Write(w, format)
+	if err != nil {
+		// заголовки уже отправлены, клиент получит оборванный файл
+		logrus.Error(fmt.Sprintf("transcript export interrupted: %v", err))
+	}
+}
+
+func transcriptError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	render.Status(r, status)
+	render.JSON(w, r, reportError{Ok: false, Error: err.Error()})
+}